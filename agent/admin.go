@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"net/http"
+
+	"mediamagi.ru/win-file-agent/server"
+	"mediamagi.ru/win-file-agent/server/controllers"
+)
+
+// adminHandlers пауза агента через запросы. В windows пауза агента - это пауза сервиса
+func adminHandlers(agentController *controllers.Agent) []server.ArgsHandler {
+	return []server.ArgsHandler{
+		server.Handler(http.MethodGet, "/v1/agent", agentController.Get),
+		server.Handler(http.MethodPost, "/v1/agent/pause", agentController.Pause),
+		server.Handler(http.MethodPost, "/v1/agent/resume", agentController.Resume),
+	}
+}
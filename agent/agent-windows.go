@@ -13,6 +13,9 @@ import (
 
 	"mediamagi.ru/win-file-agent/config"
 	log1 "mediamagi.ru/win-file-agent/log"
+	"mediamagi.ru/win-file-agent/server"
+	"mediamagi.ru/win-file-agent/server/controllers"
+	"mediamagi.ru/win-file-agent/worker"
 
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
@@ -47,11 +50,18 @@ func (a *agentWindows) Execute(args []string, r <-chan svc.ChangeRequest, change
 	slowtick := time.Tick(2 * time.Second)
 	tick := fasttick
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+	// остановка, начатая запросом drain, останавливает и сервис
+	var drained = a.a.Drained()
 
 loop:
 	for {
 		select {
 		case <-tick:
+		case <-drained:
+			elog.Info(1, "drained")
+			changes <- svc.Status{State: svc.StopPending}
+			a.a.OnStop()
+			break loop
 		case c := <-r:
 			switch c.Cmd {
 			case svc.Interrogate:
@@ -65,17 +75,19 @@ loop:
 				testOutput += fmt.Sprintf("-%d", c.Context)
 				elog.Info(1, testOutput)
 
+				// задания завершаются до drain_timeout, затем воркеры останавливаются
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((worker.DrainTimeout() + time.Minute).Milliseconds())}
 				a.a.OnStop()
 				break loop
 			case svc.Pause:
+				// новые задания не запускаются, выполняющиеся завершаются
+				a.a.Pause()
 				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
 				tick = slowtick
 			case svc.Continue:
+				a.a.Resume()
 				changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 				tick = fasttick
-				if err := a.a.Start(a.ctx); err != nil {
-					elog.Error(1, fmt.Sprintf("%s service failed: %v", a.name, err))
-				}
 			default:
 				elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
 			}
@@ -86,6 +98,11 @@ loop:
 	return
 }
 
+// adminHandlers в windows пауза агента - это пауза сервиса (pause, continue)
+func adminHandlers(agentController *controllers.Agent) []server.ArgsHandler {
+	return nil
+}
+
 func RunService(name string, isDebug bool) {
 	var err error
 	if isDebug {
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/log"
 	"mediamagi.ru/win-file-agent/server"
 	"mediamagi.ru/win-file-agent/server/controllers"
 	"mediamagi.ru/win-file-agent/store"
@@ -14,24 +15,38 @@ import (
 type Agent struct {
 	s server.Server
 	w *worker.Worker
+	t *controllers.Task
 }
 
 func New(ctx context.Context) *Agent {
 	var store = store.NewRam[string, *worker.Task](ctx)
 	var w = worker.New(store)
 	var taskController = controllers.NewTask(store, w)
+	var agentController = controllers.NewAgent(w)
 	// обычный запуск
-	var s = server.New(
+	var handlers = []server.ArgsHandler{
 		server.Port(config.Load().Port),
 		server.Handler(http.MethodGet, "/v1/task/{id}", taskController.Get),
 		server.Handler(http.MethodGet, "/v1/task", taskController.GetAll),
 		server.Handler(http.MethodPost, "/v1/task", taskController.Create),
+		server.Handler(http.MethodPost, "/v1/tasks:batch", taskController.CreateBatch),
+		server.Handler(http.MethodDelete, "/v1/tasks", taskController.DeleteBatch),
 		server.Handler(http.MethodDelete, "/v1/task/{id}", taskController.Delete),
-	)
+		server.Handler(http.MethodPost, "/v1/task/{id}/pause", taskController.Pause),
+		server.Handler(http.MethodPost, "/v1/task/{id}/resume", taskController.Resume),
+		server.Handler(http.MethodPost, "/v1/task/{id}/rerun", taskController.Rerun),
+		server.StreamHandler(http.MethodPost, "/v1/task/{id}/files", taskController.Upload),
+		server.Handler(http.MethodGet, "/v1/task/{id}/files", taskController.Files),
+		server.RawHandler(http.MethodGet, "/v1/task/{id}/files/{name...}", taskController.File),
+		server.Handler(http.MethodGet, "/v1/agent/drain", agentController.DrainStatus),
+		server.Handler(http.MethodPost, "/v1/agent/drain", agentController.Drain),
+	}
+	var s = server.New(append(handlers, adminHandlers(agentController)...)...)
 
 	return &Agent{
 		w: w,
 		s: s,
+		t: taskController,
 	}
 }
 
@@ -40,15 +55,56 @@ func (c *Agent) Start(ctx context.Context) error {
 	if err := c.w.Run(ctx); err != nil {
 		return err
 	}
-
 	if err := c.s.Run(ctx); err != nil {
 		return err
 	}
+	// задания ставятся в очередь, когда в ней есть место, и не задерживают старт сервиса
+	c.restore()
 	return nil
 }
 
-// OnStop вызывается из Windows ServiceControlManager
+// Pause останавливает запуск новых заданий, выполняющиеся задания завершаются
+func (c *Agent) Pause() {
+	c.w.PauseQueue()
+}
+
+// Resume продолжает запуск заданий после Pause
+func (c *Agent) Resume() {
+	c.w.ResumeQueue()
+}
+
+// restore запускает задания, сохраненные при прошлой остановке
+func (c *Agent) restore() {
+	requests, err := worker.LoadDrained()
+	if err != nil {
+		log.Error("Load drained tasks error: %+v", err)
+		return
+	}
+	for _, it := range requests {
+		id, err := c.t.Restore(it)
+		if err != nil {
+			log.Error("Restore drained task error: %+v", err)
+			continue
+		}
+		log.Info("Task %s restored after drain", id)
+	}
+}
+
+// OnStop вызывается из Windows ServiceControlManager. Задания завершаются до drain_timeout,
+// оставшиеся сохраняются и запускаются после перезапуска
 func (c *Agent) OnStop() {
+	<-c.w.Drain(worker.DrainTimeout())
 	c.w.Stop()
 	c.s.Stop()
 }
+
+// StopNow ускоряет начатую остановку: задания не ждутся, оставшиеся сохраняются сразу
+func (c *Agent) StopNow() {
+	c.w.DrainNow()
+}
+
+// Drained закрывается после остановки заданий, в том числе начатой запросом Post, "/v1/agent/drain".
+// После этого процесс агента должен завершиться через OnStop
+func (c *Agent) Drained() <-chan struct{} {
+	return c.w.Drained()
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync/atomic"
 
 	"mediamagi.ru/win-file-agent/log"
@@ -13,10 +15,112 @@ import (
 var cfg atomic.Pointer[cfgData]
 
 type cfgData struct {
-	Port        int    `json:"port"`
-	WorkerCount int    `json:"worker_count"`
-	WorkerQueue int    `json:"worker_queue"`
-	TmpDir      string `json:"tmp_dir"`
+	Port        int          `json:"port"`
+	WorkerCount int          `json:"worker_count"`
+	WorkerQueue int          `json:"worker_queue"`
+	TmpDir      string       `json:"tmp_dir"`
+	FtpProfiles []FtpProfile `json:"ftp_profiles"`
+	// FileRoots папки, из которых разрешено забирать файлы по file:// ссылкам.
+	// Если не заданы, то ограничений нет.
+	FileRoots []string `json:"file_roots"`
+	// UploadMaxSize максимальный размер загружаемого в агент файла в байтах, 0 - без ограничения
+	UploadMaxSize int64 `json:"upload_max_size"`
+	// UploadTimeout сколько секунд задание ждет загрузки входящих файлов, по умолчанию час
+	UploadTimeout int `json:"upload_timeout"`
+	// OutputRetention сколько секунд задание и его результаты хранятся после завершения, по умолчанию минута
+	OutputRetention int `json:"output_retention"`
+	// S3 хранилище по умолчанию для s3:// ссылок и назначений s3
+	S3 S3Profile `json:"s3"`
+	// WorkRoots папки, внутри которых разрешены working_dir заданий и dir шагов.
+	// Если не заданы, то ограничений нет.
+	WorkRoots []string `json:"work_roots"`
+	// EnvAllow переменные окружения сервиса, которые передаются командам.
+	// Если не заданы, то команды получают все окружение сервиса.
+	EnvAllow []string `json:"env_allow"`
+	// StopGrace сколько секунд команда завершается после мягкой остановки (SIGTERM, Ctrl+Break),
+	// затем дерево процессов убивается, по умолчанию 5 секунд
+	StopGrace int `json:"stop_grace"`
+	// Limits ограничения ресурсов команд по умолчанию и их потолок, задание может их только уменьшить
+	Limits Limits `json:"limits"`
+	// CgroupRoot папка cgroup v2, делегированная сервису (linux), в ней создаются cgroup команд
+	// для ограничения памяти. Если не задана, то память ограничивается через rlimit
+	CgroupRoot string `json:"cgroup_root"`
+	// PauseReject на паузе агента новые задания отклоняются с 503,
+	// иначе они принимаются в очередь и ждут продолжения
+	PauseReject bool `json:"pause_reject"`
+	// DrainTimeout сколько секунд при остановке агента завершаются задания в очереди и в работе,
+	// оставшиеся сохраняются в DrainFile и запускаются заново при старте. По умолчанию минута,
+	// отрицательное значение - задания сразу сохраняются
+	DrainTimeout int `json:"drain_timeout"`
+	// DrainFile файл сохраненных заданий, по умолчанию drain.json рядом с исполняемым файлом
+	DrainFile string `json:"drain_file"`
+}
+
+// Limits ограничения ресурсов команд задания, 0 - без ограничения
+type Limits struct {
+	// MaxMemory память всех процессов команды в байтах
+	MaxMemory int64 `json:"max_memory,omitempty"`
+	// CpuAffinity номера процессоров, на которых выполняются команды
+	CpuAffinity []int `json:"cpu_affinity,omitempty"`
+	// Priority приоритет процессов: idle, below_normal, normal, above_normal, high
+	Priority string `json:"priority,omitempty"`
+	// MaxOutputSize размер каждого результата команды в байтах
+	MaxOutputSize int64 `json:"max_output_size,omitempty"`
+	// MaxTime время выполнения команд задания (этап PROCESS) в секундах
+	MaxTime int `json:"max_time,omitempty"`
+}
+
+// Merge лимиты конфига, уточненные лимитами задания task. Лимиты конфига - потолок:
+// память, размер результата и время задания берутся, только если они меньше.
+// Что priority и cpu_affinity задания не выходят за конфиг, проверяется при создании задания.
+func (c Limits) Merge(task *Limits) Limits {
+	if task == nil {
+		return c
+	}
+	c.MaxMemory = minLimit(c.MaxMemory, task.MaxMemory)
+	if len(task.CpuAffinity) > 0 {
+		c.CpuAffinity = task.CpuAffinity
+	}
+	if len(task.Priority) > 0 {
+		c.Priority = task.Priority
+	}
+	c.MaxOutputSize = minLimit(c.MaxOutputSize, task.MaxOutputSize)
+	c.MaxTime = minLimit(c.MaxTime, task.MaxTime)
+	return c
+}
+
+// minLimit меньший из лимитов, 0 - без ограничения
+func minLimit[T int | int64](cfg, task T) T {
+	if task > 0 && (cfg <= 0 || task < cfg) {
+		return task
+	}
+	return cfg
+}
+
+// FtpProfile учетные данные ftp сервера, которые подставляются
+// в ftp:// ссылки без логина и пароля.
+type FtpProfile struct {
+	Addr  string `json:"addr"`
+	Login string `json:"login"`
+	Pass  string `json:"pass"`
+}
+
+// S3Profile адрес и ключи S3-совместимого хранилища
+type S3Profile struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// FindFtpProfile ищет профиль по адресу сервера в формате host:port.
+func (c *cfgData) FindFtpProfile(addr string) (*FtpProfile, bool) {
+	for idx := range c.FtpProfiles {
+		if c.FtpProfiles[idx].Addr == addr {
+			return &c.FtpProfiles[idx], true
+		}
+	}
+	return nil, false
 }
 
 func init() {
@@ -28,6 +132,74 @@ func init() {
 	})
 }
 
+// IsFileAllowed проверяет, что путь лежит внутри одной из FileRoots.
+// Символические ссылки в пути и в FileRoots раскрываются, ссылка из root наружу не проходит.
+func (c *cfgData) IsFileAllowed(path string) bool {
+	if len(c.FileRoots) == 0 {
+		return true
+	}
+	path = RealPath(path)
+	for _, root := range c.FileRoots {
+		if IsSubPath(RealPath(root), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWorkDirAllowed проверяет, что рабочая папка команды лежит внутри одной из WorkRoots
+func (c *cfgData) IsWorkDirAllowed(path string) bool {
+	if len(c.WorkRoots) == 0 {
+		return true
+	}
+	for _, root := range c.WorkRoots {
+		if IsSubPath(root, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEnvAllowed проверяет, что переменная окружения сервиса name передается командам
+func (c *cfgData) IsEnvAllowed(name string) bool {
+	if len(c.EnvAllow) == 0 {
+		return true
+	}
+	for _, it := range c.EnvAllow {
+		if strings.EqualFold(it, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSubPath проверяет, что path совпадает с root или лежит внутри него
+func IsSubPath(root, path string) bool {
+	if runtime.GOOS == "windows" {
+		root = strings.ToLower(root)
+		path = strings.ToLower(path)
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// RealPath раскрывает символические ссылки в пути.
+// Если файла еще нет, то раскрывается ближайшая существующая родительская папка.
+func RealPath(path string) string {
+	path = filepath.Clean(path)
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	var dir = filepath.Dir(path)
+	if dir == path {
+		return path
+	}
+	return filepath.Join(RealPath(dir), filepath.Base(path))
+}
+
 func Load() *cfgData {
 	return cfg.Load()
 }
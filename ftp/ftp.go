@@ -1,6 +1,7 @@
 package ftp
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -193,6 +194,54 @@ func DialWithDialFunc(f func(network, address string) (net.Conn, error)) DialOpt
 	}}
 }
 
+// DialWithTLS returns a DialOption that configures the ServerConn with specified TLS config
+//
+// If called together with the DialWithDialFunc option, the DialWithDialFunc function
+// will be used when dialing new connections but regardless of the function,
+// the connection will be treated as a TLS connection.
+func DialWithTLS(tlsConfig *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.tlsConfig = tlsConfig
+	}}
+}
+
+// DialWithExplicitTLS returns a DialOption that configures the ServerConn to be upgraded to TLS
+// See DialWithTLS for general TLS documentation
+func DialWithExplicitTLS(tlsConfig *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.explicitTLS = true
+		do.tlsConfig = tlsConfig
+	}}
+}
+
+// DialWithLocation returns a DialOption that configures the ServerConn with specified time.Location
+// The location is used to parse the dates sent by the server which are in server's timezone
+func DialWithLocation(location *time.Location) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.location = location
+	}}
+}
+
+// DialWithDisabledMLSD returns a DialOption that configures the ServerConn with MLSD option disabled
+//
+// This is useful for servers which advertise MLSD (eg some versions
+// of Serv-U) but don't support it properly.
+func DialWithDisabledMLSD(disabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.disableMLSD = disabled
+	}}
+}
+
+// DialWithForceListHidden returns a DialOption making ServerConn use LIST -a to include hidden files and folders in directory listings
+//
+// This is useful for servers that do not do this by default, but it forces the use of the LIST command
+// even if the server supports MLST.
+func DialWithForceListHidden(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.forceListHidden = enabled
+	}}
+}
+
 func (o *dialOptions) wrapConn(netConn net.Conn) io.ReadWriteCloser {
 	if o.debugOutput == nil {
 		return netConn
@@ -201,6 +250,14 @@ func (o *dialOptions) wrapConn(netConn net.Conn) io.ReadWriteCloser {
 	return newDebugWrapper(netConn, o.debugOutput)
 }
 
+func (o *dialOptions) wrapStream(rd io.ReadCloser) io.ReadCloser {
+	if o.debugOutput == nil {
+		return rd
+	}
+
+	return newStreamDebugWrapper(rd, o.debugOutput)
+}
+
 // Login authenticates the client with specified user and password.
 //
 // "anonymous"/"anonymous" is a common user/password scheme for FTP servers
@@ -511,9 +568,94 @@ func (c *ServerConn) cmdDataConnFrom(offset uint64, format string, args ...any)
 	return conn, nil
 }
 
+// NameList issues an NLST FTP command.
+func (c *ServerConn) NameList(path string) (entries []string, err error) {
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	conn, err := c.cmdDataConnFrom(0, "NLST%s%s", space, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs error
+	r := &Response{conn: conn, c: c}
+
+	scanner := bufio.NewScanner(c.options.wrapStream(r))
+	for scanner.Scan() {
+		entries = append(entries, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = errors.Join(errs, err)
+	}
+	if err := r.Close(); err != nil {
+		errs = errors.Join(errs, err)
+	}
+
+	return entries, errs
+}
+
+// List issues a LIST FTP command.
+//
+// If the server supports MLST, the MLSD command is used instead. When MLSD
+// is refused by the server the LIST command is used as a fallback.
+// The "." and ".." entries are not returned.
+func (c *ServerConn) List(path string) (entries []*Entry, err error) {
+	if c.mlstSupported && !c.options.forceListHidden {
+		entries, err = c.list("MLSD", path, parseRFC3659ListLine)
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) || protoErr.Code < 500 {
+			return entries, err
+		}
+		// сервер заявил MLST, но MLSD не поддерживает
+		c.mlstSupported = false
+	}
+
+	var cmd = "LIST"
+	if c.options.forceListHidden {
+		cmd = "LIST -a"
+	}
+	return c.list(cmd, path, parseListLine)
+}
+
+func (c *ServerConn) list(cmd, path string, parser parseFunc) (entries []*Entry, err error) {
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	conn, err := c.cmdDataConnFrom(0, "%s%s%s", cmd, space, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs error
+	r := &Response{conn: conn, c: c}
+
+	scanner := bufio.NewScanner(c.options.wrapStream(r))
+	now := time.Now()
+	for scanner.Scan() {
+		entry, errParse := parser(scanner.Text(), now, c.options.location)
+		if errParse != nil || entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = errors.Join(errs, err)
+	}
+	if err := r.Close(); err != nil {
+		errs = errors.Join(errs, err)
+	}
+
+	return entries, errs
+}
+
 // Type switches the transfer mode for the connection.
 func (c *ServerConn) Type(transferType TransferType) (err error) {
-	_, _, err = c.cmd(StatusCommandOK, "TYPE "+string(transferType))
+	_, _, err = c.cmd(StatusCommandOK, "TYPE %s", transferType)
 	return err
 }
 
@@ -588,6 +730,50 @@ func (c *ServerConn) StorFrom(path string, r io.Reader, offset uint64) error {
 	return errs
 }
 
+// Retr issues a RETR FTP command to fetch the specified file from the remote
+// FTP server.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
+func (c *ServerConn) Retr(path string) (*Response, error) {
+	return c.RetrFrom(path, 0)
+}
+
+// RetrFrom issues a RETR FTP command to fetch the specified file from the remote
+// FTP server, the server will not send the offset first bytes of the file.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
+func (c *ServerConn) RetrFrom(path string, offset uint64) (*Response, error) {
+	conn, err := c.cmdDataConnFrom(offset, "RETR %s", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{conn: conn, c: c}, nil
+}
+
+// FileSize issues a SIZE FTP command, which Returns the size of the file
+func (c *ServerConn) FileSize(path string) (int64, error) {
+	_, msg, err := c.cmd(StatusFile, "SIZE %s", path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+// IsNotImplemented reports whether err is the server reply to a command
+// it does not recognize or implement (500, 502).
+func IsNotImplemented(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && (protoErr.Code == StatusBadCommand || protoErr.Code == StatusNotImplemented)
+}
+
+// MakeDir issues a MKD FTP command to create the specified directory.
+func (c *ServerConn) MakeDir(path string) error {
+	_, _, err := c.cmd(StatusPathCreated, "MKD %s", path)
+	return err
+}
+
 // Quit issues a QUIT FTP command to properly close the connection from the
 // remote FTP server.
 func (c *ServerConn) Quit() error {
@@ -604,6 +790,16 @@ func (c *ServerConn) Quit() error {
 	return errs
 }
 
+// Read implements the io.Reader interface on a FTP data connection.
+func (r *Response) Read(buf []byte) (int, error) {
+	return r.conn.Read(buf)
+}
+
+// SetDeadline sets the deadlines associated with the connection.
+func (r *Response) SetDeadline(t time.Time) error {
+	return r.conn.SetDeadline(t)
+}
+
 // Close implements the io.Closer interface on a FTP data connection.
 // After the first call, Close will do nothing and return nil.
 func (r *Response) Close() error {
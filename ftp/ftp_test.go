@@ -0,0 +1,167 @@
+package ftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/ftp/ftptest"
+)
+
+// newFakeServer ftp сервер в памяти, который останавливается после теста
+func newFakeServer(t *testing.T, mlsd bool) *ftptest.Server {
+	var s = ftptest.NewServer(mlsd)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialFake(t *testing.T, s *ftptest.Server) *ServerConn {
+	var c, err = Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Login("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Quit() })
+	return c
+}
+
+func TestList(t *testing.T) {
+	for idx, mlsd := range []bool{true, false, true} {
+		var s = newFakeServer(t, mlsd)
+		s.RefuseMLSD = idx == 2
+		s.Put("/in/a.mov", []byte("aaa"))
+		s.Put("/in/b.mp4", []byte("bb"))
+		s.Put("/in/sub/c.mov", []byte("c"))
+
+		var c = dialFake(t, s)
+		entries, err := c.List("/in")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("mlsd %v entries %d", mlsd, len(entries))
+		}
+		if entries[0].Name != "a.mov" || entries[0].Size != 3 || entries[0].Type != EntryTypeFile {
+			t.Errorf("mlsd %v entry %+v", mlsd, *entries[0])
+		}
+		if entries[2].Name != "sub" || entries[2].Type != EntryTypeFolder {
+			t.Errorf("mlsd %v entry %+v", mlsd, *entries[2])
+		}
+
+		names, err := c.NameList("/in")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names, ",") != "a.mov,b.mp4,sub" {
+			t.Errorf("NameList %v", names)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	var s = newFakeServer(t, true)
+	s.Put("/in/a.mov", []byte("a"))
+	s.Put("/in/sub/b.mov", []byte("b"))
+	s.Put("/in/sub/deep/c.mov", []byte("c"))
+	s.Put("/in/skip/d.mov", []byte("d"))
+
+	var c = dialFake(t, s)
+	var files []string
+	var w = c.Walk("/in")
+	for w.Next() {
+		if w.Stat().Type == EntryTypeFolder && path.Base(w.Path()) == "skip" {
+			w.SkipDir()
+			continue
+		}
+		if w.Stat().Type == EntryTypeFile {
+			files = append(files, w.Path())
+		}
+	}
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "/in/a.mov,/in/sub/b.mov,/in/sub/deep/c.mov" {
+		t.Errorf("files %v", files)
+	}
+}
+
+func TestRetrFromStorFrom(t *testing.T) {
+	var s = newFakeServer(t, false)
+	var c = dialFake(t, s)
+
+	var data = []byte("0123456789")
+	if err := c.Stor("/f.bin", bytes.NewReader(data[:4])); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StorFrom("/f.bin", bytes.NewReader(data[4:]), 4); err != nil {
+		t.Fatal(err)
+	}
+	size, err := c.FileSize("/f.bin")
+	if err != nil || size != 10 {
+		t.Fatalf("size %d err %v", size, err)
+	}
+
+	r, err := c.RetrFrom("/f.bin", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer, _ = io.ReadAll(r)
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer) != "6789" {
+		t.Errorf("RetrFrom %q", buffer)
+	}
+
+	if _, err = c.FileSize("/none"); err == nil {
+		t.Error("FileSize expected error")
+	}
+
+	if err = c.MakeDir("/out"); err != nil {
+		t.Error(err)
+	}
+	if err = c.MakeDir("/out"); err == nil {
+		t.Error("MakeDir expected error for existing dir")
+	}
+}
+
+func TestHash(t *testing.T) {
+	var srv = newFakeServer(t, true)
+	srv.Hash = true
+	var data = []byte("hash data")
+	srv.Put("/out/a.mp4", data)
+
+	c, err := Dial(srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+	if err = c.Login("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	if algos := c.HashAlgorithms(); strings.Join(algos, ",") != "SHA-256,MD5,CRC32" {
+		t.Errorf("algorithms %v", algos)
+	}
+	var checks = map[string]string{
+		HashSHA256: fmt.Sprintf("%x", sha256.Sum256(data)),
+		HashMD5:    fmt.Sprintf("%x", md5.Sum(data)),
+		HashCRC32:  fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)),
+	}
+	for algo, expected := range checks {
+		if sum, err := c.Hash("/out/a.mp4", algo); err != nil || sum != expected {
+			t.Errorf("%s: %s err %v", algo, sum, err)
+		}
+	}
+	if _, err = c.Hash("/out/a.mp4", "SHA-512"); err != ErrHashNotSupported {
+		t.Errorf("SHA-512 err %v", err)
+	}
+}
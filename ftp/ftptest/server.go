@@ -0,0 +1,275 @@
+// Package ftptest минимальный ftp сервер в памяти для тестов.
+// Поддерживает пассивный режим EPSV, докачку REST, MLSD/LIST/NLST, SIZE и HASH,
+// умеет обрывать загрузку STOR.
+package ftptest
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DropBytes сколько байт сохраняет оборванная загрузка
+const DropBytes = 4
+
+// Server ftp сервер в памяти. Настройки меняются до подключения клиентов.
+type Server struct {
+	listener net.Listener
+	// Mlsd сервер поддерживает MLST/MLSD, иначе только LIST
+	Mlsd bool
+	// RefuseMLSD сервер заявляет MLST в FEAT, но отвечает ошибкой на MLSD
+	RefuseMLSD bool
+	// Hash сервер поддерживает HASH (SHA-256, MD5) и XCRC
+	Hash bool
+	// NoSize сервер не поддерживает SIZE
+	NoSize bool
+	// DropStor кол-во загрузок STOR, которые обрываются после DropBytes байт
+	DropStor int
+
+	lock  sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+// NewServer запускает сервер на случайном порту 127.0.0.1
+func NewServer(mlsd bool) *Server {
+	var l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("ftptest: failed to listen: %v", err))
+	}
+	var s = &Server{listener: l, Mlsd: mlsd, files: make(map[string][]byte), dirs: make(map[string]bool)}
+	go s.serve()
+	return s
+}
+
+// Addr адрес сервера host:port
+func (s *Server) Addr() string { return s.listener.Addr().String() }
+
+// Close останавливает прием новых соединений
+func (s *Server) Close() error { return s.listener.Close() }
+
+// Put сохраняет файл name (абсолютный путь) на сервере
+func (s *Server) Put(name string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[name] = data
+}
+
+// File содержимое файла name на сервере
+func (s *Server) File(name string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	var rd = bufio.NewReader(conn)
+	var reply = func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	var dataL net.Listener
+	var offset int64
+	var hashAlgo = "SHA-256"
+
+	var openData = func() net.Conn {
+		reply("150 Opening data connection")
+		c, err := dataL.Accept()
+		dataL.Close()
+		if err != nil {
+			return nil
+		}
+		return c
+	}
+
+	reply("220 fake ready")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			reply("331 need password")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			var feat = " SIZE"
+			if s.NoSize {
+				feat = " UTF8"
+			}
+			if s.Mlsd || s.RefuseMLSD {
+				feat = " MLST type*;size*;modify*;"
+			}
+			if s.Hash {
+				feat += "\r\n HASH SHA-256*;MD5\r\n XCRC"
+			}
+			reply("211-Features:\r\n%s\r\n211 End", feat)
+		case "OPTS":
+			if strings.HasPrefix(strings.ToUpper(arg), "HASH ") {
+				hashAlgo = strings.ToUpper(arg[5:])
+			}
+			reply("200 ok")
+		case "HASH", "XCRC":
+			data, ok := s.File(arg)
+			if !ok {
+				reply("550 not found")
+				continue
+			}
+			switch {
+			case cmd == "XCRC":
+				reply("250 %08X", crc32.ChecksumIEEE(data))
+			case hashAlgo == "MD5":
+				reply("213 MD5 0-%d %x %s", len(data), md5.Sum(data), arg)
+			default:
+				reply("213 SHA-256 0-%d %X %s", len(data), sha256.Sum256(data), arg)
+			}
+		case "TYPE":
+			reply("200 ok")
+		case "EPSV":
+			dataL, _ = net.Listen("tcp", "127.0.0.1:0")
+			reply("229 Entering Extended Passive Mode (|||%d|)", dataL.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting")
+		case "SIZE":
+			if s.NoSize {
+				reply("502 not implemented")
+				continue
+			}
+			data, ok := s.File(arg)
+			if !ok {
+				reply("550 not found")
+				continue
+			}
+			reply("213 %d", len(data))
+		case "MLSD", "LIST", "NLST":
+			if (!s.Mlsd || s.RefuseMLSD) && cmd == "MLSD" {
+				reply("500 unknown command")
+				continue
+			}
+			var c = openData()
+			for _, it := range s.list(arg) {
+				var name, size, dir = it.name, it.size, it.dir
+				switch {
+				case cmd == "NLST":
+					fmt.Fprintf(c, "%s\r\n", name)
+				case cmd == "MLSD" && dir:
+					fmt.Fprintf(c, "type=dir;modify=20200102150405; %s\r\n", name)
+				case cmd == "MLSD":
+					fmt.Fprintf(c, "type=file;size=%d;modify=20200102150405; %s\r\n", size, name)
+				case dir:
+					fmt.Fprintf(c, "drwxr-xr-x   2 owner group      4096 Jan 02  2020 %s\r\n", name)
+				default:
+					fmt.Fprintf(c, "-rw-r--r--   1 owner group %9d Jan 02  2020 %s\r\n", size, name)
+				}
+			}
+			c.Close()
+			reply("226 done")
+		case "RETR":
+			data, ok := s.File(arg)
+			if !ok {
+				reply("550 not found")
+				continue
+			}
+			var c = openData()
+			c.Write(data[offset:])
+			offset = 0
+			c.Close()
+			reply("226 done")
+		case "STOR":
+			var c = openData()
+			s.lock.Lock()
+			var drop = s.DropStor > 0
+			if drop {
+				s.DropStor--
+			}
+			s.lock.Unlock()
+			var r io.Reader = c
+			if drop {
+				r = io.LimitReader(c, DropBytes)
+			}
+			var buffer, _ = io.ReadAll(r)
+			c.Close()
+			s.lock.Lock()
+			s.files[arg] = append(s.files[arg][:offset:offset], buffer...)
+			s.lock.Unlock()
+			offset = 0
+			if drop {
+				reply("426 connection closed, transfer aborted")
+				continue
+			}
+			reply("226 done")
+		case "MKD":
+			s.lock.Lock()
+			var exists = s.dirs[arg]
+			s.dirs[arg] = true
+			s.lock.Unlock()
+			if exists {
+				reply("550 exists")
+				continue
+			}
+			reply("257 \"%s\" created", arg)
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+type entry struct {
+	name string
+	size int
+	dir  bool
+}
+
+// list содержимое папки dir: файлы и папки первого уровня по именам
+func (s *Server) list(dir string) []entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var seen = map[string]entry{}
+	var prefix = strings.TrimSuffix(dir, "/") + "/"
+	for name, data := range s.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		var rest = strings.TrimPrefix(name, prefix)
+		if sub, _, ok := strings.Cut(rest, "/"); ok {
+			seen[sub] = entry{name: sub, dir: true}
+			continue
+		}
+		seen[rest] = entry{name: rest, size: len(data)}
+	}
+
+	var res []entry
+	for _, it := range seen {
+		res = append(res, it)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
@@ -0,0 +1,94 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// Hash algorithms accepted by ServerConn.Hash
+const (
+	HashSHA256 = "SHA-256"
+	HashMD5    = "MD5"
+	HashCRC32  = "CRC32"
+)
+
+// ErrHashNotSupported is returned by Hash when the server supports neither
+// the HASH command with the requested algorithm nor its X* counterpart.
+var ErrHashNotSupported = errors.New("hash algorithm not supported by server")
+
+// xHashCommands non-standard commands returning a single checksum
+var xHashCommands = map[string]string{
+	HashSHA256: "XSHA256",
+	HashMD5:    "XMD5",
+	HashCRC32:  "XCRC",
+}
+
+// HashAlgorithms returns the algorithms the server can compute, in the order
+// they are listed in FEAT (HASH) followed by supported X* commands.
+func (c *ServerConn) HashAlgorithms() []string {
+	var res []string
+	if desc, ok := c.features["HASH"]; ok {
+		for _, it := range strings.Split(desc, ";") {
+			if it = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(it), "*")); len(it) > 0 {
+				res = append(res, it)
+			}
+		}
+	}
+	for _, algo := range []string{HashSHA256, HashMD5, HashCRC32} {
+		if _, ok := c.features[xHashCommands[algo]]; ok && !containsFold(res, algo) {
+			res = append(res, algo)
+		}
+	}
+	return res
+}
+
+// Hash returns the lowercase hex checksum of a remote file computed by the server.
+// The HASH command (draft-bryan-ftp-hash) is used if the server lists
+// the algorithm in FEAT, otherwise XSHA256, XMD5 or XCRC.
+func (c *ServerConn) Hash(path, algo string) (string, error) {
+	algo = strings.ToUpper(algo)
+	if desc, ok := c.features["HASH"]; ok && containsFold(strings.Split(strings.ReplaceAll(desc, "*", ""), ";"), algo) {
+		if _, _, err := c.cmd(StatusCommandOK, "OPTS HASH %s", algo); err != nil {
+			return "", err
+		}
+		_, msg, err := c.cmd(StatusFile, "HASH %s", path)
+		if err != nil {
+			return "", err
+		}
+		// <algo> <start>-<end> <hash> <path>
+		var fields = strings.Fields(msg)
+		if len(fields) < 3 || !strings.EqualFold(fields[0], algo) {
+			return "", fmt.Errorf("unexpected HASH response: %s", msg)
+		}
+		return strings.ToLower(fields[2]), nil
+	}
+
+	var xcmd, ok = xHashCommands[algo]
+	if _, supported := c.features[xcmd]; !ok || !supported {
+		return "", ErrHashNotSupported
+	}
+	code, msg, err := c.cmd(-1, "%s %s", xcmd, path)
+	if err != nil {
+		return "", err
+	}
+	if code < 200 || code > 299 {
+		return "", &textproto.Error{Code: code, Msg: msg}
+	}
+	// some servers append the file name to the checksum
+	var fields = strings.Fields(msg)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unexpected %s response: %s", xcmd, msg)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func containsFold(list []string, val string) bool {
+	for _, it := range list {
+		if strings.EqualFold(strings.TrimSpace(it), val) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+package ftp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUnsupportedListLine = errors.New("unsupported LIST line")
+var errUnsupportedListDate = errors.New("unsupported LIST date")
+var errUnknownListEntryType = errors.New("unknown entry type")
+
+type parseFunc func(string, time.Time, *time.Location) (*Entry, error)
+
+var listLineParsers = []parseFunc{
+	parseRFC3659ListLine,
+	parseLsListLine,
+	parseDirListLine,
+}
+
+// parseRFC3659ListLine parses the style of directory line defined in RFC 3659.
+//
+//	type=file;size=1024;modify=20200102150405; file.mp4
+func parseRFC3659ListLine(line string, _ time.Time, loc *time.Location) (*Entry, error) {
+	iSemicolon := strings.Index(line, ";")
+	iWhitespace := strings.Index(line, " ")
+
+	if iSemicolon < 0 || iSemicolon > iWhitespace {
+		return nil, errUnsupportedListLine
+	}
+
+	e := &Entry{
+		Name: line[iWhitespace+1:],
+	}
+
+	for _, field := range strings.Split(line[:iWhitespace-1], ";") {
+		i := strings.Index(field, "=")
+		if i < 1 {
+			return nil, errUnsupportedListLine
+		}
+
+		key := strings.ToLower(field[:i])
+		value := field[i+1:]
+
+		switch key {
+		case "modify":
+			var err error
+			e.Time, err = time.ParseInLocation(timeFormat, value[:min(len(value), len(timeFormat))], loc)
+			if err != nil {
+				return nil, err
+			}
+		case "type":
+			switch strings.ToLower(value) {
+			case "dir", "cdir", "pdir":
+				e.Type = EntryTypeFolder
+			case "file":
+				e.Type = EntryTypeFile
+			case "os.unix=slink", "os.unix=symlink":
+				e.Type = EntryTypeLink
+			default:
+				return nil, errUnknownListEntryType
+			}
+		case "size", "sizd":
+			if err := e.setSize(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// parseLsListLine parses a directory line in a format based on the output of
+// the UNIX ls command.
+//
+//	-rw-r--r--   1 owner group      1024 Jan 02 15:04 file.mp4
+//	drwxr-xr-x   2 owner group      4096 Jan 02  2020 folder
+//	lrwxrwxrwx   1 owner group         8 Jan 02 15:04 link -> file.mp4
+func parseLsListLine(line string, now time.Time, loc *time.Location) (*Entry, error) {
+	// Has the first field a length of 10 bytes?
+	if strings.IndexByte(line, ' ') != 10 {
+		return nil, errUnsupportedListLine
+	}
+
+	scanner := newScanner(line)
+	fields := scanner.NextFields(6)
+
+	if len(fields) < 6 {
+		return nil, errUnsupportedListLine
+	}
+
+	if fields[1] == "folder" && fields[2] == "0" {
+		e := &Entry{
+			Type: EntryTypeFolder,
+			Name: scanner.Remaining(),
+		}
+		if err := e.setTime(fields[3:6], now, loc); err != nil {
+			return nil, err
+		}
+
+		return e, nil
+	}
+
+	if fields[1] == "0" {
+		fields = append(fields, scanner.Next())
+		e := &Entry{
+			Type: EntryTypeFile,
+			Name: scanner.Remaining(),
+		}
+
+		if err := e.setSize(fields[2]); err != nil {
+			return nil, errUnsupportedListLine
+		}
+		if err := e.setTime(fields[4:7], now, loc); err != nil {
+			return nil, err
+		}
+
+		return e, nil
+	}
+
+	// Read two more fields
+	fields = append(fields, scanner.NextFields(2)...)
+	if len(fields) < 8 {
+		return nil, errUnsupportedListLine
+	}
+
+	e := &Entry{
+		Name: scanner.Remaining(),
+	}
+	switch fields[0][0] {
+	case '-':
+		e.Type = EntryTypeFile
+		if err := e.setSize(fields[4]); err != nil {
+			return nil, err
+		}
+	case 'd':
+		e.Type = EntryTypeFolder
+	case 'l':
+		e.Type = EntryTypeLink
+
+		// Split link name and target
+		if i := strings.Index(e.Name, " -> "); i > 0 {
+			e.Target = e.Name[i+4:]
+			e.Name = e.Name[:i]
+		}
+	default:
+		return nil, errUnknownListEntryType
+	}
+
+	if err := e.setTime(fields[5:8], now, loc); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// parseDirListLine parses a directory line in a format based on the output of
+// the MS-DOS DIR command.
+//
+//	01-02-20  03:04PM       <DIR>          folder
+//	01-02-20  03:04PM                 1024 file.mp4
+func parseDirListLine(line string, now time.Time, loc *time.Location) (*Entry, error) {
+	e := &Entry{}
+	var err error
+
+	// Try various time formats that DIR might use, and stop when one works.
+	for _, format := range dirTimeFormats {
+		if len(line) > len(format) {
+			e.Time, err = time.ParseInLocation(format, line[:len(format)], loc)
+			if err == nil {
+				line = line[len(format):]
+				break
+			}
+		}
+	}
+	if err != nil {
+		// None of the time formats worked.
+		return nil, errUnsupportedListLine
+	}
+
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, "<DIR>") {
+		e.Type = EntryTypeFolder
+		line = strings.TrimPrefix(line, "<DIR>")
+	} else {
+		space := strings.Index(line, " ")
+		if space == -1 {
+			return nil, errUnsupportedListLine
+		}
+		e.Size, err = strconv.ParseUint(line[:space], 10, 64)
+		if err != nil {
+			return nil, errUnsupportedListLine
+		}
+		e.Type = EntryTypeFile
+		line = line[space:]
+	}
+
+	e.Name = strings.TrimLeft(line, " ")
+	if len(e.Name) == 0 {
+		return nil, errUnsupportedListLine
+	}
+	return e, nil
+}
+
+var dirTimeFormats = []string{
+	"01-02-06  03:04PM",
+	"01-02-2006  03:04PM",
+	"01-02-06  15:04",
+	"01-02-2006  15:04",
+	"2006-01-02  15:04",
+}
+
+// parseListLine parses the various non-standard format returned by the LIST
+// FTP command.
+func parseListLine(line string, now time.Time, loc *time.Location) (*Entry, error) {
+	for _, f := range listLineParsers {
+		e, err := f(line, now, loc)
+		if err != errUnsupportedListLine {
+			return e, err
+		}
+	}
+	return nil, errUnsupportedListLine
+}
+
+func (e *Entry) setSize(str string) (err error) {
+	e.Size, err = strconv.ParseUint(str, 0, 64)
+	return
+}
+
+func (e *Entry) setTime(fields []string, now time.Time, loc *time.Location) (err error) {
+	if strings.Contains(fields[2], ":") { // contains time
+		thisYear, _, _ := now.Date()
+		timeStr := fields[1] + " " + fields[0] + " " + strconv.Itoa(thisYear)[2:4] + " " + fields[2] + " GMT"
+		e.Time, err = time.Parse("_2 Jan 06 15:04 MST", timeStr)
+		if err != nil {
+			return errUnsupportedListDate
+		}
+
+		/*
+			On unix, `info ls` shows:
+
+			10.1.6 Formatting file timestamps
+			---------------------------------
+
+			A timestamp is considered to be “recent” if it is less than six
+			months old, and is not dated in the future.  If a timestamp dated today
+			is not listed in recent form, the timestamp is in the future, which
+			means you probably have clock skew problems which may break programs
+			like ‘make’ that rely on file timestamps.
+		*/
+		if !e.Time.Before(now.AddDate(0, 6, 0)) {
+			e.Time = e.Time.AddDate(-1, 0, 0)
+		}
+
+	} else { // only the date
+		if len(fields[2]) != 4 {
+			return errUnsupportedListDate
+		}
+		timeStr := fields[1] + " " + fields[0] + " " + fields[2][2:4] + " 00:00 GMT"
+		e.Time, err = time.Parse("_2 Jan 06 15:04 MST", timeStr)
+		if err != nil {
+			return errUnsupportedListDate
+		}
+	}
+	e.Time = time.Date(e.Time.Year(), e.Time.Month(), e.Time.Day(), e.Time.Hour(), e.Time.Minute(), 0, 0, loc)
+	return nil
+}
+
+// scanner reads space separated fields of a LIST line
+// keeping the remaining part (file name) untouched.
+type scanner struct {
+	bytes    []byte
+	position int
+}
+
+func newScanner(str string) *scanner {
+	return &scanner{
+		bytes: []byte(str),
+	}
+}
+
+// NextFields returns the next `count` fields
+func (s *scanner) NextFields(count int) []string {
+	fields := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if field := s.Next(); field != "" {
+			fields = append(fields, field)
+		} else {
+			break
+		}
+	}
+	return fields
+}
+
+// Next returns the next field
+func (s *scanner) Next() string {
+	sLen := len(s.bytes)
+
+	// skip trailing whitespace
+	for s.position < sLen {
+		if s.bytes[s.position] != ' ' {
+			break
+		}
+		s.position++
+	}
+
+	start := s.position
+
+	// skip non-whitespace
+	for s.position < sLen {
+		if s.bytes[s.position] == ' ' {
+			s.position++
+			return string(s.bytes[start : s.position-1])
+		}
+		s.position++
+	}
+
+	return string(s.bytes[start:s.position])
+}
+
+// Remaining returns the remaining string
+func (s *scanner) Remaining() string {
+	return string(s.bytes[s.position:len(s.bytes)])
+}
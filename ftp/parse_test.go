@@ -0,0 +1,60 @@
+package ftp
+
+import (
+	"testing"
+	"time"
+)
+
+var listTests = []struct {
+	line string
+	name string
+	typ  EntryType
+	size uint64
+	time time.Time
+}{
+	// MLSD
+	{"type=file;size=1024;modify=20200102150405; file.mp4", "file.mp4", EntryTypeFile, 1024, time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)},
+	{"type=dir;modify=20200102150405.123; my folder", "my folder", EntryTypeFolder, 0, time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)},
+	{"Type=OS.unix=symlink;Modify=20200102150405; link", "link", EntryTypeLink, 0, time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)},
+	// unix
+	{"-rw-r--r--   1 owner group      1024 Jan 02  2020 file.mp4", "file.mp4", EntryTypeFile, 1024, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{"-rw-r--r--   1 owner group      1024 Jan 02  2020 file with spaces.mp4", "file with spaces.mp4", EntryTypeFile, 1024, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{"drwxr-xr-x   2 owner group      4096 Mar 12  2019 folder", "folder", EntryTypeFolder, 0, time.Date(2019, 3, 12, 0, 0, 0, 0, time.UTC)},
+	{"lrwxrwxrwx   1 owner group         8 Jan 02  2020 link -> file.mp4", "link", EntryTypeLink, 0, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+	// DOS
+	{"01-02-20  03:04PM       <DIR>          folder", "folder", EntryTypeFolder, 0, time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)},
+	{"01-02-20  03:04PM                 1024 file.mp4", "file.mp4", EntryTypeFile, 1024, time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)},
+	{"2020-01-02  15:04                 1024 file 2.mp4", "file 2.mp4", EntryTypeFile, 1024, time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)},
+}
+
+func TestParseListLine(t *testing.T) {
+	var now = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, it := range listTests {
+		var e, err = parseListLine(it.line, now, time.UTC)
+		if err != nil {
+			t.Errorf("parseListLine(%q) err: %v", it.line, err)
+			continue
+		}
+		if e.Name != it.name || e.Type != it.typ || e.Size != it.size || !e.Time.Equal(it.time) {
+			t.Errorf("parseListLine(%q) = %+v", it.line, *e)
+		}
+	}
+
+	for _, line := range []string{"", "total 12", "garbage line"} {
+		if _, err := parseListLine(line, now, time.UTC); err == nil {
+			t.Errorf("parseListLine(%q) expected error", line)
+		}
+	}
+}
+
+func TestParseLsRecentTime(t *testing.T) {
+	var now = time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	// декабрь без года относится к прошлому году
+	var e, err = parseLsListLine("-rw-r--r--   1 owner group      1024 Dec 31 23:59 file.mp4", now, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Time.Equal(time.Date(2020, 12, 31, 23, 59, 0, 0, time.UTC)) {
+		t.Errorf("time %v", e.Time)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"mediamagi.ru/win-file-agent/agent"
 	"mediamagi.ru/win-file-agent/config"
@@ -50,10 +51,40 @@ func main() {
 		panic(err)
 	}
 
-	// блокируем до Ctrl+C
+	// блокируем до Ctrl+C или SIGTERM, SIGUSR1 - пауза агента, SIGUSR2 - продолжение.
+	// Повторный Ctrl+C или SIGTERM сохраняет задания без ожидания. Остановка, начатая
+	// запросом drain, тоже завершает процесс
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
-
-	ag.OnStop()
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	var drained = ag.Drained()
+	var stopped chan struct{}
+	var stop = func() {
+		stopped = make(chan struct{})
+		go func() {
+			ag.OnStop()
+			close(stopped)
+		}()
+	}
+	for {
+		select {
+		case s := <-sig:
+			switch {
+			case s == syscall.SIGUSR1:
+				ag.Pause()
+			case s == syscall.SIGUSR2:
+				ag.Resume()
+			case stopped != nil:
+				ag.StopNow()
+			default:
+				stop()
+			}
+		case <-drained:
+			drained = nil
+			if stopped == nil {
+				stop()
+			}
+		case <-stopped:
+			return
+		}
+	}
 }
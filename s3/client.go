@@ -0,0 +1,389 @@
+// Package s3 клиент S3-совместимого хранилища (MinIO, AWS S3 и т.д.)
+// с подписью запросов AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client клиент S3-совместимого хранилища
+type Client struct {
+	// Endpoint адрес хранилища, например http://minio:9000
+	Endpoint string
+	// Region регион для подписи, по умолчанию us-east-1
+	Region string
+	Cred   Credentials
+	// VirtualHost адресация bucket.host/key вместо host/bucket/key
+	VirtualHost bool
+	HTTPClient  *http.Client
+}
+
+// Error ошибка, которую вернуло хранилище
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (c *Error) Error() string {
+	return fmt.Sprintf("s3: %d %s %s", c.StatusCode, c.Code, c.Message)
+}
+
+// ObjectInfo сведения об объекте
+type ObjectInfo struct {
+	Size int64
+	ETag string
+}
+
+// Part загруженная часть multipart загрузки
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+// Upload незавершенная multipart загрузка
+type Upload struct {
+	Key       string    `xml:"Key"`
+	UploadID  string    `xml:"UploadId"`
+	Initiated time.Time `xml:"Initiated"`
+}
+
+func (c *Client) region() string {
+	if len(c.Region) == 0 {
+		return "us-east-1"
+	}
+	return c.Region
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) objectURL(bucket, key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", c.Endpoint)
+	}
+
+	key = strings.TrimPrefix(key, "/")
+	if c.VirtualHost {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	} else {
+		u.Path = "/" + bucket
+		if len(key) > 0 {
+			u.Path += "/" + key
+		}
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+// do выполняет подписанный запрос. body может быть nil.
+// payloadHash если пустой, то вычисляется по body (body должен быть io.ReadSeeker).
+func (c *Client) do(ctx context.Context, method, bucket, key string, query url.Values,
+	header http.Header, body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+
+	u, err := c.objectURL(bucket, key, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payloadHash) == 0 {
+		if body == nil {
+			payloadHash = EmptyPayload
+		} else if payloadHash, err = hashReader(body); err != nil {
+			return nil, err
+		}
+	}
+
+	var rd io.Reader
+	if body != nil {
+		// транспорт закрывает тело запроса, а файл нужен вызывающему и после запроса
+		rd = io.NopCloser(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	// сохраняем экранирование пути, которое было подписано
+	req.URL.RawPath = u.RawPath
+	req.URL.Path = u.Path
+	if body != nil {
+		req.ContentLength = size
+		req.GetBody = nil
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	SignV4(req, c.Cred, c.region(), payloadHash, time.Now())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+func readError(resp *http.Response) error {
+	var s3Err = &Error{StatusCode: resp.StatusCode}
+	var buffer, _ = io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := xml.Unmarshal(buffer, s3Err); err != nil || len(s3Err.Code) == 0 {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+		s3Err.Message = strings.TrimSpace(string(buffer))
+	}
+	return s3Err
+}
+
+// hashReader sha256 содержимого с возвратом позиции чтения в начало
+func hashReader(r io.ReadSeeker) (string, error) {
+	var h = sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sumReader sha256 (hex) и md5 (raw) содержимого с возвратом позиции чтения в начало
+func sumReader(r io.ReadSeeker) (string, []byte, error) {
+	var hs, hm = sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(hs, hm), r); err != nil {
+		return "", nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(hs.Sum(nil)), hm.Sum(nil), nil
+}
+
+// PutObject загружает объект одним запросом. Возвращает ETag.
+func (c *Client) PutObject(ctx context.Context, bucket, key string, body io.ReadSeeker, size int64) (string, error) {
+	payloadHash, sum, err := sumReader(body)
+	if err != nil {
+		return "", err
+	}
+	var header = http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, nil, header, body, size, payloadHash)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// GetObject скачивает объект начиная с offset байта.
+func (c *Client) GetObject(ctx context.Context, bucket, key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	var header = http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil, header, nil, 0, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("s3: range not supported, status %d", resp.StatusCode)
+	}
+	return resp.Body, &ObjectInfo{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// HeadObject сведения об объекте
+func (c *Client) HeadObject(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, bucket, key, nil, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &ObjectInfo{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// CreateMultipartUpload начинает multipart загрузку и возвращает UploadId
+func (c *Client) CreateMultipartUpload(ctx context.Context, bucket, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil, nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+// UploadPart загружает часть multipart загрузки. Возвращает ETag части.
+func (c *Client) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	payloadHash, sum, err := sumReader(body)
+	if err != nil {
+		return "", err
+	}
+	var header = http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	var query = url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, query, header, body, size, payloadHash)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload завершает multipart загрузку. Возвращает ETag объекта.
+func (c *Client) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []Part) (string, error) {
+	type completePart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var req struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+	for _, it := range parts {
+		req.Parts = append(req.Parts, completePart{PartNumber: it.PartNumber, ETag: it.ETag})
+	}
+	buffer, err := xml.Marshal(&req)
+	if err != nil {
+		return "", err
+	}
+
+	var header = http.Header{}
+	header.Set("Content-Type", "application/xml")
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, header,
+		bytes.NewReader(buffer), int64(len(buffer)), "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// ошибка может прийти с кодом 200 в теле ответа
+	buffer, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err = xml.Unmarshal(buffer, &res); err != nil {
+		return "", err
+	}
+	if res.XMLName.Local == "Error" {
+		return "", &Error{StatusCode: resp.StatusCode, Code: res.Code, Message: res.Message}
+	}
+	return res.ETag, nil
+}
+
+// AbortMultipartUpload отменяет multipart загрузку и удаляет загруженные части
+func (c *Client) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListParts список загруженных частей multipart загрузки
+func (c *Client) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	var parts []Part
+	var marker = "0"
+	for {
+		var query = url.Values{"uploadId": {uploadID}, "part-number-marker": {marker}}
+		resp, err := c.do(ctx, http.MethodGet, bucket, key, query, nil, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Parts                []Part `xml:"Part"`
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, res.Parts...)
+		if !res.IsTruncated || len(res.NextPartNumberMarker) == 0 {
+			return parts, nil
+		}
+		marker = res.NextPartNumberMarker
+	}
+}
+
+// ListMultipartUploads незавершенные multipart загрузки с ключами, начинающимися с prefix
+func (c *Client) ListMultipartUploads(ctx context.Context, bucket, prefix string) ([]Upload, error) {
+	var uploads []Upload
+	var keyMarker, idMarker string
+	for {
+		var query = url.Values{"uploads": {""}, "prefix": {prefix}}
+		if len(keyMarker) > 0 {
+			query.Set("key-marker", keyMarker)
+			query.Set("upload-id-marker", idMarker)
+		}
+		resp, err := c.do(ctx, http.MethodGet, bucket, "", query, nil, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Uploads            []Upload `xml:"Upload"`
+			IsTruncated        bool     `xml:"IsTruncated"`
+			NextKeyMarker      string   `xml:"NextKeyMarker"`
+			NextUploadIDMarker string   `xml:"NextUploadIdMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		uploads = append(uploads, res.Uploads...)
+		if !res.IsTruncated || len(res.NextKeyMarker) == 0 {
+			return uploads, nil
+		}
+		keyMarker, idMarker = res.NextKeyMarker, res.NextUploadIDMarker
+	}
+}
@@ -0,0 +1,314 @@
+// Package s3test S3-совместимый сервер в памяти для тестов.
+// Проверяет подпись запросов, sha256 и Content-MD5 тела.
+package s3test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mediamagi.ru/win-file-agent/s3"
+)
+
+// Server S3 сервер в памяти, адресация path-style
+type Server struct {
+	*httptest.Server
+	Cred   s3.Credentials
+	Region string
+
+	lock    sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*upload
+	nextID  int
+	// failParts номера частей, загрузка которых один раз завершится ошибкой
+	failParts map[int]bool
+	// PartUploads количество успешных UploadPart
+	PartUploads int
+	// Puts количество успешных PutObject
+	Puts int
+}
+
+type upload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+// NewServer запускает сервер с ключами cred и регионом us-east-1
+func NewServer(cred s3.Credentials) *Server {
+	var srv = &Server{
+		Cred:      cred,
+		Region:    "us-east-1",
+		objects:   make(map[string][]byte),
+		uploads:   make(map[string]*upload),
+		failParts: make(map[int]bool),
+	}
+	srv.Server = httptest.NewServer(srv)
+	return srv
+}
+
+// Client клиент, настроенный на этот сервер
+func (c *Server) Client() *s3.Client {
+	return &s3.Client{Endpoint: c.URL, Region: c.Region, Cred: c.Cred}
+}
+
+// FailPartOnce следующая загрузка части partNumber завершится ошибкой 500
+func (c *Server) FailPartOnce(partNumber int) {
+	c.lock.Lock()
+	c.failParts[partNumber] = true
+	c.lock.Unlock()
+}
+
+// Object содержимое объекта
+func (c *Server) Object(bucket, key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	data, ok := c.objects[bucket+"/"+key]
+	return data, ok
+}
+
+// PutObject кладет объект напрямую, без запроса
+func (c *Server) PutObject(bucket, key string, data []byte) {
+	c.lock.Lock()
+	c.objects[bucket+"/"+key] = data
+	c.lock.Unlock()
+}
+
+// Uploads количество незавершенных multipart загрузок
+func (c *Server) Uploads() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.uploads)
+}
+
+func (c *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if code, msg := c.verify(r, body); len(code) > 0 {
+		writeError(w, http.StatusForbidden, code, msg)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	var query = r.URL.Query()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		c.nextID++
+		var id = strconv.Itoa(c.nextID)
+		c.uploads[id] = &upload{key: bucket + "/" + key, initiated: time.Now(), parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		type xmlUpload struct {
+			Key       string `xml:"Key"`
+			UploadID  string `xml:"UploadId"`
+			Initiated string `xml:"Initiated"`
+		}
+		var res struct {
+			XMLName xml.Name    `xml:"ListMultipartUploadsResult"`
+			Uploads []xmlUpload `xml:"Upload"`
+		}
+		for id, it := range c.uploads {
+			var itBucket, itKey, _ = strings.Cut(it.key, "/")
+			if itBucket == bucket && strings.HasPrefix(itKey, query.Get("prefix")) {
+				res.Uploads = append(res.Uploads, xmlUpload{Key: itKey, UploadID: id,
+					Initiated: it.initiated.UTC().Format(time.RFC3339Nano)})
+			}
+		}
+		writeXML(w, res)
+
+	case query.Has("uploadId"):
+		c.serveUpload(w, r, bucket, key, query, body)
+
+	case r.Method == http.MethodPut:
+		c.objects[bucket+"/"+key] = body
+		c.Puts++
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := c.objects[bucket+"/"+key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		var status = http.StatusOK
+		if rng := r.Header.Get("Range"); len(rng) > 0 {
+			var offset int
+			if _, err = fmt.Sscanf(rng, "bytes=%d-", &offset); err != nil || offset > len(data) {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			data = data[offset:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (c *Server) serveUpload(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values, body []byte) {
+	var id = query.Get("uploadId")
+	var up, ok = c.uploads[id]
+	if !ok || up.key != bucket+"/"+key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		if partNumber < 1 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "partNumber")
+			return
+		}
+		if c.failParts[partNumber] {
+			delete(c.failParts, partNumber)
+			writeError(w, http.StatusInternalServerError, "InternalError", "injected failure")
+			return
+		}
+		up.parts[partNumber] = body
+		c.PartUploads++
+		w.Header().Set("ETag", etag(body))
+
+	case http.MethodGet:
+		type xmlPart struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+			Size       int    `xml:"Size"`
+		}
+		var res struct {
+			XMLName xml.Name  `xml:"ListPartsResult"`
+			Parts   []xmlPart `xml:"Part"`
+		}
+		for num, data := range up.parts {
+			res.Parts = append(res.Parts, xmlPart{PartNumber: num, ETag: etag(data), Size: len(data)})
+		}
+		sort.Slice(res.Parts, func(i, j int) bool { return res.Parts[i].PartNumber < res.Parts[j].PartNumber })
+		writeXML(w, res)
+
+	case http.MethodPost:
+		var req struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+			writeError(w, http.StatusBadRequest, "MalformedXML", fmt.Sprint(err))
+			return
+		}
+		var data []byte
+		var sums = md5.New()
+		for idx, it := range req.Parts {
+			part, ok := up.parts[it.PartNumber]
+			if !ok || it.ETag != etag(part) || (idx > 0 && it.PartNumber <= req.Parts[idx-1].PartNumber) {
+				writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(it.PartNumber))
+				return
+			}
+			if idx < len(req.Parts)-1 && len(part) < s3.MinPartSize {
+				writeError(w, http.StatusBadRequest, "EntityTooSmall", strconv.Itoa(it.PartNumber))
+				return
+			}
+			data = append(data, part...)
+			var sum = md5.Sum(part)
+			sums.Write(sum[:])
+		}
+		c.objects[up.key] = data
+		delete(c.uploads, id)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Key: key, ETag: fmt.Sprintf(`"%x-%d"`, sums.Sum(nil), len(req.Parts))})
+
+	case http.MethodDelete:
+		delete(c.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// verify проверяет подпись и хеши тела. Возвращает код ошибки S3 или пустую строку.
+func (c *Server) verify(r *http.Request, body []byte) (string, string) {
+	var payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != s3.UnsignedPayload {
+		var sum = sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return "XAmzContentSHA256Mismatch", payloadHash
+		}
+	}
+	if contentMD5 := r.Header.Get("Content-MD5"); len(contentMD5) > 0 {
+		var sum = md5.Sum(body)
+		if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return "BadDigest", contentMD5
+		}
+	}
+
+	t, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "AccessDenied", "bad x-amz-date"
+	}
+	var check = r.Clone(r.Context())
+	check.Header.Del("Authorization")
+	s3.SignV4(check, c.Cred, c.Region, payloadHash, t)
+	if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		return "SignatureDoesNotMatch", r.Header.Get("Authorization")
+	}
+	return "", ""
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+func writeXML(w http.ResponseWriter, val any) {
+	w.Header().Set("Content-Type", "application/xml")
+	buffer, _ := xml.Marshal(val)
+	w.Write([]byte(xml.Header))
+	w.Write(buffer)
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	buffer, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: msg})
+	w.Write(buffer)
+}
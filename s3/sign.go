@@ -0,0 +1,169 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	signService   = "s3"
+	amzDateFormat = "20060102T150405Z"
+	// UnsignedPayload значение x-amz-content-sha256, когда тело не подписывается
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// EmptyPayload sha256 пустого тела
+	EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Credentials ключи доступа к хранилищу
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+// SignV4 подписывает запрос по AWS Signature Version 4.
+// payloadHash - hex sha256 тела запроса, EmptyPayload или UnsignedPayload.
+// Заголовки x-amz-date и x-amz-content-sha256 выставляются здесь же,
+// подписываются host, content-md5, content-type, range и все x-amz-* заголовки.
+func SignV4(req *http.Request, cred Credentials, region, payloadHash string, t time.Time) {
+	t = t.UTC()
+	var amzDate = t.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var signedHeaders, canonicalHeaders = canonicalHeaders(req)
+	var canonicalRequest = strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	var scope = strings.Join([]string{t.Format("20060102"), region, signService, "aws4_request"}, "/")
+	var stringToSign = strings.Join([]string{
+		signAlgorithm,
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	var key = hmacSHA256([]byte("AWS4"+cred.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, signService)
+	key = hmacSHA256(key, "aws4_request")
+	var signature = hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", signAlgorithm+
+		" Credential="+cred.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func canonicalHeaders(req *http.Request) (string, string) {
+	var host = req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	var headers = map[string]string{"host": host}
+	for name, values := range req.Header {
+		var lower = strings.ToLower(name)
+		switch {
+		case lower == "content-md5", lower == "content-type", lower == "range", lower == "date",
+			strings.HasPrefix(lower, "x-amz-"):
+		default:
+			continue
+		}
+		var trimmed = make([]string, len(values))
+		for idx, it := range values {
+			trimmed[idx] = strings.Join(strings.Fields(it), " ")
+		}
+		headers[lower] = strings.Join(trimmed, ",")
+	}
+
+	var names = make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		sb.WriteString(headers[name])
+		sb.WriteByte('\n')
+	}
+	return strings.Join(names, ";"), sb.String()
+}
+
+func canonicalURI(u *url.URL) string {
+	var p = u.EscapedPath()
+	if len(p) == 0 {
+		return "/"
+	}
+	// приводим экранирование к виду, который ожидает S3
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return u.EscapedPath()
+	}
+	return uriEncode(p, false)
+}
+
+func canonicalQuery(u *url.URL) string {
+	var query = u.Query()
+	var keys = make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		var values = query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode экранирует все, кроме A-Z a-z 0-9 - _ . ~ (и '/' если encodeSlash false)
+func uriEncode(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		var c = s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(hexChars[c>>4])
+			sb.WriteByte(hexChars[c&15])
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	var h = hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
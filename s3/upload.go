@@ -0,0 +1,239 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// MinPartSize минимальный размер части multipart загрузки (кроме последней)
+	MinPartSize = 5 << 20
+	// DefaultPartSize размер части по умолчанию
+	DefaultPartSize = 16 << 20
+	// MaxParts максимальное количество частей
+	MaxParts = 10000
+	// DefaultConcurrency количество частей, загружаемых параллельно
+	DefaultConcurrency = 4
+)
+
+// Uploader загружает файлы в хранилище. Файлы больше PartSize загружаются
+// частями параллельно. Незавершенная загрузка не отменяется при ошибке,
+// и следующий вызов Upload для того же ключа догружает недостающие части.
+type Uploader struct {
+	Client      *Client
+	PartSize    int64
+	Concurrency int
+	// Verify сверять ETag объекта с md5 загруженных данных.
+	// Не подходит для хранилищ с шифрованием SSE-KMS/SSE-C, где ETag не md5.
+	Verify bool
+	// Wait вызывается перед загрузкой файла и каждой части, например для паузы.
+	// Ошибка прерывает загрузку.
+	Wait func(ctx context.Context) error
+}
+
+// ErrETagMismatch ETag объекта не совпал с ожидаемым
+var ErrETagMismatch = errors.New("s3: etag mismatch")
+
+func (c *Uploader) partSize(size int64) int64 {
+	var partSize = c.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	// ограничение количества частей
+	if (size+partSize-1)/partSize > MaxParts {
+		partSize = (size + MaxParts - 1) / MaxParts
+	}
+	return partSize
+}
+
+func (c *Uploader) concurrency() int {
+	if c.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return c.Concurrency
+}
+
+func (c *Uploader) wait(ctx context.Context) error {
+	if c.Wait == nil {
+		return nil
+	}
+	return c.Wait(ctx)
+}
+
+// Upload загружает локальный файл filePath в bucket/key. Возвращает ETag объекта.
+func (c *Uploader) Upload(ctx context.Context, bucket, key, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	var size = info.Size()
+	var partSize = c.partSize(size)
+	if size <= partSize {
+		if err = c.wait(ctx); err != nil {
+			return "", err
+		}
+		etag, err := c.Client.PutObject(ctx, bucket, key, file, size)
+		if err != nil || !c.Verify {
+			return etag, err
+		}
+		var h = md5.New()
+		if _, err = io.Copy(h, io.NewSectionReader(file, 0, size)); err != nil {
+			return "", err
+		}
+		return etag, checkETag(etag, hex.EncodeToString(h.Sum(nil)))
+	}
+
+	uploadID, done, err := c.resume(ctx, bucket, key, file, size, partSize)
+	if err != nil {
+		return "", err
+	}
+	if len(uploadID) == 0 {
+		if uploadID, err = c.Client.CreateMultipartUpload(ctx, bucket, key); err != nil {
+			return "", err
+		}
+	}
+
+	var count = int((size + partSize - 1) / partSize)
+	var parts = make([]Part, count)
+	var jobs = make(chan int)
+	var errOnce sync.Once
+	var firstErr error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for range c.concurrency() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				var offset = int64(idx) * partSize
+				var length = min(partSize, size-offset)
+				var section = io.NewSectionReader(file, offset, length)
+				var err = c.wait(ctx)
+				var etag string
+				if err == nil {
+					etag, err = c.Client.UploadPart(ctx, bucket, key, uploadID, idx+1, section, length)
+				}
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				parts[idx] = Part{PartNumber: idx + 1, ETag: etag, Size: length}
+			}
+		}()
+	}
+
+	for idx := range count {
+		if part, ok := done[idx+1]; ok {
+			parts[idx] = part
+			continue
+		}
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
+	etag, err := c.Client.CompleteMultipartUpload(ctx, bucket, key, uploadID, parts)
+	if err != nil || !c.Verify {
+		return etag, err
+	}
+	expected, err := multipartETag(parts)
+	if err != nil {
+		return "", err
+	}
+	return etag, checkETag(etag, expected)
+}
+
+// multipartETag ETag объекта multipart загрузки: md5 от склеенных md5 частей и количество частей
+func multipartETag(parts []Part) (string, error) {
+	var h = md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(strings.Trim(part.ETag, `"`))
+		if err != nil {
+			return "", fmt.Errorf("s3: part %d etag %s: %w", part.PartNumber, part.ETag, err)
+		}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(parts)), nil
+}
+
+func checkETag(etag, expected string) error {
+	if !strings.EqualFold(strings.Trim(etag, `"`), expected) {
+		return fmt.Errorf("%w: expected %s got %s", ErrETagMismatch, expected, etag)
+	}
+	return nil
+}
+
+// resume ищет незавершенную загрузку ключа и возвращает ее id и части,
+// совпадающие с локальным файлом по размеру и md5.
+func (c *Uploader) resume(ctx context.Context, bucket, key string, file io.ReaderAt,
+	size, partSize int64) (string, map[int]Part, error) {
+
+	uploads, err := c.Client.ListMultipartUploads(ctx, bucket, key)
+	if err != nil {
+		return "", nil, err
+	}
+	var found []Upload
+	for _, it := range uploads {
+		if it.Key == key {
+			found = append(found, it)
+		}
+	}
+	if len(found) == 0 {
+		return "", nil, nil
+	}
+	// последняя начатая загрузка
+	sort.Slice(found, func(i, j int) bool { return found[i].Initiated.After(found[j].Initiated) })
+	var uploadID = found[0].UploadID
+
+	parts, err := c.Client.ListParts(ctx, bucket, key, uploadID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var done = make(map[int]Part)
+	for _, part := range parts {
+		var offset = int64(part.PartNumber-1) * partSize
+		if part.PartNumber < 1 || offset >= size || part.Size != min(partSize, size-offset) {
+			continue
+		}
+		var h = md5.New()
+		if _, err = io.Copy(h, io.NewSectionReader(file, offset, part.Size)); err != nil {
+			return "", nil, err
+		}
+		if strings.Trim(part.ETag, `"`) == hex.EncodeToString(h.Sum(nil)) {
+			done[part.PartNumber] = part
+		}
+	}
+	return uploadID, done, nil
+}
@@ -0,0 +1,99 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/s3"
+	"mediamagi.ru/win-file-agent/s3/s3test"
+)
+
+var testCred = s3.Credentials{AccessKey: "minio", SecretKey: "minio123"}
+
+func TestPutGetObject(t *testing.T) {
+	var srv = s3test.NewServer(testCred)
+	defer srv.Close()
+	var client = srv.Client()
+	var ctx = context.TODO()
+
+	var data = []byte("hello world")
+	if _, err := client.PutObject(ctx, "bucket", "dir/file name+1.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, info, err := client.GetObject(ctx, "bucket", "dir/file name+1.txt", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer, _ := io.ReadAll(rd)
+	rd.Close()
+	if string(buffer) != "world" || info.Size != 5 {
+		t.Errorf("range get %q size %d", buffer, info.Size)
+	}
+
+	if _, err = client.HeadObject(ctx, "bucket", "missing"); err == nil {
+		t.Error("expected not found")
+	} else if s3Err, ok := err.(*s3.Error); !ok || s3Err.StatusCode != 404 {
+		t.Errorf("error %v", err)
+	}
+
+	// неверный ключ
+	client.Cred.SecretKey = "wrong"
+	if _, err = client.HeadObject(ctx, "bucket", "dir/file name+1.txt"); err == nil {
+		t.Error("expected signature error")
+	}
+}
+
+func TestUploadMultipartResume(t *testing.T) {
+	var srv = s3test.NewServer(testCred)
+	defer srv.Close()
+
+	var data = make([]byte, 3*s3.MinPartSize+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	var filePath = filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var uploader = &s3.Uploader{Client: srv.Client(), PartSize: s3.MinPartSize, Concurrency: 1, Verify: true}
+	srv.FailPartOnce(3)
+	if _, err := uploader.Upload(context.TODO(), "bucket", "big.bin", filePath); err == nil {
+		t.Fatal("expected injected error")
+	}
+	if srv.Uploads() != 1 || srv.PartUploads != 2 {
+		t.Fatalf("uploads %d parts %d", srv.Uploads(), srv.PartUploads)
+	}
+
+	// докачка загружает только недостающие части
+	uploader.Concurrency = 3
+	if _, err := uploader.Upload(context.TODO(), "bucket", "big.bin", filePath); err != nil {
+		t.Fatal(err)
+	}
+	if srv.PartUploads != 4 || srv.Uploads() != 0 {
+		t.Errorf("parts %d uploads %d", srv.PartUploads, srv.Uploads())
+	}
+	if obj, _ := srv.Object("bucket", "big.bin"); !bytes.Equal(obj, data) {
+		t.Error("object differs")
+	}
+}
+
+func TestUploadSmall(t *testing.T) {
+	var srv = s3test.NewServer(testCred)
+	defer srv.Close()
+
+	var filePath = filepath.Join(t.TempDir(), "small.txt")
+	os.WriteFile(filePath, []byte("small"), 0644)
+
+	var uploader = &s3.Uploader{Client: srv.Client(), Verify: true}
+	if _, err := uploader.Upload(context.TODO(), "bucket", "small.txt", filePath); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Puts != 1 || srv.PartUploads != 0 {
+		t.Errorf("puts %d parts %d", srv.Puts, srv.PartUploads)
+	}
+}
@@ -75,11 +75,11 @@ func TestRun(ctx context.Context, params *Params) {
 						// log
 						taskState = task.State
 						if taskState == worker.ERROR || taskState == worker.FINISH {
-							log.Info("STOP PING Task: %+v\n", *task)
+							log.Info("STOP PING Task: %+v\n", task)
 							break
 						}
 
-						log.Info("NEW STATE Task: %+v\n", *task)
+						log.Info("NEW STATE Task: %+v\n", task)
 					}
 
 					time.Sleep(time.Second)
@@ -2,8 +2,12 @@ package server
 
 import (
 	"fmt"
+	"net/http"
 	"reflect"
 	"runtime"
+	"time"
+
+	"mediamagi.ru/win-file-agent/log"
 )
 
 type ArgsHandler func(*server)
@@ -31,3 +35,40 @@ func Handler[T any](method, path string, h routerAction[*T]) ArgsHandler {
 		o.mux.HandleFunc(fmt.Sprintf("%s %s", method, path), handler)
 	}
 }
+
+// StreamHandler как Handler, но без таймаутов чтения и записи сервера,
+// для запросов с передачей больших файлов
+func StreamHandler[T any](method, path string, h routerAction[*T]) ArgsHandler {
+	return func(o *server) {
+		var pc = reflect.ValueOf(h).Pointer()
+		var name = runtime.FuncForPC(pc).Name()
+		var handler = (&router[T]{h: h, name: name}).generalHandler
+
+		o.mux.HandleFunc(fmt.Sprintf("%s %s", method, path), noTimeout(handler))
+	}
+}
+
+// RawHandler регистрирует обработчик, который сам пишет ответ.
+// Таймауты чтения и записи сервера для него сняты.
+func RawHandler(method, path string, h http.HandlerFunc) ArgsHandler {
+	return func(o *server) {
+		var name = runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+		o.mux.HandleFunc(fmt.Sprintf("%s %s", method, path), noTimeout(func(w http.ResponseWriter, req *http.Request) {
+			log.Debug("Method: %s, Path: %s -> %s\n", req.Method, req.URL.Path, name)
+			h(w, req)
+		}))
+	}
+}
+
+func noTimeout(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var rc = http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			log.Error("SetReadDeadline err: %+v", err)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Error("SetWriteDeadline err: %+v", err)
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"mediamagi.ru/win-file-agent/server"
+	"mediamagi.ru/win-file-agent/worker"
+)
+
+// AgentState состояние агента
+type AgentState struct {
+	// Paused агент на паузе: новые задания не запускаются, выполняющиеся завершаются
+	Paused bool `json:"paused"`
+}
+
+type Agent struct {
+	w *worker.Worker
+}
+
+func NewAgent(w *worker.Worker) *Agent {
+	return &Agent{w: w}
+}
+
+// Get, "/v1/agent" - состояние агента
+func (c *Agent) Get(req *http.Request) (*AgentState, error) {
+	return &AgentState{Paused: c.w.IsQueuePaused()}, nil
+}
+
+// Post, "/v1/agent/pause" - пауза агента: задания из очереди не запускаются до продолжения,
+// выполняющиеся задания завершаются
+func (c *Agent) Pause(req *http.Request) (*AgentState, error) {
+	c.w.PauseQueue()
+	return c.Get(req)
+}
+
+// Post, "/v1/agent/resume" - продолжение запуска заданий после паузы
+func (c *Agent) Resume(req *http.Request) (*AgentState, error) {
+	c.w.ResumeQueue()
+	return c.Get(req)
+}
+
+// Post, "/v1/agent/drain" - остановка агента с завершением заданий: новые задания не принимаются,
+// задания в очереди и в работе завершаются до timeout (секунды, по умолчанию drain_timeout конфига),
+// оставшиеся сохраняются и запускаются после перезапуска
+func (c *Agent) Drain(req *http.Request) (*worker.DrainState, error) {
+	var timeout = worker.DrainTimeout()
+	if val := req.URL.Query().Get("timeout"); len(val) > 0 {
+		sec, err := strconv.Atoi(val)
+		if err != nil || sec < 0 {
+			return nil, server.StatusMsgErr(http.StatusBadRequest, "timeout должен быть числом секунд", nil)
+		}
+		timeout = time.Duration(sec) * time.Second
+	}
+	c.w.Drain(timeout)
+	return c.DrainStatus(req)
+}
+
+// Get, "/v1/agent/drain" - ход остановки агента
+func (c *Agent) DrainStatus(req *http.Request) (*worker.DrainState, error) {
+	var state = c.w.DrainStatus()
+	return &state, nil
+}
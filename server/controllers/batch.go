@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/disk"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/server"
+	"mediamagi.ru/win-file-agent/worker"
+)
+
+// BatchResult результат создания одного задания пакета: ключ или ошибка
+type BatchResult struct {
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DeleteResult результат массовой отмены и удаления заданий
+type DeleteResult struct {
+	Canceled []string `json:"canceled"`
+	Deleted  []string `json:"deleted"`
+}
+
+// Post, "/v1/tasks:batch" - создание заданий пакетом, тело - массив запросов как для Post, "/v1/task".
+// Ответ - результат по каждому заданию в том же порядке. Место в очереди и на диске проверяется
+// сразу для всех принятых заданий, если его не хватает, то не создается ни одно задание
+func (c *Task) CreateBatch(req *http.Request) (*[]*BatchResult, error) {
+	defer req.Body.Close()
+	if err := c.accepting(); err != nil {
+		return nil, err
+	}
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, server.StatusErr(http.StatusBadRequest, err)
+	}
+	var items []json.RawMessage
+	if err = json.Unmarshal(bodyBytes, &items); err != nil || len(items) == 0 {
+		return nil, server.StatusMsgErr(http.StatusBadRequest, "Ожидается непустой массив заданий", err)
+	}
+
+	var res = make([]*BatchResult, len(items))
+	var prepared = make([]*worker.Task, len(items))
+	for idx, it := range items {
+		if prepared[idx], err = prepare(it, "", ""); err != nil {
+			res[idx] = batchError(err)
+		}
+	}
+
+	// проверка ключей и места, постановка в очередь одной операцией для конкурентных
+	// пакетов и заданий, как в create
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	var queued, waiting []*worker.Task
+	// tasksByDir кол-во заданий на входящую папку, каждому нужен oneGB свободного места
+	var tasksByDir = make(map[string]uint64)
+	var ids = make(map[string]bool)
+	for idx, tw := range prepared {
+		if tw == nil {
+			continue
+		}
+		if _, ok := c.store.Load(tw.ID); ok || ids[tw.ID] {
+			res[idx] = batchError(conflict(tw.ID))
+			continue
+		}
+		ids[tw.ID] = true
+		tasksByDir[tw.InDir]++
+		if len(tw.Uploads) > 0 {
+			waiting = append(waiting, tw)
+		} else {
+			queued = append(queued, tw)
+		}
+		res[idx] = &BatchResult{ID: tw.ID, Status: http.StatusCreated}
+	}
+	for inDir, count := range tasksByDir {
+		fs, err := disk.GetFreeSpace(inDir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if fs < oneGB*count {
+			return nil, server.StatusMsgErr(http.StatusInsufficientStorage,
+				fmt.Sprintf("На диске папки %s нет места для %d заданий", inDir, count), nil)
+		}
+	}
+	if err = c.w.ExecBatch(queued); err != nil {
+		return nil, server.StatusMsgErr(http.StatusServiceUnavailable, err.Error(), nil)
+	}
+	for _, tw := range waiting {
+		c.w.WaitUploads(tw, uploadTimeout())
+	}
+	return &res, nil
+}
+
+func batchError(err error) *BatchResult {
+	if st, ok := err.(*server.StCode); ok {
+		return &BatchResult{Status: st.Code(), Error: st.Error()}
+	}
+	return &BatchResult{Status: http.StatusBadRequest, Error: errors.Cause(err).Error()}
+}
+
+// Delete, "/v1/tasks?state=ERROR,FINISH&err_kind=download&id=a,b" - массовая отмена и удаление заданий по фильтру.
+// Незавершенные задания отменяются, завершенные и упавшие убираются из агента. Нужен хотя бы один фильтр,
+// state - названия или коды состояний через запятую
+func (c *Task) DeleteBatch(req *http.Request) (*DeleteResult, error) {
+	var query = req.URL.Query()
+	var filter = worker.TaskFilter{IDs: splitList(query.Get("id")), ErrKind: query.Get("err_kind")}
+	for _, name := range splitList(query.Get("state")) {
+		state, ok := parseState(name)
+		if !ok {
+			return nil, server.StatusMsgErr(http.StatusBadRequest, fmt.Sprintf("Неизвестное состояние %s", name), nil)
+		}
+		filter.States = append(filter.States, state)
+	}
+	if filter.IsEmpty() {
+		return nil, server.StatusMsgErr(http.StatusBadRequest, "Не задан фильтр state, err_kind или id", nil)
+	}
+
+	var res = new(DeleteResult)
+	res.Canceled, res.Deleted = c.w.DeleteTasks(filter)
+	return res, nil
+}
+
+// parseState состояние по названию или коду
+func parseState(name string) (worker.StateCode, bool) {
+	if code, err := strconv.Atoi(name); err == nil {
+		var state = worker.StateCode(code)
+		return state, len(state.String()) > 0
+	}
+	for _, state := range []worker.StateCode{worker.CREATE, worker.DOWNLOAD, worker.PROCESS, worker.SAVING,
+		worker.CANCEL, worker.FINISH, worker.VERIFY, worker.PAUSED, worker.ERROR} {
+		if strings.EqualFold(name, state.String()) {
+			return state, true
+		}
+	}
+	return worker.CREATE, false
+}
+
+func splitList(val string) []string {
+	var res []string
+	for _, it := range strings.Split(val, ",") {
+		if it = strings.TrimSpace(it); len(it) > 0 {
+			res = append(res, it)
+		}
+	}
+	return res
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/server"
+	"mediamagi.ru/win-file-agent/store"
+	"mediamagi.ru/win-file-agent/worker"
+)
+
+func TestTaskBatch(t *testing.T) {
+	var ctx, cf = context.WithCancel(context.TODO())
+	defer cf()
+	var st = store.NewRam[string, *worker.Task](ctx)
+	var w = worker.New(st)
+	var c = NewTask(st, w)
+
+	var dir = filepath.ToSlash(t.TempDir())
+	var item = func(url string) string {
+		return `{"in_dir":"` + dir + `","out_dir":"` + dir + `","urls":["http://host/` + url + `"],"cmd":"cmd","args":["{input}","{output}"]}`
+	}
+	var batch = func(items ...string) (*[]*BatchResult, error) {
+		var req = httptest.NewRequest(http.MethodPost, "/v1/tasks:batch", strings.NewReader("["+strings.Join(items, ",")+"]"))
+		return c.CreateBatch(req)
+	}
+
+	res, err := batch(item("a"), `{"cmd":"cmd"}`, item("a"), item("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []int
+	for _, it := range *res {
+		codes = append(codes, it.Status)
+	}
+	if len(codes) != 4 || codes[0] != http.StatusCreated || codes[1] != http.StatusBadRequest ||
+		codes[2] != http.StatusConflict || codes[3] != http.StatusCreated || len((*res)[0].ID) == 0 {
+		t.Fatalf("results %v", codes)
+	}
+	if len(st.GetKeys()) != 2 {
+		t.Errorf("tasks %d", len(st.GetKeys()))
+	}
+
+	// в очереди на 10 заданий осталось 8 мест, пакет из 9 не принимается целиком
+	var items []string
+	for idx := range 9 {
+		items = append(items, item(string(rune('c'+idx))))
+	}
+	if _, err = batch(items...); err == nil {
+		t.Fatal("batch over queue capacity")
+	}
+	if len(st.GetKeys()) != 2 {
+		t.Errorf("tasks after rejected batch %d", len(st.GetKeys()))
+	}
+	// очередь заполнена, одиночное задание не ждет места в ней
+	if _, err = batch(items[:8]...); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Create(httptest.NewRequest(http.MethodPost, "/v1/task", strings.NewReader(item("z"))))
+	if st, ok := err.(*server.StCode); !ok || st.Code() != http.StatusServiceUnavailable {
+		t.Fatalf("create on full queue err %v", err)
+	}
+
+	// отмена заданий в очереди и удаление упавших
+	var req = httptest.NewRequest(http.MethodDelete, "/v1/tasks", nil)
+	if _, err = c.DeleteBatch(req); err == nil {
+		t.Error("delete without filter")
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/v1/tasks?state=create,0", nil)
+	deleted, err := c.DeleteBatch(req)
+	if err != nil || len(deleted.Canceled) != 10 || len(deleted.Deleted) != 0 {
+		t.Fatalf("cancel %+v err %v", deleted, err)
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/v1/tasks?state=ERROR&err_kind=cancel", nil)
+	deleted, err = c.DeleteBatch(req)
+	if err != nil || len(deleted.Deleted) != 10 || len(st.GetKeys()) != 0 {
+		t.Fatalf("delete %+v err %v", deleted, err)
+	}
+}
@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/server"
+	"mediamagi.ru/win-file-agent/store"
+	"mediamagi.ru/win-file-agent/worker"
+)
+
+const (
+	// индексы заданий в store для отбора по cmd и tag
+	indexCmd = "cmd"
+	indexTag = "tag"
+
+	listLimit    = 100
+	listLimitMax = 1000
+)
+
+// TaskList страница списка заданий
+type TaskList struct {
+	// Tasks задания, с fields - только выбранные поля
+	Tasks []any `json:"tasks"`
+	// Next курсор следующей страницы, пустой на последней странице
+	Next string `json:"next,omitempty"`
+	// Total кол-во заданий, подходящих под фильтр, на всех страницах
+	Total int `json:"total"`
+	// Summary кол-во подходящих под фильтр заданий по состояниям
+	Summary map[string]int `json:"summary"`
+}
+
+// taskOrder порядок списка заданий: по времени приема или ключу, desc - по убыванию
+type taskOrder struct {
+	byID bool
+	desc bool
+}
+
+func (c taskOrder) less(a, b *worker.Task) bool {
+	var res int
+	if !c.byID {
+		res = a.Created.Compare(b.Created)
+	}
+	if res == 0 {
+		res = strings.Compare(a.ID, b.ID)
+	}
+	if c.desc {
+		return res > 0
+	}
+	return res < 0
+}
+
+// indexTasks индексы store для отбора заданий по командам и меткам
+func indexTasks(storeT store.Store[string, *worker.Task]) {
+	storeT.Index(indexCmd, func(task *worker.Task) []string { return task.Cmds() })
+	storeT.Index(indexTag, func(task *worker.Task) []string { return task.Tags })
+}
+
+// Get, "/v1/task" - список заданий. Без параметров - ключи всех заданий в работе ["qwe", "rty"],
+// с параметрами - TaskList с отбором, сортировкой и страницами
+func (c *Task) GetAll(req *http.Request) (*any, error) {
+	var res any
+	if len(req.URL.RawQuery) == 0 {
+		res = c.store.GetKeys()
+		return &res, nil
+	}
+	list, err := c.list(req.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	res = list
+	return &res, nil
+}
+
+// list отбор заданий по параметрам запроса: state, created_after, created_before, cmd, tag, q,
+// сортировка sort, страница cursor и limit, поля fields
+func (c *Task) list(query url.Values) (*TaskList, error) {
+	var states []worker.StateCode
+	for _, name := range splitList(query.Get("state")) {
+		state, ok := parseState(name)
+		if !ok {
+			return nil, server.StatusMsgErr(http.StatusBadRequest, fmt.Sprintf("Неизвестное состояние %s", name), nil)
+		}
+		states = append(states, state)
+	}
+	after, err := parseTime(query.Get("created_after"))
+	if err != nil {
+		return nil, err
+	}
+	before, err := parseTime(query.Get("created_before"))
+	if err != nil {
+		return nil, err
+	}
+	var cmds, tags = splitList(query.Get("cmd")), splitList(query.Get("tag"))
+	var text = strings.ToLower(query.Get("q"))
+
+	var order taskOrder
+	switch sort := query.Get("sort"); strings.TrimPrefix(sort, "-") {
+	case "", "created":
+		// по умолчанию сначала новые
+		order.desc = len(sort) == 0 || strings.HasPrefix(sort, "-")
+	case "id":
+		order.byID = true
+		order.desc = strings.HasPrefix(sort, "-")
+	default:
+		return nil, server.StatusMsgErr(http.StatusBadRequest, fmt.Sprintf("Неизвестная сортировка %s", sort), nil)
+	}
+	var limit = listLimit
+	if val := query.Get("limit"); len(val) > 0 {
+		if limit, err = strconv.Atoi(val); err != nil || limit < 1 || limit > listLimitMax {
+			return nil, server.StatusMsgErr(http.StatusBadRequest, fmt.Sprintf("limit от 1 до %d", listLimitMax), err)
+		}
+	}
+
+	var res = &TaskList{Tasks: []any{}, Summary: make(map[string]int)}
+	var q = store.Query[string, *worker.Task]{
+		Filter: func(key string, task *worker.Task) bool {
+			var state = task.GetState()
+			var ok = (len(states) == 0 || slices.Contains(states, state)) &&
+				(after.IsZero() || task.Created.After(after)) &&
+				(before.IsZero() || task.Created.Before(before)) &&
+				(len(cmds) == 0 || slices.ContainsFunc(task.Cmds(), func(cmd string) bool { return slices.Contains(cmds, cmd) })) &&
+				(len(tags) == 0 || slices.ContainsFunc(task.Tags, func(tag string) bool { return slices.Contains(tags, tag) })) &&
+				(len(text) == 0 || matchText(task, text))
+			if ok {
+				res.Summary[state.String()]++
+			}
+			return ok
+		},
+		Less:  order.less,
+		Limit: limit,
+	}
+	// отбор по индексу сужает перебор, условие Filter проверяется все равно
+	if len(tags) > 0 {
+		q.Index, q.IndexKeys = indexTag, tags
+	} else if len(cmds) > 0 {
+		q.Index, q.IndexKeys = indexCmd, cmds
+	}
+	if val := query.Get("cursor"); len(val) > 0 {
+		pivot, err := parseCursor(val)
+		if err != nil {
+			return nil, err
+		}
+		q.After = func(task *worker.Task) bool { return order.less(pivot, task) }
+	}
+
+	var found = c.store.Query(q)
+	res.Total = found.Total
+	if found.More {
+		res.Next = makeCursor(found.Values[len(found.Values)-1])
+	}
+	var fields = splitList(query.Get("fields"))
+	for _, task := range found.Values {
+		if len(fields) == 0 {
+			res.Tasks = append(res.Tasks, task)
+			continue
+		}
+		item, err := project(task, fields)
+		if err != nil {
+			return nil, err
+		}
+		res.Tasks = append(res.Tasks, item)
+	}
+	return res, nil
+}
+
+// matchText text (в нижнем регистре) есть в ключе, командах, аргументах, ссылках, метках или ошибке задания
+func matchText(task *worker.Task, text string) bool {
+	var values = []string{task.ID, task.GetMsg()}
+	values = append(values, task.Cmds()...)
+	values = append(values, task.Args...)
+	// поиск по ссылкам без паролей, как они выдаются в ответе
+	values = append(values, worker.RedactUrls(task.Urls)...)
+	values = append(values, task.Tags...)
+	return slices.ContainsFunc(values, func(val string) bool {
+		return strings.Contains(strings.ToLower(val), text)
+	})
+}
+
+// project поля fields задания в том виде, как они в ответе Get, "/v1/task/{id}"
+func project(task *worker.Task, fields []string) (map[string]json.RawMessage, error) {
+	buffer, err := json.Marshal(task)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var all map[string]json.RawMessage
+	if err = json.Unmarshal(buffer, &all); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var res = make(map[string]json.RawMessage, len(fields))
+	for _, name := range fields {
+		if val, ok := all[name]; ok {
+			res[name] = val
+		}
+	}
+	return res, nil
+}
+
+// parseTime время в формате RFC3339, пустое - без ограничения
+func parseTime(val string) (time.Time, error) {
+	if len(val) == 0 {
+		return time.Time{}, nil
+	}
+	res, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return res, server.StatusMsgErr(http.StatusBadRequest, fmt.Sprintf("Время %s не в формате RFC3339", val), err)
+	}
+	return res, nil
+}
+
+// makeCursor курсор после задания task: время приема и ключ
+func makeCursor(task *worker.Task) string {
+	var val = strconv.FormatInt(task.Created.UnixNano(), 10) + ":" + task.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(val))
+}
+
+// parseCursor задание с временем приема и ключом из курсора для сравнения в taskOrder
+func parseCursor(cursor string) (*worker.Task, error) {
+	var invalid = server.StatusMsgErr(http.StatusBadRequest, "Неверный cursor", nil)
+	buffer, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	nsec, id, ok := strings.Cut(string(buffer), ":")
+	if !ok {
+		return nil, invalid
+	}
+	created, err := strconv.ParseInt(nsec, 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	return &worker.Task{ID: id, Created: time.Unix(0, created)}, nil
+}
@@ -1,36 +1,59 @@
 package controllers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
 
+	"mediamagi.ru/win-file-agent/config"
 	"mediamagi.ru/win-file-agent/disk"
 	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
 	"mediamagi.ru/win-file-agent/server"
 	"mediamagi.ru/win-file-agent/store"
 	"mediamagi.ru/win-file-agent/worker"
 )
 
+// idempotencyTTL сколько помнится ответ на запрос с Idempotency-Key
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyEntry ответ на запрос с Idempotency-Key
+type idempotencyEntry struct {
+	// hash тела запроса
+	hash [sha256.Size]byte
+	// id ключ созданного задания, пустой пока запрос выполняется
+	id string
+}
+
 type Task struct {
 	w     *worker.Worker
 	store store.Store[string, *worker.Task]
+	// keys ответы на запросы с Idempotency-Key
+	keys     store.Store[string, *idempotencyEntry]
+	keysLock sync.Mutex
+	// admitLock проверка места на диске и постановка в очередь новых заданий
+	admitLock sync.Mutex
 }
 
-func NewTask(store store.Store[string, *worker.Task], w *worker.Worker) *Task {
+func NewTask(storeT store.Store[string, *worker.Task], w *worker.Worker) *Task {
+	indexTasks(storeT)
 	return &Task{
-		store: store,
+		store: storeT,
 		w:     w,
+		keys:  store.NewRam[string, *idempotencyEntry](context.TODO()),
 	}
 }
 
-// Get, "/v1/task" - получение списка ключей всех заданий в работе
-func (c *Task) GetAll(req *http.Request) (*[]string, error) {
-	var ks = c.store.GetKeys()
-	return &ks, nil
-}
-
 // Get, "/v1/task/{id}" - получение задание и его статус.
 func (c *Task) Get(req *http.Request) (*worker.Task, error) {
 	var id = req.PathValue("id")
@@ -46,22 +69,99 @@ func (c *Task) Get(req *http.Request) (*worker.Task, error) {
 }
 
 // Post, "/v1/task" - создание задания на обработку.
+// С заголовком Idempotency-Key повтор запроса с тем же ключом получает тот же ответ.
 func (c *Task) Create(req *http.Request) (*string, error) {
 	defer req.Body.Close()
+	if err := c.accepting(); err != nil {
+		return nil, err
+	}
 	bodyBytes, err := io.ReadAll(req.Body)
 	if err != nil {
 		return nil, server.StatusErr(http.StatusBadRequest, err)
 	}
+	if key := req.Header.Get("Idempotency-Key"); len(key) > 0 {
+		return c.createOnce(key, bodyBytes)
+	}
+	return c.create(bodyBytes, "", "")
+}
 
-	var t = new(TaskReq)
-	if err = json.Unmarshal(bodyBytes, t); err != nil {
-		return nil, errors.WithStack(err)
+// Restore запускает задание, сохраненное при остановке агента, с прежним ключом.
+// Задание не ждет места в очереди и ставится в нее, когда место появится.
+// Задание с uploads снова ждет загрузки файлов
+func (c *Task) Restore(task worker.DrainedTask) (string, error) {
+	tw, err := prepare(task.Request, task.ID, "")
+	if err != nil {
+		return "", err
 	}
-	if err = t.verification(); err != nil {
-		return nil, server.StatusMsgErr(http.StatusBadRequest, err.Error(), err)
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	if _, ok := c.store.Load(tw.ID); ok {
+		return "", conflict(tw.ID)
+	}
+	if len(tw.Uploads) > 0 {
+		c.w.WaitUploads(tw, uploadTimeout())
+	} else {
+		c.w.ExecTaskLater(tw)
+	}
+	return tw.ID, nil
+}
+
+// accepting ошибка 503, если агент не принимает новые задания
+func (c *Task) accepting() error {
+	if c.w.IsDraining() {
+		return server.StatusMsgErr(http.StatusServiceUnavailable, "Агент останавливается, задания не принимаются", nil)
+	}
+	if c.w.IsQueuePaused() && config.Load().PauseReject {
+		return server.StatusMsgErr(http.StatusServiceUnavailable, "Агент на паузе, задания не принимаются", nil)
+	}
+	return nil
+}
+
+// createOnce создание задания с Idempotency-Key. Ответ запоминается на idempotencyTTL,
+// ключ с другим телом запроса - 422, повтор до ответа на первый запрос - 409
+func (c *Task) createOnce(key string, bodyBytes []byte) (*string, error) {
+	var hash = sha256.Sum256(bodyBytes)
+	c.keysLock.Lock()
+	if entry, ok := c.keys.Load(key); ok {
+		c.keysLock.Unlock()
+		if entry.hash != hash {
+			return nil, server.StatusMsgErr(http.StatusUnprocessableEntity, "Idempotency-Key уже использован с другим запросом", nil)
+		}
+		if len(entry.id) == 0 {
+			return nil, server.StatusMsgErr(http.StatusConflict, "Запрос с этим Idempotency-Key еще выполняется", nil)
+		}
+		var id = entry.id
+		return &id, server.StatusCode(http.StatusCreated)
+	}
+	var entry = &idempotencyEntry{hash: hash}
+	c.keys.Store(key, entry)
+	c.keysLock.Unlock()
+
+	id, err := c.create(bodyBytes, "", key)
+	c.keysLock.Lock()
+	defer c.keysLock.Unlock()
+	if id == nil {
+		// ошибку можно повторить с тем же ключом
+		c.keys.Delete(key)
+		return nil, err
+	}
+	entry.id = *id
+	c.keys.SetTimeout(key, time.Now().Add(idempotencyTTL))
+	return id, err
+}
+
+// create создает задание из тела запроса. id - ключ восстановленного задания,
+// key - Idempotency-Key, иначе ключ - hash запроса
+func (c *Task) create(bodyBytes []byte, id, key string) (*string, error) {
+	tw, err := prepare(bodyBytes, id, key)
+	if err != nil {
+		return nil, err
 	}
 
-	fs, err := disk.GetFreeSpace(t.InDir)
+	// проверка места и постановка в очередь одной операцией, как для пакета заданий
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	fs, err := disk.GetFreeSpace(tw.InDir)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -69,16 +169,194 @@ func (c *Task) Create(req *http.Request) (*string, error) {
 		return nil, server.StatusCode(http.StatusInsufficientStorage)
 	}
 
-	var tw = t.ToWTask()
 	if _, ok := c.store.Load(tw.ID); ok {
-		return nil, server.StatusMsgErr(http.StatusConflict, fmt.Sprintf("Задача с таких hash %s в работе.", tw.ID), nil)
+		if len(key) > 0 {
+			// повтор с тем же ключом после перезапуска агента
+			return &tw.ID, server.StatusCode(http.StatusCreated)
+		}
+		return nil, conflict(tw.ID)
+	}
+
+	if err = c.start(tw); err != nil {
+		return nil, err
+	}
+	return &tw.ID, server.StatusCode(http.StatusCreated)
+}
+
+// prepare задание из тела запроса после проверки
+func prepare(bodyBytes []byte, id, key string) (*worker.Task, error) {
+	var t = new(TaskReq)
+	var err = json.Unmarshal(bodyBytes, t)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = t.verification(); err != nil {
+		return nil, server.StatusMsgErr(http.StatusBadRequest, err.Error(), err)
+	}
+
+	if len(id) > 0 {
+		t.id = id
+	} else if len(key) > 0 {
+		t.id = keyID(t.getID(), key)
+	}
+	var tw = t.ToWTask()
+	tw.Request = bodyBytes
+	return tw, nil
+}
+
+func conflict(id string) error {
+	return server.StatusMsgErr(http.StatusConflict, fmt.Sprintf("Задача с таких hash %s в работе.", id), nil)
+}
+
+// start задание ждет загрузки файлов или ставится в очередь, если в ней нет места - 503
+func (c *Task) start(tw *worker.Task) error {
+	if len(tw.Uploads) > 0 {
+		c.w.WaitUploads(tw, uploadTimeout())
+		return nil
+	}
+	if err := c.w.ExecTask(tw); err != nil {
+		return server.StatusMsgErr(http.StatusServiceUnavailable, err.Error(), nil)
+	}
+	return nil
+}
+
+// RerunReq параметры перезапуска задания
+type RerunReq struct {
+	// From этап, с которого начинается копия: download (по умолчанию), process, verify, saving
+	From string `json:"from"`
+}
+
+// Post, "/v1/task/{id}/rerun" - копия завершенного или упавшего задания с новым ключом,
+// тело запроса {"from":"process"} необязательно. Ответ - ключ копии
+func (c *Task) Rerun(req *http.Request) (*string, error) {
+	defer req.Body.Close()
+	var id = req.PathValue("id")
+	if len(id) == 0 {
+		return nil, server.StatusCode(http.StatusBadRequest)
+	}
+	if err := c.accepting(); err != nil {
+		return nil, err
+	}
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, server.StatusErr(http.StatusBadRequest, err)
+	}
+	var r = new(RerunReq)
+	if len(bodyBytes) > 0 {
+		if err = json.Unmarshal(bodyBytes, r); err != nil {
+			return nil, server.StatusMsgErr(http.StatusBadRequest, "Ожидается {\"from\":\"<этап>\"}", err)
+		}
+	}
+	var from = worker.CREATE
+	if len(r.From) > 0 {
+		var ok bool
+		if from, ok = worker.ParseStage(r.From); !ok {
+			return nil, server.StatusMsgErr(http.StatusBadRequest, fmt.Sprintf("Неизвестный этап %s, ожидается download, process, verify или saving", r.From), nil)
+		}
 	}
 
-	c.w.ExecTask(tw)
+	tw, err := c.w.Clone(id, from)
+	switch errors.Cause(err) {
+	case nil:
+	case worker.ErrTaskNotFound:
+		return nil, server.StatusMsgErr(http.StatusNotFound, err.Error(), nil)
+	case worker.ErrRerunState, worker.ErrRerunFiles:
+		return nil, server.StatusMsgErr(http.StatusConflict, err.Error(), nil)
+	default:
+		return nil, server.StatusMsgErr(http.StatusBadRequest, err.Error(), err)
+	}
 
+	if err = c.start(tw); err != nil {
+		c.w.Discard(tw)
+		return nil, err
+	}
 	return &tw.ID, server.StatusCode(http.StatusCreated)
 }
 
+// Post, "/v1/task/{id}/files" - загрузка входящих файлов задания в multipart/form-data.
+// Имя файла в части формы должно быть объявлено в uploads задания.
+func (c *Task) Upload(req *http.Request) (*[]*worker.UploadFile, error) {
+	defer req.Body.Close()
+	var id = req.PathValue("id")
+	if len(id) == 0 {
+		return nil, server.StatusCode(http.StatusBadRequest)
+	}
+	task, ok := c.store.Load(id)
+	if !ok {
+		return nil, server.StatusCode(http.StatusNotFound)
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, server.StatusMsgErr(http.StatusBadRequest, "Ожидается multipart/form-data", err)
+	}
+
+	var res = make([]*worker.UploadFile, 0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &res, server.StatusErr(http.StatusBadRequest, errors.WithStack(err))
+		}
+		var name = part.FileName()
+		if len(name) == 0 {
+			part.Close()
+			continue
+		}
+
+		fs, err := disk.GetFreeSpace(task.InDir)
+		if err != nil {
+			part.Close()
+			return &res, errors.WithStack(err)
+		}
+		if fs < oneGB {
+			part.Close()
+			return &res, server.StatusCode(http.StatusInsufficientStorage)
+		}
+		// оставляем на диске не меньше oneGB
+		var maxSize = int64(fs - oneGB)
+		var diskLimit = true
+		if limit := config.Load().UploadMaxSize; limit > 0 && limit < maxSize {
+			maxSize, diskLimit = limit, false
+		}
+
+		up, err := c.w.Upload(req.Context(), id, name, part, maxSize)
+		part.Close()
+		if errors.Cause(err) == worker.ErrUploadTooLarge && diskLimit {
+			// файл не поместился на диск, а не превысил upload_max_size
+			return &res, server.StatusMsgErr(http.StatusInsufficientStorage, fmt.Sprintf("%s: %s", name, errors.Cause(err)), nil)
+		}
+		if err != nil {
+			return &res, uploadStatus(name, err)
+		}
+		res = append(res, up)
+	}
+	return &res, nil
+}
+
+func uploadStatus(name string, err error) error {
+	var msg = fmt.Sprintf("%s: %s", name, errors.Cause(err))
+	switch errors.Cause(err) {
+	case worker.ErrTaskNotFound:
+		return server.StatusMsgErr(http.StatusNotFound, msg, nil)
+	case worker.ErrUploadUnknown:
+		return server.StatusMsgErr(http.StatusBadRequest, msg, nil)
+	case worker.ErrUploadDuplicate, worker.ErrUploadClosed:
+		return server.StatusMsgErr(http.StatusConflict, msg, nil)
+	case worker.ErrUploadTooLarge:
+		return server.StatusMsgErr(http.StatusRequestEntityTooLarge, msg, nil)
+	}
+	return err
+}
+
+func uploadTimeout() time.Duration {
+	if sec := config.Load().UploadTimeout; sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return time.Hour
+}
+
 // Delete, "/v1/task/{id}" отмена задания. {id}
 func (c *Task) Delete(req *http.Request) (*any, error) {
 	var id = req.PathValue("id")
@@ -93,3 +371,97 @@ func (c *Task) Delete(req *http.Request) (*any, error) {
 
 	return nil, nil
 }
+
+// Post, "/v1/task/{id}/pause" - пауза задания: задание в очереди не запускается,
+// у выполняющегося приостанавливаются команды и передача файлов
+func (c *Task) Pause(req *http.Request) (*any, error) {
+	var id = req.PathValue("id")
+	if len(id) == 0 {
+		return nil, server.StatusCode(http.StatusBadRequest)
+	}
+	return nil, pauseStatus(c.w.Pause(id))
+}
+
+// Post, "/v1/task/{id}/resume" - продолжение задания после паузы
+func (c *Task) Resume(req *http.Request) (*any, error) {
+	var id = req.PathValue("id")
+	if len(id) == 0 {
+		return nil, server.StatusCode(http.StatusBadRequest)
+	}
+	return nil, pauseStatus(c.w.Resume(id))
+}
+
+func pauseStatus(err error) error {
+	switch errors.Cause(err) {
+	case nil:
+		return nil
+	case worker.ErrTaskNotFound:
+		return server.StatusMsgErr(http.StatusNotFound, err.Error(), nil)
+	case worker.ErrPauseState:
+		return server.StatusMsgErr(http.StatusConflict, err.Error(), nil)
+	case worker.ErrQueueFull:
+		return server.StatusMsgErr(http.StatusServiceUnavailable, err.Error(), nil)
+	}
+	return err
+}
+
+// Get, "/v1/task/{id}/files" - список результатов задания с размером и sha256
+func (c *Task) Files(req *http.Request) (*[]*worker.OutFile, error) {
+	var id = req.PathValue("id")
+	if len(id) == 0 {
+		return nil, server.StatusCode(http.StatusBadRequest)
+	}
+	task, ok := c.store.Load(id)
+	if !ok {
+		return nil, server.StatusCode(http.StatusNotFound)
+	}
+	var res = task.Outputs
+	if res == nil {
+		res = make([]*worker.OutFile, 0)
+	}
+	return &res, nil
+}
+
+// Get, "/v1/task/{id}/files/{name...}" - скачивание результата завершенного задания.
+// Поддерживается Range, sha256 файла передается в заголовках Digest и X-Content-Sha256.
+func (c *Task) File(w http.ResponseWriter, req *http.Request) {
+	task, ok := c.store.Load(req.PathValue("id"))
+	if !ok {
+		http.Error(w, "Задание не найдено", http.StatusNotFound)
+		return
+	}
+	if task.GetState() != worker.FINISH {
+		http.Error(w, "Задание не завершено", http.StatusConflict)
+		return
+	}
+	out, ok := task.FindOutput(req.PathValue("name"))
+	if !ok {
+		http.Error(w, "Файл не найден", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(out.Path)
+	if err != nil {
+		log.Error("Task %s os.Open error, filePath %s, err %+v", task.ID, out.Path, err)
+		http.Error(w, "Файл не найден", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Error("%+v", errors.WithStack(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(out.Sha256) > 0 {
+		if sum, err := hex.DecodeString(out.Sha256); err == nil {
+			w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+		}
+		w.Header().Set("X-Content-Sha256", out.Sha256)
+		w.Header().Set("ETag", `"`+out.Sha256+`"`)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(out.Name)}))
+	// ServeContent выставляет Content-Length и обрабатывает Range
+	http.ServeContent(w, req, out.Name, info.ModTime(), file)
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/store"
+	"mediamagi.ru/win-file-agent/worker"
+)
+
+func TestTaskFile(t *testing.T) {
+	var ctx, cf = context.WithCancel(context.TODO())
+	defer cf()
+	var st = store.NewRam[string, *worker.Task](ctx)
+	var c = NewTask(st, worker.New(st))
+
+	var outPath = filepath.Join(t.TempDir(), "666_0.mp4")
+	var data = []byte("0123456789")
+	if err := os.WriteFile(outPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var sum = sha256.Sum256(data)
+	var task = &worker.Task{
+		ID:      "666",
+		State:   worker.PROCESS,
+		Outputs: []*worker.OutFile{{Name: "666_0.mp4", Path: outPath, Size: 10, Sha256: hex.EncodeToString(sum[:])}},
+	}
+	st.Store(task.ID, task)
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("GET /v1/task/{id}/files/{name...}", c.File)
+	var get = func(target, rng string) *http.Response {
+		var req = httptest.NewRequest(http.MethodGet, target, nil)
+		if len(rng) > 0 {
+			req.Header.Set("Range", rng)
+		}
+		var rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	if resp := get("/v1/task/666/files/666_0.mp4", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("not finished status %d", resp.StatusCode)
+	}
+	task.State = worker.FINISH
+	if resp := get("/v1/task/666/files/other.mp4", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown file status %d", resp.StatusCode)
+	}
+
+	var resp = get("/v1/task/666/files/666_0.mp4", "")
+	var body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != string(data) || resp.ContentLength != 10 {
+		t.Errorf("status %d body %q length %d", resp.StatusCode, body, resp.ContentLength)
+	}
+	if resp.Header.Get("X-Content-Sha256") != task.Outputs[0].Sha256 {
+		t.Errorf("sha256 header %q", resp.Header.Get("X-Content-Sha256"))
+	}
+
+	resp = get("/v1/task/666/files/666_0.mp4", "bytes=4-")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "456789" {
+		t.Errorf("range status %d body %q", resp.StatusCode, body)
+	}
+}
+
+func TestTaskCreateIdempotency(t *testing.T) {
+	var ctx, cf = context.WithCancel(context.TODO())
+	defer cf()
+	var st = store.NewRam[string, *worker.Task](ctx)
+	var c = NewTask(st, worker.New(st))
+
+	var dir = filepath.ToSlash(t.TempDir())
+	var body = `{"in_dir":"` + dir + `","out_dir":"` + dir + `","uploads":["a.mp4"],"cmd":"cmd","args":["{input}","{output}"]}`
+	var create = func(key, body string) (*string, error) {
+		var req = httptest.NewRequest(http.MethodPost, "/v1/task", strings.NewReader(body))
+		if len(key) > 0 {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		return c.Create(req)
+	}
+
+	first, _ := create("k1", body)
+	retry, _ := create("k1", body)
+	if first == nil || retry == nil || *first != *retry {
+		t.Fatalf("retry id %v, first %v", retry, first)
+	}
+	other, _ := create("k2", body)
+	if other == nil || *other == *first {
+		t.Errorf("other key id %v", other)
+	}
+	if id, err := create("k1", strings.Replace(body, "cmd", "cmd2", 1)); id != nil || err == nil ||
+		err.Error() != "Idempotency-Key уже использован с другим запросом" {
+		t.Errorf("changed body id %v err %v", id, err)
+	}
+
+	// без ключа повтор того же запроса - 409
+	if id, _ := create("", body); id == nil {
+		t.Fatal("create without key")
+	}
+	if id, err := create("", body); id != nil || err == nil {
+		t.Errorf("repeat without key id %v err %v", id, err)
+	}
+}
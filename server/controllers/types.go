@@ -1,12 +1,13 @@
 package controllers
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"mediamagi.ru/win-file-agent/config"
@@ -18,29 +19,96 @@ import (
 const oneGB uint64 = 1000 * 1000 * 1000
 
 type TaskReq struct {
-	InDir  string      `json:"in_dir"`
-	OutDir string      `json:"out_dir"`
-	Urls   []string    `json:"urls"`
-	Cmd    string      `json:"cmd"`
-	Args   []string    `json:"args"`
-	OutExt string      `json:"out_ext"`
-	Ftp    *worker.Ftp `json:"ftp"`
+	InDir     string           `json:"in_dir"`
+	OutDir    string           `json:"out_dir"`
+	Urls      []string         `json:"urls"`
+	InputMode worker.InputMode `json:"input_mode"`
+	Cmd       string           `json:"cmd"`
+	Args      []string         `json:"args"`
+	OutExt    string           `json:"out_ext"`
+	// Vars переменные для {var.<имя>} в args
+	Vars map[string]string `json:"vars"`
+	// Steps цепочка команд вместо cmd и args, результаты шага - {input} следующего
+	Steps []*worker.Step `json:"steps"`
+	// Env переменные окружения команд
+	Env map[string]string `json:"env"`
+	// WorkingDir рабочая папка команд, внутри work_roots конфига
+	WorkingDir string `json:"working_dir"`
+	// Stdin стандартный ввод команды: {"file":"..."} или {"content":"..."}
+	Stdin *worker.Stdin `json:"stdin"`
+	// Success правила успешного завершения команд: exit_codes, fail_on, succeed_on, messages
+	Success *worker.SuccessPolicy `json:"success"`
+	// Limits ограничения ресурсов команд: max_memory, cpu_affinity, priority, max_output_size, max_time
+	Limits *config.Limits `json:"limits"`
+	// Workflow граф команд: map узлы для каждого файла и reduce узлы для всех файлов
+	Workflow *worker.Workflow `json:"workflow"`
+	// Outputs шаблон результатов в папке {output_dir}, например *.ts, для команд с несколькими результатами
+	Outputs string `json:"outputs"`
+	// Checksum md5, файлы .sha256 и манифест результатов
+	Checksum worker.ChecksumOptions `json:"checksum"`
+	// Verify проверки результатов перед сохранением
+	Verify *worker.VerifyOptions `json:"verify"`
+	// Ftp сохранение на ftp, если не задана out_dir. Оставлено для совместимости с destinations
+	Ftp          *worker.Ftp           `json:"ftp"`
+	Destinations []*worker.Destination `json:"destinations"`
+	// Uploads имена входящих файлов, которые загружаются запросом Post, "/v1/task/{id}/files"
+	Uploads []string `json:"uploads"`
+	// Tags метки задания для отбора в Get, "/v1/task?tag=", без меток ключ задания не меняется
+	Tags []string `json:"tags,omitempty"`
 
 	isSaveToFtp bool `json:"-"`
+	// id заданный ключ задания вместо hash запроса
+	id string `json:"-"`
 }
 
 func (c *TaskReq) ToWTask() *worker.Task {
 	var t = &worker.Task{
-		ID:     c.getID(),
-		InDir:  c.InDir,
-		OutDir: c.OutDir,
-		Urls:   c.Urls,
-		Cmd:    c.Cmd,
-		Args:   c.Args,
-		OutExt: c.OutExt,
+		ID:         c.getID(),
+		InDir:      c.InDir,
+		OutDir:     c.OutDir,
+		Urls:       c.Urls,
+		InputMode:  c.InputMode,
+		Cmd:        c.Cmd,
+		Args:       c.Args,
+		Vars:       c.Vars,
+		Env:        c.Env,
+		WorkingDir: c.WorkingDir,
+		Stdin:      c.Stdin,
+		Success:    c.Success,
+		Limits:     c.Limits,
+		OutExt:     c.OutExt,
+		OutGlob:    c.Outputs,
+		Checksum:   c.Checksum,
+		Verify:     c.Verify,
+		Tags:       c.Tags,
+	}
+	t.AddUploads(c.Uploads)
+	for _, it := range c.Steps {
+		var step = *it
+		step.State = worker.CREATE
+		step.Msg = ""
+		step.Log = ""
+		t.Steps = append(t.Steps, &step)
+	}
+	if c.Workflow != nil {
+		t.Workflow = &worker.Workflow{Parallel: c.Workflow.Parallel}
+		for _, it := range c.Workflow.Nodes {
+			var node = *it
+			node.State = worker.CREATE
+			node.Msg = ""
+			node.Log = ""
+			t.Workflow.Nodes = append(t.Workflow.Nodes, &node)
+		}
+	}
+	for _, it := range c.Destinations {
+		var dst = *it
+		dst.State = worker.CREATE
+		dst.Msg = ""
+		dst.Files = nil
+		t.Destinations = append(t.Destinations, &dst)
 	}
 	if c.isSaveToFtp {
-		t.SaveToFtp(c.Ftp)
+		t.Destinations = append(t.Destinations, &worker.Destination{Type: worker.DestFtp, Ftp: c.Ftp})
 	}
 
 	return t
@@ -52,33 +120,94 @@ func (c *TaskReq) verification() error {
 		msg = append(msg, "Не задана входящая папка")
 	}
 	if len(c.OutDir) == 0 {
-		if c.Ftp == nil {
+		if c.Ftp == nil && len(c.Destinations) == 0 {
 			msg = append(msg, "Не задана исходящая папка")
-			msg = append(msg, "Не заданы настройки ftp")
+			msg = append(msg, "Не заданы настройки ftp или destinations")
 		}
 		if len(config.Load().TmpDir) == 0 {
 			msg = append(msg, "Не задано в настройках сервиса временное хранение файлов")
 		}
-		if len(c.Ftp.Addr) == 0 {
-			msg = append(msg, "Не задан адрес ftp сервера")
+		if c.Ftp != nil {
+			if len(c.Ftp.Addr) == 0 {
+				msg = append(msg, "Не задан адрес ftp сервера")
+			}
+			c.isSaveToFtp = true
+		}
+	}
+	for idx, it := range c.Destinations {
+		if it == nil {
+			msg = append(msg, fmt.Sprintf("destinations[%d]: пустое назначение", idx))
+			continue
+		}
+		if err := worker.ValidateDest(it); err != nil {
+			msg = append(msg, fmt.Sprintf("destinations[%d]: %s", idx, err))
 		}
-		c.isSaveToFtp = true
 	}
-	if len(c.Urls) == 0 {
+	if len(c.Urls) == 0 && len(c.Uploads) == 0 {
 		msg = append(msg, "Не задан(ы) файлы для скачивания")
 	}
+	for idx, name := range c.Uploads {
+		if len(name) == 0 || name != path.Base(strings.ReplaceAll(name, "\\", "/")) || name == "." || name == ".." {
+			msg = append(msg, fmt.Sprintf("uploads[%d]: некорректное имя файла %s", idx, name))
+		} else if slices.Contains(c.Uploads[:idx], name) {
+			msg = append(msg, fmt.Sprintf("uploads[%d]: повторяется имя файла %s", idx, name))
+		}
+	}
+	if len(c.Outputs) > 0 {
+		if _, err := filepath.Match(c.Outputs, ""); err != nil || filepath.IsAbs(c.Outputs) ||
+			slices.Contains(strings.Split(filepath.ToSlash(c.Outputs), "/"), "..") {
+			msg = append(msg, fmt.Sprintf("Некорректный шаблон outputs: %s", c.Outputs))
+		}
+	}
+	if c.Verify != nil {
+		if err := c.Verify.Validate(c.Vars); err != nil {
+			msg = append(msg, err.Error())
+		}
+	}
 	for _, rawURL := range c.Urls {
-		u, err := url.ParseRequestURI(rawURL)
-		if err != nil || u.Scheme == "" || u.Host == "" {
-			msg = append(msg, fmt.Sprintf("Некорректный URL: %s", rawURL))
+		if err := worker.ValidateUrl(rawURL, c.InputMode); err != nil {
+			msg = append(msg, err.Error())
 		}
 	}
-	if len(c.Cmd) == 0 {
-		msg = append(msg, "Не задана команда запуска")
+	switch c.InputMode {
+	case worker.InputModeUrls, worker.InputModeFtpGlob:
+	default:
+		msg = append(msg, fmt.Sprintf("Неизвестный input_mode: %s", c.InputMode))
+	}
+	if err := worker.ValidateProcess(c.Env, c.WorkingDir, c.Stdin, c.Vars); err != nil {
+		msg = append(msg, err.Error())
 	}
-	// TODO точно надо проверять?
-	if len(c.Args) == 0 {
-		msg = append(msg, "Не задан(ы) аргументы для команды")
+	if err := c.Success.Validate(); err != nil {
+		msg = append(msg, err.Error())
+	}
+	if err := worker.ValidateLimits(c.Limits); err != nil {
+		msg = append(msg, err.Error())
+	}
+	if c.Workflow != nil {
+		if len(c.Cmd) > 0 || len(c.Args) > 0 || len(c.Outputs) > 0 || len(c.Steps) > 0 {
+			msg = append(msg, "cmd, args, outputs и steps задаются в workflow")
+		}
+		if err := c.Workflow.Validate(c.Vars); err != nil {
+			msg = append(msg, err.Error())
+		}
+	} else if len(c.Steps) > 0 {
+		if len(c.Cmd) > 0 || len(c.Args) > 0 || len(c.Outputs) > 0 {
+			msg = append(msg, "cmd, args и outputs задаются в steps")
+		}
+		if err := worker.ValidateSteps(c.Steps, c.Vars); err != nil {
+			msg = append(msg, err.Error())
+		}
+	} else {
+		if len(c.Cmd) == 0 {
+			msg = append(msg, "Не задана команда запуска")
+		}
+		// TODO точно надо проверять?
+		if len(c.Args) == 0 {
+			msg = append(msg, "Не задан(ы) аргументы для команды")
+		}
+		if err := worker.ValidateArgs(c.Args, c.Vars); err != nil {
+			msg = append(msg, err.Error())
+		}
 	}
 
 	if len(msg) > 0 {
@@ -93,17 +222,33 @@ func (c *TaskReq) verification() error {
 }
 
 // Если делать hash то можно отслеживать, что несколько раз кидают одинаковые команды
-// если команда уже в работе, то выдавать ошибку.
+// если команда уже в работе, то выдавать ошибку. Пароли в hash не входят.
 func (c *TaskReq) getID() string {
-	//return fmt.Sprintf("%d", time.Now().Unix())
+	if len(c.id) > 0 {
+		return c.id
+	}
 
-	var b bytes.Buffer
-	if err := gob.NewEncoder(&b).Encode(c); err != nil {
+	var req = *c
+	if req.Ftp != nil {
+		var f = *req.Ftp
+		f.Pass = ""
+		req.Ftp = &f
+	}
+	req.Urls = worker.RedactUrls(req.Urls)
+	// пароли destinations скрывает worker.Destination.MarshalJSON
+	buffer, err := json.Marshal(&req)
+	if err != nil {
 		log.Error("Обшибка создания ID, %+v", errors.WithStack(err))
 		return ""
 	}
 
-	var hash = sha256.New()
-	hash.Write(b.Bytes())
-	return hex.EncodeToString(hash.Sum(nil))
+	var hash = sha256.Sum256(buffer)
+	return hex.EncodeToString(hash[:])
+}
+
+// keyID ключ задания, созданного с Idempotency-Key: повтор запроса с тем же ключом получает тот же ID,
+// тот же запрос с другим ключом - новое задание
+func keyID(id, key string) string {
+	var hash = sha256.Sum256([]byte(id + "\n" + key))
+	return hex.EncodeToString(hash[:])
 }
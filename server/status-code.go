@@ -11,6 +11,9 @@ type StCode struct {
 
 func (c *StCode) Error() string { return c.externalMsg }
 
+// Code http код ответа
+func (c *StCode) Code() int { return c.statusCode }
+
 func StatusCode(val int) *StCode {
 	return &StCode{statusCode: val}
 }
@@ -9,4 +9,35 @@ type Store[K any, V any] interface {
 	Load(key K) (value V, ok bool)
 	GetKeys() []K
 	SetTimeout(key K, t time.Time)
+	// Index добавляет индекс name: keys - значения индекса для value.
+	// Значения индекса считаются при Store и не должны меняться, пока value хранится
+	Index(name string, keys func(value V) []string)
+	// Query выборка значений по индексу и условию с сортировкой и ограничением кол-ва
+	Query(q Query[K, V]) Result[V]
+}
+
+// Query условия выборки Store.Query
+type Query[K any, V any] struct {
+	// Index имя индекса и его значения, отбираются значения хотя бы с одним из IndexKeys.
+	// Пустой Index - отбор из всех значений
+	Index     string
+	IndexKeys []string
+	// Filter условие отбора, nil - без условия. Вызывается один раз для каждого значения,
+	// прошедшего отбор по индексу
+	Filter func(key K, value V) bool
+	// Less порядок выдачи, nil - без сортировки
+	Less func(a, b V) bool
+	// After выдаются только значения после курсора в порядке Less, nil - с начала
+	After func(value V) bool
+	// Limit максимальное кол-во значений, 0 - без ограничения
+	Limit int
+}
+
+// Result результат Store.Query
+type Result[V any] struct {
+	Values []V
+	// Total кол-во значений, прошедших Filter, без учета After и Limit
+	Total int
+	// More после Values есть еще значения
+	More bool
 }
@@ -14,12 +14,42 @@ type ram[K comparable, V any] struct {
 	lock   sync.RWMutex
 	data   map[K]V
 	timers map[K]*time.Timer
+	// indexes значения индекса -> ключи, по имени индекса
+	indexes map[string]*ramIndex[K, V]
+}
+
+type ramIndex[K comparable, V any] struct {
+	keys func(value V) []string
+	data map[string]map[K]struct{}
+}
+
+func (c *ramIndex[K, V]) add(key K, value V) {
+	for _, it := range c.keys(value) {
+		var set, ok = c.data[it]
+		if !ok {
+			set = make(map[K]struct{})
+			c.data[it] = set
+		}
+		set[key] = struct{}{}
+	}
+}
+
+func (c *ramIndex[K, V]) remove(key K, value V) {
+	for _, it := range c.keys(value) {
+		if set, ok := c.data[it]; ok {
+			delete(set, key)
+			if len(set) == 0 {
+				delete(c.data, it)
+			}
+		}
+	}
 }
 
 func NewRam[K comparable, V any](ctx context.Context) Store[K, V] {
 	var r = &ram[K, V]{
-		data:   make(map[K]V),
-		timers: make(map[K]*time.Timer),
+		data:    make(map[K]V),
+		timers:  make(map[K]*time.Timer),
+		indexes: make(map[string]*ramIndex[K, V]),
 	}
 	go r.timersStop(ctx)
 
@@ -28,13 +58,32 @@ func NewRam[K comparable, V any](ctx context.Context) Store[K, V] {
 
 func (c *ram[K, V]) Store(key K, value V) {
 	c.lock.Lock()
+	c.unindex(key)
 	c.data[key] = value
+	for _, idx := range c.indexes {
+		idx.add(key, value)
+	}
 	c.lock.Unlock()
 }
 
+// unindex удаляет значение key из индексов, вызывается под lock
+func (c *ram[K, V]) unindex(key K) {
+	if prev, ok := c.data[key]; ok {
+		for _, idx := range c.indexes {
+			idx.remove(key, prev)
+		}
+	}
+}
+
 func (c *ram[K, V]) Delete(key K) {
 	c.lock.Lock()
+	c.unindex(key)
 	delete(c.data, key)
+	// таймер удаления не должен сработать для нового значения с тем же ключом
+	if timer, ok := c.timers[key]; ok {
+		timer.Stop()
+		delete(c.timers, key)
+	}
 	c.lock.Unlock()
 }
 
@@ -81,6 +130,9 @@ func (c *ram[K, V]) timersStop(ctx context.Context) {
 	}
 	c.data = make(map[K]V)
 	c.timers = make(map[K]*time.Timer)
+	for _, idx := range c.indexes {
+		idx.data = make(map[string]map[K]struct{})
+	}
 	c.lock.Unlock()
 
 }
@@ -90,8 +142,73 @@ func (c *ram[K, V]) handler(key K) {
 	c.lock.Lock()
 	var _, ok = c.data[key]
 	if ok {
+		c.unindex(key)
 		delete(c.data, key)
 		delete(c.timers, key)
 	}
 	c.lock.Unlock()
 }
+
+func (c *ram[K, V]) Index(name string, keys func(value V) []string) {
+	var idx = &ramIndex[K, V]{keys: keys, data: make(map[string]map[K]struct{})}
+	c.lock.Lock()
+	for key, value := range c.data {
+		idx.add(key, value)
+	}
+	c.indexes[name] = idx
+	c.lock.Unlock()
+}
+
+func (c *ram[K, V]) Query(q Query[K, V]) Result[V] {
+	var res Result[V]
+	var values []V
+	var check = func(key K, value V) {
+		if q.Filter != nil && !q.Filter(key, value) {
+			return
+		}
+		res.Total++
+		if q.After == nil || q.After(value) {
+			values = append(values, value)
+		}
+	}
+
+	c.lock.RLock()
+	if idx, ok := c.indexes[q.Index]; ok {
+		// значение с несколькими ключами индекса проверяется один раз
+		var seen = make(map[K]struct{})
+		for _, it := range q.IndexKeys {
+			for key := range idx.data[it] {
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				check(key, c.data[key])
+			}
+		}
+	} else if len(q.Index) == 0 {
+		for key, value := range c.data {
+			check(key, value)
+		}
+	} else {
+		log.Error("Unknown store index %s", q.Index)
+	}
+	c.lock.RUnlock()
+
+	if q.Less != nil {
+		slices.SortFunc(values, func(a, b V) int {
+			if q.Less(a, b) {
+				return -1
+			}
+			if q.Less(b, a) {
+				return 1
+			}
+			return 0
+		})
+	}
+	if q.Limit > 0 && len(values) > q.Limit {
+		values = values[:q.Limit]
+		res.More = true
+	}
+	res.Values = values
+	return res
+}
@@ -121,3 +121,40 @@ func TestTimeout(t *testing.T) {
 		return true
 	})
 }
+
+func TestQuery(t *testing.T) {
+	var ctx, cf = context.WithCancel(context.TODO())
+	defer cf()
+	var r = NewRam[int, int](ctx)
+	for idx := range 10 {
+		r.Store(idx, idx)
+	}
+	r.Index("parity", func(value int) []string {
+		if value%2 == 0 {
+			return []string{"even"}
+		}
+		return []string{"odd"}
+	})
+	r.Store(10, 10)
+	r.Delete(4)
+
+	var less = func(a, b int) bool { return a < b }
+	var res = r.Query(Query[int, int]{Index: "parity", IndexKeys: []string{"even"}, Less: less, Limit: 3})
+	if fmt.Sprint(res.Values) != "[0 2 6]" || res.Total != 5 || !res.More {
+		t.Fatalf("even %+v", res)
+	}
+	res = r.Query(Query[int, int]{Index: "parity", IndexKeys: []string{"even"}, Less: less, Limit: 3,
+		After: func(value int) bool { return value > 6 }})
+	if fmt.Sprint(res.Values) != "[8 10]" || res.Total != 5 || res.More {
+		t.Fatalf("even after 6 %+v", res)
+	}
+	res = r.Query(Query[int, int]{Index: "parity", IndexKeys: []string{"even", "odd"},
+		Filter: func(key, value int) bool { return value > 5 }, Less: less})
+	if fmt.Sprint(res.Values) != "[6 7 8 9 10]" || res.Total != 5 {
+		t.Fatalf("filter %+v", res)
+	}
+	res = r.Query(Query[int, int]{Less: func(a, b int) bool { return a > b }, Limit: 2})
+	if fmt.Sprint(res.Values) != "[10 9]" || res.Total != 10 {
+		t.Fatalf("all %+v", res)
+	}
+}
@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"context"
+	"slices"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// ErrQueueFull в очереди нет места для задания или всех заданий пакета
+var ErrQueueFull = errors.New("В очереди нет места для новых заданий")
+
+// TaskFilter отбор заданий для массовых операций, пустые поля не учитываются
+type TaskFilter struct {
+	IDs     []string
+	States  []StateCode
+	ErrKind string
+}
+
+// IsEmpty фильтр не задан и подходит всем заданиям
+func (c *TaskFilter) IsEmpty() bool {
+	return len(c.IDs) == 0 && len(c.States) == 0 && len(c.ErrKind) == 0
+}
+
+func (c *TaskFilter) match(task *Task) bool {
+	if len(c.IDs) > 0 && !slices.Contains(c.IDs, task.ID) {
+		return false
+	}
+	if len(c.States) > 0 && !slices.Contains(c.States, task.GetState()) {
+		return false
+	}
+	return len(c.ErrKind) == 0 || c.ErrKind == task.GetErrKind()
+}
+
+// ExecBatch ставит задания в очередь одной операцией без ожидания: если места в очереди
+// на все задания нет, то ни одно задание не добавляется и возвращается ErrQueueFull
+func (c *Worker) ExecBatch(tasks []*Task) error {
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	if c.queueRoom() < len(tasks) {
+		return ErrQueueFull
+	}
+	for _, t := range tasks {
+		c.enqueue(t)
+	}
+	return nil
+}
+
+// Discard удаляет файлы задания, которое не попало в очередь (например, копии Clone)
+func (c *Worker) Discard(t *Task) {
+	clearFolders(t)
+}
+
+// DeleteTasks отменяет подходящие под фильтр незавершенные задания и убирает из агента
+// завершенные и упавшие. Файлы убранных заданий удаляются по истечении их времени хранения.
+func (c *Worker) DeleteTasks(filter TaskFilter) (canceled, deleted []string) {
+	var tasks []*Task
+	c.store.Range(func(key string, task *Task) bool {
+		if filter.match(task) {
+			tasks = append(tasks, task)
+		}
+		return true
+	})
+
+	for _, task := range tasks {
+		switch task.GetState() {
+		case FINISH, ERROR:
+			c.store.Delete(task.ID)
+			deleted = append(deleted, task.ID)
+		default:
+			if !c.closeUploads(task, context.Canceled) {
+				c.stopProc(task.ID, task)
+			}
+			canceled = append(canceled, task.ID)
+		}
+	}
+	log.Info("Tasks canceled %d, deleted %d", len(canceled), len(deleted))
+	return canceled, deleted
+}
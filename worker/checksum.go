@@ -0,0 +1,142 @@
+package worker
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// ChecksumOptions контрольные суммы результатов. sha256 считается всегда.
+type ChecksumOptions struct {
+	// Md5 дополнительно считать md5
+	Md5 bool `json:"md5,omitempty"`
+	// Sidecar писать рядом с каждым результатом файл <name>.sha256 в формате sha256sum
+	Sidecar bool `json:"sidecar,omitempty"`
+	// Manifest писать JSON манифест <task_id>_manifest.json со списком результатов
+	Manifest bool `json:"manifest,omitempty"`
+}
+
+// Manifest содержимое JSON манифеста результатов
+type Manifest struct {
+	TaskID string     `json:"task_id"`
+	Files  []*OutFile `json:"files"`
+}
+
+// checksumOutputs считает размер и контрольные суммы результатов,
+// при необходимости пишет файлы .sha256 и манифест и добавляет их в результаты.
+func checksumOutputs(ctx context.Context, task *Task) error {
+	var outputs = task.Outputs
+	for _, out := range outputs {
+		if err := fillChecksums(ctx, task, out); err != nil {
+			return errors.Errorf("checksum Task %s err %+v filePath %s", task.ID, err, out.Path)
+		}
+	}
+
+	// файлы с суммами добавляются в результаты до записи, чтобы удалить их и при ошибке
+	if task.Checksum.Sidecar {
+		for _, out := range outputs {
+			var sidecar = &OutFile{Name: out.Name + ".sha256", Path: out.Path + ".sha256"}
+			task.update(func() { task.Outputs = append(task.Outputs, sidecar) })
+			var line = fmt.Sprintf("%s *%s\n", out.Sha256, path.Base(out.Name))
+			if err := replaceFile(sidecar.Path, []byte(line)); err != nil {
+				return err
+			}
+		}
+	}
+	if task.Checksum.Manifest {
+		buffer, err := json.MarshalIndent(&Manifest{TaskID: task.ID, Files: outputs}, "", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var name = task.ID + "_manifest.json"
+		var manifest = &OutFile{Name: name, Path: filepath.Join(task.GetOutDir(), name)}
+		task.update(func() { task.Outputs = append(task.Outputs, manifest) })
+		if err = replaceFile(manifest.Path, buffer); err != nil {
+			return err
+		}
+	}
+
+	for _, out := range task.Outputs[len(outputs):] {
+		if err := fillChecksums(ctx, task, out); err != nil {
+			return errors.Errorf("checksum Task %s err %+v filePath %s", task.ID, err, out.Path)
+		}
+	}
+
+	log.Debug("Task %s checksums calculated, outputs %d\n", task.ID, len(task.Outputs))
+	return nil
+}
+
+// isChecksumFile out файл .sha256 или манифест, которые пишет checksumOutputs
+func isChecksumFile(task *Task, out *OutFile) bool {
+	return (task.Checksum.Sidecar && strings.HasSuffix(out.Name, ".sha256")) ||
+		(task.Checksum.Manifest && out.Name == task.ID+"_manifest.json")
+}
+
+// replaceFile записывает файл через временный файл и переименование, чтобы не менять
+// данные по жесткой ссылке, если на месте filePath уже есть файл
+func replaceFile(filePath string, data []byte) error {
+	if err := os.WriteFile(filePath+".tmp", data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(filePath+".tmp", filePath))
+}
+
+// fillChecksums заполняет размер, sha256 и, если нужно, md5 результата out задания.
+// Суммы считаются без блокировки, а записываются под stateLock, как и другие выдаваемые поля задания
+func fillChecksums(ctx context.Context, task *Task, out *OutFile) error {
+	var withMd5 = task.Checksum.Md5
+	var hashes = []hash.Hash{sha256.New()}
+	if withMd5 {
+		hashes = append(hashes, md5.New())
+	}
+	size, err := hashFile(ctx, out.Path, hashes...)
+	if err != nil {
+		return err
+	}
+
+	task.update(func() {
+		out.Size = size
+		out.Sha256 = hex.EncodeToString(hashes[0].Sum(nil))
+		if withMd5 {
+			out.Md5 = hex.EncodeToString(hashes[1].Sum(nil))
+		}
+	})
+	return nil
+}
+
+// fileCrc32 crc32 (IEEE) файла в hex, для серверов с XCRC
+func fileCrc32(ctx context.Context, filePath string) (string, error) {
+	var h = crc32.NewIEEE()
+	if _, err := hashFile(ctx, filePath, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(ctx context.Context, filePath string, hashes ...hash.Hash) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	var writers = make([]io.Writer, len(hashes))
+	for idx, h := range hashes {
+		writers[idx] = h
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), &ctxReader{ctx: ctx, r: file})
+	return size, errors.WithStack(err)
+}
@@ -0,0 +1,53 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumOutputs(t *testing.T) {
+	var outDir = t.TempDir()
+	var outPath = filepath.Join(outDir, "777_0.mp4")
+	if err := os.WriteFile(outPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var task = &Task{
+		ID:       "777",
+		OutDir:   outDir,
+		OutExt:   ".mp4",
+		Outputs:  []*OutFile{{Name: "777_0.mp4", Path: outPath}},
+		Checksum: ChecksumOptions{Md5: true, Sidecar: true, Manifest: true},
+	}
+	var stop = marshalLoop(task)
+	if err := checksumOutputs(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	const sha = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	var out = task.Outputs[0]
+	if out.Size != 5 || out.Sha256 != sha || out.Md5 != "5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("out %+v", out)
+	}
+	if len(task.Outputs) != 3 || task.Outputs[1].Name != "777_0.mp4.sha256" || task.Outputs[2].Name != "777_manifest.json" {
+		t.Fatalf("outputs %+v %+v", task.Outputs[1], task.Outputs[2])
+	}
+	if buffer, _ := os.ReadFile(task.Outputs[1].Path); string(buffer) != sha+" *777_0.mp4\n" {
+		t.Errorf("sidecar %q", buffer)
+	}
+
+	var manifest Manifest
+	buffer, _ := os.ReadFile(filepath.Join(outDir, "777_manifest.json"))
+	if err := json.Unmarshal(buffer, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.TaskID != "777" || len(manifest.Files) != 1 || manifest.Files[0].Sha256 != sha {
+		t.Errorf("manifest %s", buffer)
+	}
+	if len(task.Outputs[2].Sha256) == 0 {
+		t.Error("manifest checksum not filled")
+	}
+}
@@ -0,0 +1,236 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// drainTimeout сколько задания завершаются при остановке агента, если drain_timeout не задан
+const drainTimeout = time.Minute
+
+// drainInterval как часто проверяется завершение заданий при остановке
+var drainInterval = 500 * time.Millisecond
+
+// DrainState ход остановки агента с завершением заданий
+type DrainState struct {
+	// Draining агент останавливается, новые задания не принимаются
+	Draining bool `json:"draining"`
+	// Done остановка завершена, оставшиеся задания сохранены
+	Done     bool      `json:"done"`
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Queued задания в очереди, на паузе и в ожидании загрузки файлов. Задания, которые ждут
+	// загрузки файлов, остановка не ждет
+	Queued int `json:"queued"`
+	// Running выполняющиеся задания
+	Running int `json:"running"`
+	// Persisted задания, сохраненные для запуска после перезапуска
+	Persisted []string `json:"persisted,omitempty"`
+}
+
+// DrainedTask задание, сохраненное при остановке агента
+type DrainedTask struct {
+	// ID ключ задания, сохраняется для копий и заданий с Idempotency-Key
+	ID      string          `json:"id"`
+	Request json.RawMessage `json:"request"`
+}
+
+// drainGate остановка агента с завершением заданий
+type drainGate struct {
+	lock  sync.Mutex
+	state DrainState
+	// done закрывается после остановки
+	done chan struct{}
+}
+
+// DrainTimeout сколько задания завершаются при остановке агента
+func DrainTimeout() time.Duration {
+	var sec = config.Load().DrainTimeout
+	if sec == 0 {
+		return drainTimeout
+	}
+	// отрицательное значение - задания сохраняются сразу
+	return max(time.Duration(sec)*time.Second, 0)
+}
+
+// drainFile файл сохраненных при остановке заданий
+func drainFile() (string, error) {
+	if fileName := config.Load().DrainFile; len(fileName) > 0 {
+		return fileName, nil
+	}
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(filepath.Dir(execPath), "drain.json"), nil
+}
+
+// Drain начинает остановку агента: новые задания не принимаются, задания в очереди и в работе
+// завершаются до timeout, оставшиеся сохраняются для перезапуска, затем Worker останавливается.
+// Повторный вызов возвращает канал уже начатой остановки, закрывается после ее завершения.
+func (c *Worker) Drain(timeout time.Duration) <-chan struct{} {
+	c.drain.lock.Lock()
+	defer c.drain.lock.Unlock()
+	if c.drain.state.Draining {
+		return c.drain.done
+	}
+	c.drain.state = DrainState{Draining: true, Deadline: time.Now().Add(timeout)}
+	log.Info("Drain started, deadline %s", timeout)
+	// задания из очереди должны завершиться и на паузе агента
+	c.ResumeQueue()
+	go c.runDrain()
+	return c.drain.done
+}
+
+// Drained канал, который закрывается после остановки агента, как бы она ни была начата
+func (c *Worker) Drained() <-chan struct{} {
+	return c.drain.done
+}
+
+// DrainNow завершает начатую остановку без ожидания заданий: оставшиеся задания сохраняются сразу
+func (c *Worker) DrainNow() {
+	c.drain.lock.Lock()
+	defer c.drain.lock.Unlock()
+	if c.drain.state.Draining && !c.drain.state.Done && time.Now().Before(c.drain.state.Deadline) {
+		c.drain.state.Deadline = time.Now()
+		log.Info("Drain deadline is cut, tasks are persisted now")
+	}
+}
+
+// IsDraining агент останавливается
+func (c *Worker) IsDraining() bool {
+	c.drain.lock.Lock()
+	defer c.drain.lock.Unlock()
+	return c.drain.state.Draining
+}
+
+// DrainStatus ход остановки агента
+func (c *Worker) DrainStatus() DrainState {
+	c.drain.lock.Lock()
+	defer c.drain.lock.Unlock()
+	return c.drain.state
+}
+
+func (c *Worker) runDrain() {
+	defer close(c.drain.done)
+	for {
+		var queued, uploading, running = c.activeTasks()
+		c.drain.lock.Lock()
+		c.drain.state.Queued, c.drain.state.Running = len(queued)+len(uploading), len(running)
+		// срок сокращается в DrainNow
+		var deadline = c.drain.state.Deadline
+		c.drain.lock.Unlock()
+		// загрузка файлов может не начаться до срока, поэтому такие задания не ждутся
+		if len(queued)+len(running) == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(drainInterval)
+	}
+
+	var queued, uploading, running = c.activeTasks()
+	var persisted, err = persistTasks(slices.Concat(queued, uploading, running))
+	if err != nil {
+		log.Error("Drain persist error: %+v", err)
+	}
+	// загруженные файлы удаляются, после перезапуска задания снова ждут загрузки
+	for _, task := range uploading {
+		c.closeUploads(task, context.Canceled)
+	}
+	c.Stop()
+
+	c.drain.lock.Lock()
+	c.drain.state.Done = true
+	c.drain.state.Persisted = persisted
+	c.drain.lock.Unlock()
+	log.Info("Drain finished, persisted %d tasks", len(persisted))
+}
+
+// activeTasks незавершенные задания: в очереди (CREATE, PAUSED), в ожидании загрузки файлов
+// и выполняющиеся. Состояния читаются после обхода store, не под его блокировкой
+func (c *Worker) activeTasks() (queued, uploading, running []*Task) {
+	var tasks []*Task
+	c.store.Range(func(key string, task *Task) bool {
+		tasks = append(tasks, task)
+		return true
+	})
+	for _, task := range tasks {
+		switch task.GetState() {
+		case FINISH, ERROR, CANCEL:
+		case CREATE, PAUSED:
+			if task.waitsUploads() {
+				uploading = append(uploading, task)
+			} else {
+				queued = append(queued, task)
+			}
+		default:
+			running = append(running, task)
+		}
+	}
+	return queued, uploading, running
+}
+
+// persistTasks сохраняет запросы заданий в drainFile. Загруженные в агент файлы удаляются
+// при остановке, поэтому задания с uploads после перезапуска снова ждут загрузки всех файлов.
+func persistTasks(tasks []*Task) ([]string, error) {
+	var ids []string
+	var requests []DrainedTask
+	for _, task := range tasks {
+		if len(task.Request) == 0 {
+			log.Info("Task %s is not persisted on drain", task.ID)
+			continue
+		}
+		ids = append(ids, task.ID)
+		requests = append(requests, DrainedTask{ID: task.ID, Request: task.Request})
+	}
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	fileName, err := drainFile()
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := json.Marshal(requests)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// через временный файл, чтобы при сбое не остался обрезанный список
+	if err = os.WriteFile(fileName+".tmp", buffer, 0600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = os.Rename(fileName+".tmp", fileName); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ids, nil
+}
+
+// LoadDrained читает и удаляет задания, сохраненные при прошлой остановке
+func LoadDrained() ([]DrainedTask, error) {
+	fileName, err := drainFile()
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var requests []DrainedTask
+	if err = json.Unmarshal(buffer, &requests); err != nil {
+		return nil, errors.WithMessagef(err, "drain file %s", fileName)
+	}
+	if err = os.Remove(fileName); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return requests, nil
+}
@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/store"
+)
+
+func TestWorkerDrain(t *testing.T) {
+	var drainFile = filepath.Join(t.TempDir(), "drain.json")
+	config.InitFromJson(strings.NewReader(`{"worker_count":1,"worker_queue":10,"stop_grace":1,"drain_file":"` + filepath.ToSlash(drainFile) + `"}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+
+	var w, sh = runWorker(t)
+	var outDir = t.TempDir()
+	var newTask = func(id, script string) *Task {
+		var task = shTask(t, sh, id, outDir, script)
+		task.Request = []byte(`{"id":"` + id + `"}`)
+		return task
+	}
+
+	// один воркер: первое задание успевает завершиться, второе прерывается, третье не запускается
+	var short, long, queued = newTask("301", "sleep 0.2; cp {input} {output}"), newTask("302", "sleep 10"), newTask("303", "cp {input} {output}")
+	w.ExecTask(short)
+	w.ExecTask(long)
+	w.ExecTask(queued)
+
+	var done = w.Drain(1500 * time.Millisecond)
+	if !w.IsDraining() {
+		t.Fatal("worker is not draining")
+	}
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("drain is not finished")
+	}
+
+	var state = w.DrainStatus()
+	slices.Sort(state.Persisted)
+	if !state.Done || !slices.Equal(state.Persisted, []string{"302", "303"}) {
+		t.Fatalf("drain state %+v", state)
+	}
+	if short.GetState() != FINISH || long.GetState() != ERROR || long.GetErrKind() != ErrKindCancel {
+		t.Errorf("states %s %s %s", short.GetState(), long.GetState(), long.GetErrKind())
+	}
+
+	requests, err := LoadDrained()
+	if err != nil || len(requests) != 2 {
+		t.Fatalf("drained %d err %v", len(requests), err)
+	}
+	if _, err = os.Stat(drainFile); !os.IsNotExist(err) {
+		t.Errorf("drain file is not removed: %v", err)
+	}
+	if requests, err = LoadDrained(); err != nil || requests != nil {
+		t.Errorf("second load %v err %v", requests, err)
+	}
+}
+
+func TestWorkerBacklog(t *testing.T) {
+	config.InitFromJson(strings.NewReader(`{"worker_count":1,"worker_queue":1}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+
+	var w, sh = runWorker(t)
+	w.PauseQueue()
+	var outDir = t.TempDir()
+	var tasks []*Task
+	for _, id := range []string{"311", "312", "313"} {
+		var task = shTask(t, sh, id, outDir, "cp {input} {output}")
+		w.ExecTaskLater(task)
+		tasks = append(tasks, task)
+	}
+	// задания ждут места в очереди в агенте, новые задания не обгоняют их
+	if _, ok := w.store.Load("313"); !ok || tasks[2].GetState() != CREATE {
+		t.Fatal("backlog task is not stored")
+	}
+	if err := w.ExecTask(shTask(t, sh, "314", outDir, "true")); err != ErrQueueFull {
+		t.Fatalf("exec with backlog err %v", err)
+	}
+
+	w.ResumeQueue()
+	for _, task := range tasks {
+		waitState(t, task, FINISH)
+	}
+}
+
+// TestWorkerStateStoreLocks смена состояния не блокирует обход store, который читает состояния заданий
+func TestWorkerStateStoreLocks(t *testing.T) {
+	var w = New(store.NewRam[string, *Task](context.Background()))
+	for i := range 10 {
+		var task = &Task{ID: strconv.Itoa(i), pause: newPauseGate()}
+		w.store.Store(task.ID, task)
+	}
+
+	var stop = time.Now().Add(time.Second)
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for time.Now().Before(stop) {
+			w.activeTasks()
+		}
+	}()
+	go func() {
+		for i := 0; time.Now().Before(stop); i++ {
+			var id = strconv.Itoa(i % 10)
+			if i%2 == 0 {
+				w.setState(id, FINISH)
+			} else {
+				w.fail(id, ErrKindCancel, context.Canceled)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("activeTasks is locked")
+	}
+}
+
+func TestWorkerDrainNow(t *testing.T) {
+	var drainFile = filepath.Join(t.TempDir(), "drain.json")
+	config.InitFromJson(strings.NewReader(`{"worker_count":1,"worker_queue":10,"stop_grace":1,"drain_file":"` + filepath.ToSlash(drainFile) + `"}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+	drainInterval = 20 * time.Millisecond
+	defer func() { drainInterval = 500 * time.Millisecond }()
+
+	var w, sh = runWorker(t)
+	var long = shTask(t, sh, "304", t.TempDir(), "sleep 10")
+	long.Request = []byte(`{"id":"304"}`)
+	w.ExecTask(long)
+	waitState(t, long, PROCESS)
+
+	// задание, которое ждет загрузки файлов, остановка не ждет, а сохраняет
+	var upload = &Task{ID: "305", InDir: t.TempDir(), Request: []byte(`{"id":"305"}`)}
+	upload.AddUploads([]string{"a.mp4", "b.mp4"})
+	w.WaitUploads(upload, time.Hour)
+	if _, err := w.Upload(context.Background(), "305", "a.mp4", strings.NewReader("aaa"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var done = w.Drain(time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if state := w.DrainStatus(); state.Done || state.Queued != 1 || state.Running != 1 {
+		t.Fatalf("drain state %+v", state)
+	}
+	// повторный сигнал остановки: выполняющиеся задания не ждутся
+	w.DrainNow()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("drain is not finished")
+	}
+	select {
+	case <-w.Drained():
+	default:
+		t.Error("drained is not closed")
+	}
+
+	var state = w.DrainStatus()
+	slices.Sort(state.Persisted)
+	if !slices.Equal(state.Persisted, []string{"304", "305"}) {
+		t.Errorf("persisted %v", state.Persisted)
+	}
+	if _, err := os.Stat(filepath.Join(upload.InDir, upload.Files[0])); !os.IsNotExist(err) {
+		t.Errorf("uploaded file is not removed: %v", err)
+	}
+	requests, err := LoadDrained()
+	if err != nil || len(requests) != 2 {
+		t.Errorf("drained %d err %v", len(requests), err)
+	}
+}
@@ -0,0 +1,226 @@
+package worker
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+// Fetcher скачивает входящий файл задания по ссылке.
+// Реализации регистрируются по схеме ссылки через RegisterFetcher.
+type Fetcher interface {
+	// Fetch сохраняет содержимое src в локальный файл dst
+	Fetch(ctx context.Context, task *Task, src *url.URL, dst string) error
+}
+
+// Expander раскрывает ссылку с шаблоном в список ссылок на файлы.
+// Используется в режиме InputModeFtpGlob.
+type Expander interface {
+	Expand(ctx context.Context, task *Task, src *url.URL) ([]*url.URL, error)
+}
+
+// UrlValidator проверяет ссылку при создании задания.
+// Если Fetcher его не реализует, то у ссылки должен быть задан хост.
+type UrlValidator interface {
+	ValidateUrl(src *url.URL) error
+}
+
+var fetchers = struct {
+	lock sync.RWMutex
+	data map[string]Fetcher
+}{data: make(map[string]Fetcher)}
+
+func init() {
+	RegisterFetcher("http", httpFetcher{})
+	RegisterFetcher("https", httpFetcher{})
+	RegisterFetcher("ftp", ftpFetcher{})
+	RegisterFetcher("ftps", ftpFetcher{})
+	RegisterFetcher("file", fileFetcher{})
+	RegisterFetcher("data", dataFetcher{})
+	RegisterFetcher("s3", s3Fetcher{})
+}
+
+// RegisterFetcher регистрирует Fetcher для схемы ссылки, заменяя существующий.
+func RegisterFetcher(scheme string, f Fetcher) {
+	fetchers.lock.Lock()
+	fetchers.data[strings.ToLower(scheme)] = f
+	fetchers.lock.Unlock()
+}
+
+func getFetcher(scheme string) (Fetcher, bool) {
+	fetchers.lock.RLock()
+	f, ok := fetchers.data[strings.ToLower(scheme)]
+	fetchers.lock.RUnlock()
+	return f, ok
+}
+
+// ValidateUrl проверяет, что ссылку можно скачать в заданном режиме.
+func ValidateUrl(rawURL string, mode InputMode) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return errors.Errorf("Некорректный URL: %s", rawURL)
+	}
+
+	f, ok := getFetcher(u.Scheme)
+	if !ok {
+		return errors.Errorf("Неподдерживаемая схема URL: %s", u.Redacted())
+	}
+	if v, ok := f.(UrlValidator); ok {
+		if err = v.ValidateUrl(u); err != nil {
+			return err
+		}
+	} else if u.Host == "" {
+		return errors.Errorf("Некорректный URL: %s", u.Redacted())
+	}
+
+	if mode == InputModeFtpGlob {
+		if _, ok = f.(Expander); !ok {
+			return errors.Errorf("Режим %s не поддерживается для схемы %s: %s", mode, u.Scheme, u.Redacted())
+		}
+	}
+	return nil
+}
+
+// RedactUrls ссылки со скрытыми паролями, ссылки с ошибкой разбора остаются как есть
+func RedactUrls(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	var res = make([]string, len(urls))
+	for i, rawURL := range urls {
+		res[i] = rawURL
+		if u, err := url.Parse(rawURL); err == nil {
+			res[i] = u.Redacted()
+		}
+	}
+	return res
+}
+
+// httpFetcher скачивание по http и https
+type httpFetcher struct{}
+
+func (httpFetcher) Fetch(ctx context.Context, task *Task, src *url.URL, dst string) error {
+	// 1. Get the data from the URL
+	var req, err = http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Ensure the response body is closed after the function returns
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("http status %s", resp.Status)
+	}
+
+	// 2. Create the local file
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Ensure the file is closed after the function returns
+	defer out.Close()
+
+	_, err = io.Copy(out, &ctxReader{ctx: ctx, r: resp.Body})
+	return errors.WithStack(err)
+}
+
+// ftpFetcher скачивание по ftp и ftps с докачкой после обрыва
+type ftpFetcher struct{}
+
+func (ftpFetcher) ValidateUrl(src *url.URL) error {
+	if src.Host == "" || len(src.Path) == 0 {
+		return errors.Errorf("Некорректный URL: %s", src.Redacted())
+	}
+	if _, err := path.Match(src.Path, ""); err != nil {
+		return errors.Errorf("Некорректный шаблон пути: %s", src.Redacted())
+	}
+	return nil
+}
+
+func (ftpFetcher) Fetch(ctx context.Context, task *Task, src *url.URL, dst string) error {
+	var fc = &ftpConn{taskID: task.ID, cfg: ftpFromURL(src)}
+	defer fc.close()
+	return fc.retrieve(ctx, src.Path, dst)
+}
+
+func (ftpFetcher) Expand(ctx context.Context, task *Task, src *url.URL) ([]*url.URL, error) {
+	var fc = &ftpConn{taskID: task.ID, cfg: ftpFromURL(src)}
+	defer fc.close()
+
+	var matches []string
+	var err = fc.retry(ctx, "glob "+src.Path, func(bool) (err error) {
+		matches, err = fc.glob(src.Path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res = make([]*url.URL, 0, len(matches))
+	for _, it := range matches {
+		var u = *src
+		u.Path = it
+		u.RawPath = ""
+		res = append(res, &u)
+	}
+	return res, nil
+}
+
+// dataFetcher сохраняет содержимое data: ссылки (RFC 2397)
+//
+//	data:text/plain;base64,SGVsbG8=
+//	data:,Hello%20world
+type dataFetcher struct{}
+
+func (dataFetcher) ValidateUrl(src *url.URL) error {
+	if _, err := decodeDataUrl(src); err != nil {
+		return errors.Errorf("Некорректный data URL: %s", err)
+	}
+	return nil
+}
+
+func (dataFetcher) Fetch(ctx context.Context, task *Task, src *url.URL, dst string) error {
+	buffer, err := decodeDataUrl(src)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.WriteFile(dst, buffer, 0644))
+}
+
+func decodeDataUrl(src *url.URL) ([]byte, error) {
+	var raw = src.Opaque
+	if len(src.RawQuery) > 0 {
+		raw += "?" + src.RawQuery
+	}
+
+	meta, data, ok := strings.Cut(raw, ",")
+	if !ok {
+		return nil, errors.New("нет разделителя ','")
+	}
+	data, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		return []byte(data), nil
+	}
+
+	buffer, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		// допускаем base64 без выравнивания
+		buffer, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+	}
+	return buffer, errors.WithStack(err)
+}
@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// fileFetcher забирает локальный или сетевой (UNC) файл.
+// Файл связывается жесткой ссылкой в InDir, если это невозможно - копируется.
+//
+//	file:///C:/data/in.mp4 -> C:\data\in.mp4
+//	file://server/share/in.mp4 -> \\server\share\in.mp4
+//	file:///data/in.mp4 -> /data/in.mp4
+type fileFetcher struct{}
+
+func (fileFetcher) ValidateUrl(src *url.URL) error {
+	var filePath, err = filePathFromUrl(src)
+	if err != nil {
+		return err
+	}
+	if !config.Load().IsFileAllowed(filePath) {
+		return errors.Errorf("Путь не входит в разрешенные file_roots: %s", filePath)
+	}
+	return nil
+}
+
+func (fileFetcher) Fetch(ctx context.Context, task *Task, src *url.URL, dst string) error {
+	var filePath, err = filePathFromUrl(src)
+	if err != nil {
+		return err
+	}
+	// ссылка могла измениться после создания задания, проверяем и открываем уже раскрытый путь
+	filePath = config.RealPath(filePath)
+	if !config.Load().IsFileAllowed(filePath) {
+		return errors.Errorf("Путь не входит в разрешенные file_roots: %s", filePath)
+	}
+
+	if err = os.Link(filePath, dst); err == nil {
+		return nil
+	}
+	log.Debug("Task %s os.Link %s err %+v, copy file\n", task.ID, filePath, err)
+
+	in, err := os.Open(filePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, &ctxReader{ctx: ctx, r: in})
+	return errors.WithStack(err)
+}
+
+// filePathFromUrl переводит file:// ссылку в путь текущей ОС
+func filePathFromUrl(src *url.URL) (string, error) {
+	if len(src.Path) == 0 {
+		return "", errors.Errorf("Некорректный file URL: %s", src.Redacted())
+	}
+
+	var host = src.Host
+	if host == "localhost" {
+		host = ""
+	}
+
+	if runtime.GOOS != "windows" {
+		if len(host) > 0 {
+			return "", errors.Errorf("Сетевые пути не поддерживаются: %s", src.Redacted())
+		}
+		return filepath.Clean(src.Path), nil
+	}
+
+	if len(host) > 0 {
+		return `\\` + host + filepath.FromSlash(src.Path), nil
+	}
+	// /C:/data/in.mp4
+	return filepath.FromSlash(strings.TrimPrefix(src.Path, "/")), nil
+}
+
+// ctxReader прерывает чтение при отмене контекста
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(buffer []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	// на паузе задания передача ждет продолжения
+	if err := waitPause(c.ctx); err != nil {
+		return 0, err
+	}
+	return c.r.Read(buffer)
+}
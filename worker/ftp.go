@@ -0,0 +1,357 @@
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/ftp"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+const ftpAttempts = 5
+
+// ftpRetryDelay пауза перед повтором, растет с каждой попыткой
+var ftpRetryDelay = 5 * time.Second
+
+// ftpConn соединение с ftp сервером, которое пересоздается после обрыва.
+// Загрузка и скачивание продолжаются с места обрыва.
+type ftpConn struct {
+	taskID string
+	cfg    *Ftp
+	conn   *ftp.ServerConn
+	// dirs папки, созданные при загрузке (или уже существующие)
+	dirs map[string]bool
+}
+
+// ftpFromURL собирает настройки ftp из ftp:// или ftps:// ссылки.
+// Если логин не указан в ссылке, то берется профиль из конфига по адресу,
+// иначе используется anonymous.
+func ftpFromURL(u *url.URL) *Ftp {
+	var cfg = &Ftp{Tls: u.Scheme == "ftps"}
+	var port = u.Port()
+	if len(port) == 0 {
+		port = "21"
+		if cfg.Tls {
+			port = "990"
+		}
+	}
+	cfg.Addr = net.JoinHostPort(u.Hostname(), port)
+
+	if u.User != nil {
+		cfg.Login = u.User.Username()
+		cfg.Pass, _ = u.User.Password()
+		return cfg
+	}
+	if p, ok := config.Load().FindFtpProfile(cfg.Addr); ok {
+		cfg.Login = p.Login
+		cfg.Pass = p.Pass
+		return cfg
+	}
+
+	cfg.Login = "anonymous"
+	cfg.Pass = "anonymous"
+	return cfg
+}
+
+func (c *ftpConn) connect(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+
+	var opts = []ftp.DialOption{ftp.DialWithContext(ctx)}
+	if c.cfg.Tls {
+		host, _, _ := net.SplitHostPort(c.cfg.Addr)
+		opts = append(opts, ftp.DialWithTLS(&tls.Config{ServerName: host}))
+	}
+
+	ftpClient, err := ftp.Dial(c.cfg.Addr, opts...)
+	if err != nil {
+		return errors.Errorf("ftp.Dial Task %s err %+v Addr %s", c.taskID, err, c.cfg.Addr)
+	}
+
+	err = ftpClient.Login(c.cfg.Login, c.cfg.Pass)
+	if err != nil {
+		_ = ftpClient.Quit()
+		return errors.Errorf("ftpClient.Login Task %s err %+v Login %s", c.taskID, err, c.cfg.Login)
+	}
+
+	c.conn = ftpClient
+	return nil
+}
+
+func (c *ftpConn) close() {
+	if c.conn == nil {
+		return
+	}
+	if err := c.conn.Quit(); err != nil {
+		log.Error("ftpClient.Quit() err: %+v", err)
+	}
+	c.conn = nil
+}
+
+// retry повторяет fn до ftpAttempts раз, пересоздавая соединение между попытками.
+// В fn передается признак повторной попытки.
+func (c *ftpConn) retry(ctx context.Context, name string, fn func(resume bool) error) error {
+	var resume = false
+	for attempt := 1; ; attempt++ {
+		var err = c.connect(ctx)
+		if err == nil {
+			err = fn(resume)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= ftpAttempts {
+			return err
+		}
+
+		log.Error("Task %s ftp %s attempt %d/%d failed: %+v", c.taskID, name, attempt, ftpAttempts, err)
+		c.close()
+		resume = true
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * ftpRetryDelay):
+		}
+	}
+}
+
+// store загружает файл filePath под именем fileName.
+// При ошибке соединение пересоздается, размер уже загруженной части
+// запрашивается командой SIZE и загрузка продолжается с этого места.
+// Если сервер не поддерживает SIZE, то файл загружается заново и размер не сверяется.
+func (c *ftpConn) store(ctx context.Context, fileName, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.Errorf("os.Open Task %s err %+v filePath %s", c.taskID, err, filePath)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Errorf("file.Stat Task %s err %+v filePath %s", c.taskID, err, filePath)
+	}
+	var size = info.Size()
+
+	err = c.retry(ctx, "store "+fileName, func(resume bool) error {
+		return c.storAttempt(ctx, file, fileName, size, resume)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Task %s ftpStore successfully, filePath %s\n", c.taskID, filePath)
+	return nil
+}
+
+func (c *ftpConn) storAttempt(ctx context.Context, file *os.File, fileName string, size int64, resume bool) error {
+	c.makeDirs(path.Dir(fileName))
+
+	var offset int64
+	if resume {
+		// файла может не быть, если обрыв случился до начала передачи,
+		// без SIZE загрузка начинается заново
+		if remote, err := c.conn.FileSize(fileName); err == nil && remote <= size {
+			offset = remote
+		}
+	}
+
+	if offset < size || size == 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return errors.Errorf("file.Seek Task %s err %+v fileName %s offset %d", c.taskID, err, fileName, offset)
+		}
+		if offset > 0 {
+			log.Info("Task %s ftpStore resume fileName %s from %d/%d", c.taskID, fileName, offset, size)
+		}
+		if err := c.conn.StorFrom(fileName, &ctxReader{ctx: ctx, r: file}, uint64(offset)); err != nil {
+			return errors.Errorf("ftpClient.StorFrom Task %s err %+v fileName %s offset %d", c.taskID, err, fileName, offset)
+		}
+	}
+
+	remote, err := c.conn.FileSize(fileName)
+	if ftp.IsNotImplemented(err) {
+		log.Debug("Task %s ftp size check skipped, server has no SIZE, fileName %s\n", c.taskID, fileName)
+		return nil
+	}
+	if err != nil {
+		return errors.Errorf("ftpClient.FileSize Task %s err %+v fileName %s", c.taskID, err, fileName)
+	}
+	if remote != size {
+		return errors.Errorf("ftpStore Task %s fileName %s size mismatch: local %d remote %d", c.taskID, fileName, size, remote)
+	}
+
+	return nil
+}
+
+// makeDirs создает папку dir и ее родителей. Ошибки MKD не проверяются:
+// папка может уже существовать, а если ее нет, то ошибку вернет STOR.
+func (c *ftpConn) makeDirs(dir string) {
+	if dir == "." || dir == "/" || len(dir) == 0 || c.dirs[dir] {
+		return
+	}
+	c.makeDirs(path.Dir(dir))
+	if err := c.conn.MakeDir(dir); err != nil {
+		log.Debug("Task %s ftp MKD %s: %+v\n", c.taskID, dir, err)
+	}
+	if c.dirs == nil {
+		c.dirs = make(map[string]bool)
+	}
+	c.dirs[dir] = true
+}
+
+// glob возвращает пути файлов на сервере, подходящие под шаблон path.Match.
+// Метасимволы допускаются и в папках, например /in/*/src/*.mov
+func (c *ftpConn) glob(pattern string) ([]string, error) {
+	var segs = strings.Split(pattern, "/")
+	var first = slices.IndexFunc(segs, func(seg string) bool {
+		return strings.ContainsAny(seg, `*?[\`)
+	})
+	if first < 0 {
+		return []string{pattern}, nil
+	}
+
+	var root = strings.Join(segs[:first], "/")
+	if len(root) == 0 {
+		// шаблон в корне сервера, например /*.mov: обход "" дал бы относительные пути
+		root = "/"
+	}
+	var depth = len(segs) - 1
+	var res []string
+	var w = c.conn.Walk(root)
+	for w.Next() {
+		var p = w.Path()
+		switch w.Stat().Type {
+		case ftp.EntryTypeFolder:
+			// не спускаемся в папки, которые не подходят под шаблон
+			var d = strings.Count(p, "/")
+			if d >= depth {
+				w.SkipDir()
+			} else if ok, _ := path.Match(strings.Join(segs[:d+1], "/"), p); !ok {
+				w.SkipDir()
+			}
+		case ftp.EntryTypeFile:
+			if ok, _ := path.Match(pattern, p); ok {
+				res = append(res, p)
+			}
+		}
+	}
+
+	return res, w.Err()
+}
+
+// retrieve скачивает файл remotePath в filePath.
+// После обрыва скачивание продолжается с размера локального файла.
+func (c *ftpConn) retrieve(ctx context.Context, remotePath, filePath string) error {
+	out, err := os.Create(filePath)
+	if err != nil {
+		return errors.Errorf("os.Create Task %s err %+v filePath %s", c.taskID, err, filePath)
+	}
+	defer out.Close()
+
+	return c.retry(ctx, "retrieve "+remotePath, func(resume bool) error {
+		return c.retrAttempt(ctx, out, remotePath)
+	})
+}
+
+func (c *ftpConn) retrAttempt(ctx context.Context, out *os.File, remotePath string) error {
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Errorf("file.Seek Task %s err %+v remotePath %s", c.taskID, err, remotePath)
+	}
+
+	// SIZE поддерживается не всеми серверами, без него проверка размера пропускается
+	var size int64 = -1
+	if remote, err := c.conn.FileSize(remotePath); err == nil {
+		size = remote
+	}
+	if size >= 0 && offset == size {
+		return nil
+	}
+	if size >= 0 && offset > size {
+		if err = out.Truncate(0); err != nil {
+			return errors.Errorf("file.Truncate Task %s err %+v remotePath %s", c.taskID, err, remotePath)
+		}
+		if offset, err = out.Seek(0, io.SeekStart); err != nil {
+			return errors.Errorf("file.Seek Task %s err %+v remotePath %s", c.taskID, err, remotePath)
+		}
+	}
+	if offset > 0 {
+		log.Info("Task %s ftp retrieve resume %s from %d/%d", c.taskID, remotePath, offset, size)
+	}
+
+	resp, err := c.conn.RetrFrom(remotePath, uint64(offset))
+	if err != nil {
+		return errors.Errorf("ftpClient.RetrFrom Task %s err %+v remotePath %s offset %d", c.taskID, err, remotePath, offset)
+	}
+
+	// закрываем соединение данных при отмене, иначе io.Copy не прервется
+	var stop = context.AfterFunc(ctx, func() { _ = resp.SetDeadline(time.Now()) })
+	defer stop()
+
+	n, err := io.Copy(out, &ctxReader{ctx: ctx, r: resp})
+	if closeErr := resp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Errorf("ftp retrieve Task %s err %+v remotePath %s", c.taskID, err, remotePath)
+	}
+	if size >= 0 && offset+n != size {
+		return errors.Errorf("ftp retrieve Task %s remotePath %s size mismatch: local %d remote %d", c.taskID, remotePath, offset+n, size)
+	}
+
+	return nil
+}
+
+// verify сверяет контрольную сумму загруженного файла, если сервер умеет ее считать
+// (HASH, XSHA256, XMD5, XCRC). Если не умеет или суммы результата не посчитаны, то проверка пропускается.
+func (c *ftpConn) verify(ctx context.Context, fileName string, out *OutFile) error {
+	if len(out.Sha256) == 0 {
+		return nil
+	}
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+
+	var algos = c.conn.HashAlgorithms()
+	var algo, local string
+	switch {
+	case slices.Contains(algos, ftp.HashSHA256):
+		algo, local = ftp.HashSHA256, out.Sha256
+	case slices.Contains(algos, ftp.HashMD5) && len(out.Md5) > 0:
+		algo, local = ftp.HashMD5, out.Md5
+	case slices.Contains(algos, ftp.HashCRC32):
+		var err error
+		if local, err = fileCrc32(ctx, out.Path); err != nil {
+			return err
+		}
+		algo = ftp.HashCRC32
+	default:
+		log.Debug("Task %s ftp verify skipped, server has no hash commands, fileName %s\n", c.taskID, fileName)
+		return nil
+	}
+
+	remote, err := c.conn.Hash(fileName, algo)
+	if err != nil {
+		return errors.Errorf("ftpClient.Hash Task %s err %+v fileName %s algo %s", c.taskID, err, fileName, algo)
+	}
+	if remote != local {
+		return errors.Errorf("ftp verify Task %s fileName %s %s mismatch: local %s remote %s", c.taskID, fileName, algo, local, remote)
+	}
+
+	log.Debug("Task %s ftp verify successfully, fileName %s %s %s\n", c.taskID, fileName, algo, remote)
+	return nil
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/ftp/ftptest"
+)
+
+// newFtpServer ftp сервер в памяти, который останавливается после теста
+func newFtpServer(t *testing.T) *ftptest.Server {
+	var srv = ftptest.NewServer(true)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestFtpExpand(t *testing.T) {
+	var srv = newFtpServer(t)
+	for _, name := range []string{"/a.mov", "/b.mp4", "/in/c.mov", "/in/x/src/d.mov", "/in/y/src/e.mov", "/in/y/f.mov"} {
+		srv.Put(name, []byte(name))
+	}
+
+	var cases = map[string]string{
+		"/*.mov":         "/a.mov",
+		"/*/*.mov":       "/in/c.mov",
+		"/in/*/src/*":    "/in/x/src/d.mov,/in/y/src/e.mov",
+		"/in/[xy]/*.mov": "/in/y/f.mov",
+		"/in/c.mov":      "/in/c.mov",
+	}
+	for pattern, expected := range cases {
+		src, _ := url.Parse("ftp://user:pass@" + srv.Addr() + pattern)
+		srcs, err := ftpFetcher{}.Expand(context.Background(), &Task{ID: "glob"}, src)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		var paths []string
+		for _, it := range srcs {
+			if it.Host != src.Host || it.User.String() != "user:pass" {
+				t.Errorf("%s: url %s", pattern, it.Redacted())
+			}
+			paths = append(paths, it.Path)
+		}
+		if strings.Join(paths, ",") != expected {
+			t.Errorf("%s: %v", pattern, paths)
+		}
+	}
+}
+
+func TestFtpStoreDrop(t *testing.T) {
+	var delay = ftpRetryDelay
+	ftpRetryDelay = time.Millisecond
+	defer func() { ftpRetryDelay = delay }()
+
+	var filePath = filepath.Join(t.TempDir(), "a.bin")
+	var data = []byte("0123456789")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// с SIZE загрузка продолжается с места обрыва, без SIZE начинается заново
+	for _, noSize := range []bool{false, true} {
+		var srv = newFtpServer(t)
+		srv.NoSize = noSize
+		srv.DropStor = 2
+
+		var fc = &ftpConn{taskID: "stor", cfg: &Ftp{Addr: srv.Addr(), Login: "user", Pass: "pass"}}
+		if err := fc.store(context.Background(), "/out/a.bin", filePath); err != nil {
+			t.Fatalf("no size %v: %v", noSize, err)
+		}
+		fc.close()
+		if remote, _ := srv.File("/out/a.bin"); string(remote) != string(data) {
+			t.Errorf("no size %v: remote %q", noSize, remote)
+		}
+	}
+}
@@ -4,152 +4,137 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"os/exec"
+	"net/url"
+	"path"
 	"path/filepath"
-	"strings"
 
 	"mediamagi.ru/win-file-agent/errors"
-	"mediamagi.ru/win-file-agent/ftp"
 	"mediamagi.ru/win-file-agent/log"
 )
 
 type workerHandler func(ctx context.Context, task *Task) error
 
 func downloadFiles(ctx context.Context, task *Task) error {
-	for idx, urlStr := range task.Urls {
+	for _, urlStr := range task.Urls {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
 
-		var fileName = fmt.Sprintf("%s_%d", task.ID, idx)
-		// 1. Get the data from the URL
-		var req, err = http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+		u, err := url.Parse(urlStr)
 		if err != nil {
-			return errors.Errorf("fileName %s, urlStr %s, err %+v", fileName, urlStr, err)
+			return errors.Errorf("urlStr %s, err %+v", urlStr, err)
 		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return errors.Errorf("fileName %s, urlStr %s, err %+v", fileName, urlStr, err)
+		f, ok := getFetcher(u.Scheme)
+		if !ok {
+			return errors.Errorf("urlStr %s, unsupported scheme %s", u.Redacted(), u.Scheme)
 		}
-		// Ensure the response body is closed after the function returns
-		defer resp.Body.Close()
 
-		var filepath = filepath.Join(task.InDir, fileName)
-		// 2. Create the local file
-		out, err := os.Create(filepath)
-		if err != nil {
-			return errors.Errorf("fileName %s, urlStr %s, err %+v", fileName, urlStr, err)
+		var srcs = []*url.URL{u}
+		if task.InputMode == InputModeFtpGlob {
+			ex, ok := f.(Expander)
+			if !ok {
+				return errors.Errorf("urlStr %s, scheme %s does not support %s", u.Redacted(), u.Scheme, task.InputMode)
+			}
+			if srcs, err = ex.Expand(ctx, task, u); err != nil {
+				return errors.Errorf("urlStr %s, err %+v", u.Redacted(), err)
+			}
+			if len(srcs) == 0 {
+				return errors.Errorf("urlStr %s, нет файлов по шаблону", u.Redacted())
+			}
 		}
-		// Ensure the file is closed after the function returns
-		defer out.Close()
 
-		// фиксируем имя файла для удаления до самого копирования.
-		task.Files = append(task.Files, fileName)
-		_, err = io.Copy(out, resp.Body)
-		if err != nil {
-			return errors.Errorf("fileName %s, urlStr %s, err %+v", fileName, urlStr, err)
-		}
+		for _, src := range srcs {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			var fileName = task.nextFileName()
+			var filePath = filepath.Join(task.InDir, fileName)
+			// фиксируем имя файла для удаления до самого копирования.
+			task.addFile(fileName, sourceName(src))
+			if err = f.Fetch(ctx, task, src, filePath); err != nil {
+				return errors.Errorf("fileName %s, urlStr %s, err %+v", fileName, src.Redacted(), err)
+			}
 
-		log.Debug("Task %s url %s Downloaded file to %s\n", task.ID, urlStr, filepath)
+			log.Debug("Task %s url %s Downloaded file to %s\n", task.ID, src.Redacted(), filePath)
+		}
 	}
 	return nil
 }
 
+// sourceName исходное имя файла по ссылке, пустое если в пути нет имени
+func sourceName(u *url.URL) string {
+	var name = path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// executeTask выполняет команды задания, не дольше max_time лимитов
 func executeTask(ctx context.Context, task *Task) error {
-	for _, fileName := range task.Files {
+	return withMaxTime(ctx, task, func(ctx context.Context) error {
+		return runTask(ctx, task)
+	})
+}
+
+func runTask(ctx context.Context, task *Task) error {
+	if task.Workflow != nil {
+		return executeWorkflow(ctx, task)
+	}
+	if len(task.Steps) > 0 {
+		return executeSteps(ctx, task)
+	}
+
+	for fileIdx, fileName := range task.Files {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
 
-		var args = make([]string, len(task.Args))
-		for idx, it := range task.Args {
-			if strings.Contains(it, INPUT) {
-				it = strings.ReplaceAll(it, INPUT, filepath.Join(task.InDir, fileName))
+		var multiOut = task.IsMultiOut()
+		if multiOut {
+			if err := task.makeOutDir(task.GetOutDirPath(fileName)); err != nil {
+				return err
 			}
-			if strings.Contains(it, OUTPUT) {
-				it = strings.ReplaceAll(it, OUTPUT, task.GetOutPath(fileName))
-			}
-			args[idx] = it
+		}
+
+		args, err := renderArgs(task.Args, task.argVars(fileIdx), nil)
+		if err != nil {
+			return errors.Errorf("args %+v err %+v", task.Args, err)
 		}
 		fmt.Printf("args: %v\n", args)
 
+		// фиксируем результат до запуска, чтобы удалить его и при ошибке.
+		// Папка {output_dir} удаляется целиком, результаты собираются после завершения
+		if !multiOut {
+			task.addOutput(fileName)
+		}
+
 		// пример: ffmpeg -i input.mp4 -c:v libx264 -b:v 500k -c:a copy output.mp4
-		cmd := exec.CommandContext(ctx, task.Cmd, args...)
-		// настройка
 		var buffer = new(bytes.Buffer)
-		cmd.Stdout = os.Stdout
-		//cmd.Stderr = os.Stderr
-		cmd.Stderr = buffer
-		task.cmd = cmd
-
-		// запускаем
-		if err := cmd.Start(); err != nil {
-			return errors.Errorf("err (%s), cmdErr %s, cmd %s, args %+v", err, buffer, task.Cmd, args)
+		var spec = &cmdSpec{name: task.Cmd, args: args, stdin: task.Stdin, vars: task.argVars(fileIdx),
+			success: task.Success, outputs: []string{task.GetOutPath(fileName)}}
+		if multiOut {
+			spec.outputs = []string{task.GetOutDirPath(fileName)}
 		}
-		// ждём завершения
-		if err := cmd.Wait(); err != nil {
-			return errors.Errorf("err (%s), cmdErr %s, cmd %s, args %+v", err, buffer, task.Cmd, args)
+		if err = runCmd(ctx, task, spec, true, buffer); err != nil {
+			return wrapCmdErr(err, buffer, task.Cmd, args)
 		}
 
-		log.Debug("Task %s exec.Command successfully, cmd %+v, args %+v\n", task.ID, task.Cmd, args)
-	}
-
-	return nil
-}
-
-func ftpStore(ctx context.Context, task *Task) error {
-	if !task.saveToFtp {
-		return nil
-	}
-
-	ftpClient, err := ftp.Dial(task.ftp.Addr, ftp.DialWithContext(ctx))
-	if err != nil {
-		return errors.Errorf("ftp.Dial Task %s err %+v Addr %s", task.ID, err, task.ftp.Addr)
-	}
-	defer func() {
-		if err := ftpClient.Quit(); err != nil {
-			log.Error("ftpClient.Quit() err: %+v", err)
+		if multiOut {
+			if err = task.collectOutputs(fileName); err != nil {
+				return err
+			}
 		}
-	}()
 
-	err = ftpClient.Login(task.ftp.Login, task.ftp.Pass)
-	if err != nil {
-		return errors.Errorf("ftpClient.Login Task %s err %+v Login %s Pass %s", task.ID, err, task.ftp.Login, task.ftp.Pass)
+		log.Debug("Task %s exec.Command successfully, cmd %+v, args %+v\n", task.ID, task.Cmd, args)
 	}
 
-	for _, fileName := range task.Files {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		err = func() error {
-			var filePath = task.GetOutPath(fileName)
-			file, err := os.Open(filePath)
-			if err != nil {
-				return errors.Errorf("os.Open Task %s err %+v filePath %s", task.ID, err, filePath)
-			}
-			defer file.Close()
-
-			err = ftpClient.Stor(fileName, file)
-			if err != nil {
-				return errors.Errorf("ftpClient.Stor Task %s err %+v fileName %s filePath %s", task.ID, err, fileName, filePath)
-			}
-
-			log.Debug("Task %s ftpStore successfully, filePath %s\n", task.ID, filePath)
-			return nil
-		}()
-		if err != nil {
-			return err
-		}
-	}
 	return nil
 }
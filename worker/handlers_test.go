@@ -3,6 +3,10 @@ package worker
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -34,14 +38,21 @@ func TestExec(t *testing.T) {
 
 	//ffmpeg -i /home/max/Загрузки/tmp/big-buck-bunny-1080p-30sec.mp4 -c:v libx264 -b:v 500k -c:a copy /home/max/Загрузки/tmp_out/output.mp4
 	var task = defaultTask()
+	var done = make(chan struct{})
 	go func() {
+		defer close(done)
 		var err = executeTask(ctx, task)
 		fmt.Printf("%s\n", err)
 	}()
 
 	//time.Sleep(2 * time.Second)
 	//cf()
-	time.Sleep(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		cf()
+		<-done
+	}
 	fmt.Printf("task: %+v\n", task)
 }
 
@@ -52,7 +63,7 @@ func TestFtp(t *testing.T) {
 	//ffmpeg -i /home/max/Загрузки/tmp/big-buck-bunny-1080p-30sec.mp4 -c:v libx264 -b:v 500k -c:a copy /home/max/Загрузки/tmp_out/output.mp4
 	var task = defaultTask()
 	go func() {
-		var err = ftpStore(ctx, task)
+		var err = saveOutputs(ctx, task)
 		fmt.Printf("err: %+v\n", err)
 	}()
 
@@ -61,3 +72,38 @@ func TestFtp(t *testing.T) {
 	time.Sleep(time.Second)
 	fmt.Printf("task: %+v\n", task)
 }
+
+func TestExecMultiOut(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	var inDir, outDir = t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(inDir, "555_0"), []byte("in"), 0644)
+	var task = &Task{
+		ID:      "555",
+		InDir:   inDir,
+		OutDir:  outDir,
+		Cmd:     sh,
+		Args:    []string{"-c", "cd {output_dir} && mkdir -p seg && touch index.m3u8 seg/a.ts seg/b.ts x.log"},
+		OutGlob: "seg/*.ts",
+		Files:   []string{"555_0"},
+	}
+	if err = executeTask(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, out := range task.Outputs {
+		names = append(names, out.Name)
+	}
+	if strings.Join(names, ",") != "555_0/seg/a.ts,555_0/seg/b.ts" {
+		t.Errorf("outputs %v", names)
+	}
+
+	// без результатов по шаблону - ошибка
+	task.Outputs = nil
+	task.OutGlob = "*.mp4"
+	if err = executeTask(context.TODO(), task); err == nil {
+		t.Error("expected no outputs error")
+	}
+}
@@ -0,0 +1,239 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+// приоритеты процессов config.Limits.Priority
+const (
+	PriorityIdle        = "idle"
+	PriorityBelowNormal = "below_normal"
+	PriorityNormal      = "normal"
+	PriorityAboveNormal = "above_normal"
+	PriorityHigh        = "high"
+)
+
+// виды лимитов LimitError.Limit
+const (
+	LimitMemory     = "max_memory"
+	LimitOutputSize = "max_output_size"
+	LimitTime       = "max_time"
+)
+
+// outputWatchInterval как часто проверяется размер результатов команды
+var outputWatchInterval = 500 * time.Millisecond
+
+// LimitError команда остановлена из-за превышения лимита ресурсов
+type LimitError struct {
+	Limit string
+	Msg   string
+}
+
+func (c *LimitError) Error() string {
+	return fmt.Sprintf("limit %s: %s", c.Limit, c.Msg)
+}
+
+// priorityRank порядок приоритетов от низкого к высокому
+var priorityRank = map[string]int{
+	PriorityIdle:        1,
+	PriorityBelowNormal: 2,
+	PriorityNormal:      3,
+	PriorityAboveNormal: 4,
+	PriorityHigh:        5,
+}
+
+// ValidateLimits проверяет лимиты задания: priority не выше и cpu_affinity в пределах limits конфига,
+// max_memory в linux только с cgroup_root
+func ValidateLimits(limits *config.Limits) error {
+	if limits == nil {
+		return nil
+	}
+	var msg []string
+	if limits.MaxMemory < 0 || limits.MaxOutputSize < 0 || limits.MaxTime < 0 {
+		msg = append(msg, "limits: max_memory, max_output_size и max_time не могут быть отрицательными")
+	}
+	switch limits.Priority {
+	case "", PriorityIdle, PriorityBelowNormal, PriorityNormal, PriorityAboveNormal, PriorityHigh:
+	default:
+		msg = append(msg, fmt.Sprintf("limits: неизвестный priority %s", limits.Priority))
+	}
+	// в linux память ограничивается только cgroup, см. limitGroup
+	if limits.MaxMemory > 0 && runtime.GOOS == "linux" && len(config.Load().CgroupRoot) == 0 {
+		msg = append(msg, "limits: max_memory в linux требует cgroup_root в конфиге")
+	}
+	var ceiling = config.Load().Limits
+	if len(limits.Priority) > 0 && len(ceiling.Priority) > 0 && priorityRank[limits.Priority] > priorityRank[ceiling.Priority] {
+		msg = append(msg, fmt.Sprintf("limits: priority %s выше priority %s конфига", limits.Priority, ceiling.Priority))
+	}
+	for _, cpu := range limits.CpuAffinity {
+		if cpu < 0 || cpu >= runtime.NumCPU() || cpu >= 64 {
+			msg = append(msg, fmt.Sprintf("limits: cpu_affinity нет процессора %d", cpu))
+		} else if len(ceiling.CpuAffinity) > 0 && !slices.Contains(ceiling.CpuAffinity, cpu) {
+			msg = append(msg, fmt.Sprintf("limits: cpu_affinity процессора %d нет в cpu_affinity конфига", cpu))
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "\n"))
+	}
+	return nil
+}
+
+// limits лимиты задания с учетом лимитов конфига
+func (c *Task) limits() config.Limits {
+	return config.Load().Limits.Merge(c.Limits)
+}
+
+// errMaxTime причина отмены ctx команд по max_time
+var errMaxTime = errors.New("max_time")
+
+// withMaxTime ограничивает ctx временем max_time, ошибка после истечения времени - LimitError.
+// Время на паузе задания не считается
+func withMaxTime(ctx context.Context, task *Task, fn func(ctx context.Context) error) error {
+	var maxTime = task.limits().MaxTime
+	if maxTime <= 0 {
+		return fn(ctx)
+	}
+	ctxTime, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go watchMaxTime(ctxTime, task.pause, time.Duration(maxTime)*time.Second, cancel)
+	err := fn(ctxTime)
+	if err != nil && ctx.Err() == nil && context.Cause(ctxTime) == errMaxTime {
+		return &LimitError{Limit: LimitTime, Msg: fmt.Sprintf("команды выполнялись дольше %d сек", maxTime)}
+	}
+	return err
+}
+
+// watchMaxTime отменяет ctx с errMaxTime, когда время выполнения без пауз задания превысит max
+func watchMaxTime(ctx context.Context, gate *pauseGate, max time.Duration, cancel context.CancelCauseFunc) {
+	var start = time.Now()
+	var pausedStart, _ = gate.pausedTime()
+	var timer = time.NewTimer(max)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		var paused, resumed = gate.pausedTime()
+		if resumed != nil {
+			// на паузе время не идет
+			select {
+			case <-ctx.Done():
+				return
+			case <-resumed:
+			}
+			paused, _ = gate.pausedTime()
+		}
+		var left = max - (time.Since(start) - (paused - pausedStart))
+		if left <= 0 {
+			cancel(errMaxTime)
+			return
+		}
+		timer.Reset(left)
+	}
+}
+
+// outputWatch следит за размером результатов команды и вызывает stop при превышении max
+type outputWatch struct {
+	paths []string
+	max   int64
+	stop  func()
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	err  *LimitError
+}
+
+// watchOutputs запускает проверку файлов и папок paths, nil если лимита нет
+func watchOutputs(paths []string, max int64, stop func()) *outputWatch {
+	if max <= 0 || len(paths) == 0 {
+		return nil
+	}
+	var res = &outputWatch{paths: paths, max: max, stop: stop, done: make(chan struct{})}
+	res.wg.Add(1)
+	go res.run()
+	return res
+}
+
+func (c *outputWatch) run() {
+	defer c.wg.Done()
+	var ticker = time.NewTicker(outputWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if c.err = c.check(); c.err != nil {
+			c.stop()
+			return
+		}
+	}
+}
+
+// check ищет файл результата больше max
+func (c *outputWatch) check() *LimitError {
+	var res *LimitError
+	for _, root := range c.paths {
+		filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.Size() <= c.max {
+				return nil
+			}
+			res = &LimitError{Limit: LimitOutputSize, Msg: fmt.Sprintf("файл %s больше %d байт", filepath.Base(filePath), c.max)}
+			return filepath.SkipAll
+		})
+		if res != nil {
+			return res
+		}
+	}
+	return nil
+}
+
+// close останавливает проверку и возвращает ошибку, если лимит превышен
+func (c *outputWatch) close() error {
+	if c == nil {
+		return nil
+	}
+	close(c.done)
+	c.wg.Wait()
+	if c.err == nil {
+		// файл мог вырасти после последней проверки
+		c.err = c.check()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	return nil
+}
+
+// limitCause ошибка лимита из err, чтобы сохранить ее при добавлении контекста
+func limitCause(err error) (*LimitError, bool) {
+	res, ok := errors.Cause(err).(*LimitError)
+	return res, ok
+}
+
+// wrapCmdErr ошибка команды с ее stderr и аргументами, ошибка лимита остается причиной
+func wrapCmdErr(err error, stderr io.Writer, name string, args []string) error {
+	if _, ok := limitCause(err); ok {
+		return errors.WithMessagef(err, "cmdErr %s, cmd %s, args %+v", stderr, name, args)
+	}
+	return errors.Errorf("err (%s), cmdErr %s, cmd %s, args %+v", err, stderr, name, args)
+}
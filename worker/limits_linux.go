@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// priorityNice значения nice для приоритетов limits
+var priorityNice = map[string]int{
+	PriorityIdle:        19,
+	PriorityBelowNormal: 10,
+	PriorityNormal:      0,
+	PriorityAboveNormal: -5,
+	PriorityHigh:        -10,
+}
+
+// cgroupSeq номер cgroup команды, уникальный в процессе сервиса
+var cgroupSeq atomic.Int64
+
+// limitGroup лимиты ресурсов команды. Память ограничивается только cgroup v2 в cgroup_root,
+// процесс попадает в cgroup при запуске (нужно ядро 5.7+). rlimit RLIMIT_AS не используется:
+// он ограничивает адресное пространство, а не память, и его превышение не отличить от ошибки команды.
+type limitGroup struct {
+	limits *config.Limits
+	// cgroup папка cgroup команды, пустая если cgroup не используется
+	cgroup string
+	dir    *os.File
+}
+
+// prepare создает cgroup команды для max_memory. Без cgroup команда не запускается,
+// чтобы не выполнять ее без лимита памяти
+func (c *limitGroup) prepare(cmd *exec.Cmd, limits *config.Limits) error {
+	c.limits = limits
+	if limits.MaxMemory <= 0 {
+		return nil
+	}
+	var root = config.Load().CgroupRoot
+	if len(root) == 0 {
+		return errors.New("limits: max_memory в linux требует cgroup_root в конфиге")
+	}
+
+	var cgroup = filepath.Join(root, fmt.Sprintf("cmd-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		return errors.Errorf("cgroup %s create err %+v", cgroup, err)
+	}
+	var err = os.WriteFile(filepath.Join(cgroup, "memory.max"), []byte(strconv.FormatInt(limits.MaxMemory, 10)), 0644)
+	if err == nil {
+		c.dir, err = os.Open(cgroup)
+	}
+	if err != nil {
+		os.Remove(cgroup)
+		return errors.Errorf("cgroup %s memory.max err %+v", cgroup, err)
+	}
+	c.cgroup = cgroup
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+	return nil
+}
+
+// apply применяет к запущенному процессу приоритет и процессоры.
+// exec.Cmd не дает выполнить код между fork и exec, поэтому они применяются сразу после cmd.Start:
+// процессы, которые команда успела запустить до этого, их не наследуют. Лимит памяти через
+// cgroup действует с момента запуска.
+func (c *limitGroup) apply(cmd *exec.Cmd) error {
+	if c.dir != nil {
+		c.dir.Close()
+		c.dir = nil
+	}
+	var pid = cmd.Process.Pid
+	var msg []string
+	if len(c.limits.Priority) > 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, priorityNice[c.limits.Priority]); err != nil {
+			msg = append(msg, fmt.Sprintf("priority: %s", err))
+		}
+	}
+	if len(c.limits.CpuAffinity) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range c.limits.CpuAffinity {
+			set.Set(cpu)
+		}
+		if err := unix.SchedSetaffinity(pid, &set); err != nil {
+			msg = append(msg, fmt.Sprintf("cpu_affinity: %s", err))
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, ", "))
+	}
+	return nil
+}
+
+// violation LimitError, если в cgroup команды были oom_kill
+func (c *limitGroup) violation() error {
+	if len(c.cgroup) == 0 {
+		return nil
+	}
+	buffer, err := os.ReadFile(filepath.Join(c.cgroup, "memory.events"))
+	if err != nil {
+		return nil
+	}
+	var scanner = bufio.NewScanner(bytes.NewReader(buffer))
+	for scanner.Scan() {
+		var name, value, _ = strings.Cut(scanner.Text(), " ")
+		if count, _ := strconv.Atoi(value); name == "oom_kill" && count > 0 {
+			return &LimitError{Limit: LimitMemory, Msg: fmt.Sprintf("процессы команды превысили %d байт", c.limits.MaxMemory)}
+		}
+	}
+	return nil
+}
+
+// close удаляет cgroup команды, оставшиеся в ней процессы убиваются
+func (c *limitGroup) close() {
+	if c.dir != nil {
+		c.dir.Close()
+		c.dir = nil
+	}
+	if len(c.cgroup) == 0 {
+		return
+	}
+	// cgroup.kill есть с ядра 5.14, процессы группы уже убиты killAll
+	os.WriteFile(filepath.Join(c.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	for range 20 {
+		if err := os.Remove(c.cgroup); err == nil || os.IsNotExist(err) {
+			c.cgroup = ""
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Error("Cgroup %s remove error", c.cgroup)
+}
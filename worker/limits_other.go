@@ -0,0 +1,27 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package worker
+
+import (
+	"os/exec"
+
+	"mediamagi.ru/win-file-agent/config"
+)
+
+// limitGroup лимиты ресурсов на этой платформе не поддерживаются, кроме max_time и max_output_size
+type limitGroup struct{}
+
+func (c *limitGroup) prepare(cmd *exec.Cmd, limits *config.Limits) error {
+	return nil
+}
+
+func (c *limitGroup) apply(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (c *limitGroup) violation() error {
+	return nil
+}
+
+func (c *limitGroup) close() {}
@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+)
+
+func TestExecuteTaskLimits(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	config.InitFromJson(strings.NewReader(`{"stop_grace":1,"limits":{"max_time":30}}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+	outputWatchInterval = 50 * time.Millisecond
+	defer func() { outputWatchInterval = 500 * time.Millisecond }()
+
+	var outDir = t.TempDir()
+	var newTask = func(script string, limits *config.Limits) *Task {
+		var task = shTask(t, sh, "555", outDir, script)
+		task.Limits = limits
+		return task
+	}
+	var limitOf = func(err error) string {
+		if le, ok := limitCause(err); ok {
+			return le.Limit
+		}
+		return ""
+	}
+
+	// лимит задания переопределяет max_time конфига
+	var task = newTask("sleep 30", &config.Limits{MaxTime: 1})
+	var start = time.Now()
+	err = executeTask(context.TODO(), task)
+	if limitOf(err) != LimitTime || time.Since(start) > 5*time.Second {
+		t.Errorf("max_time err %v after %s", err, time.Since(start))
+	}
+	if kind := errKind(context.TODO(), PROCESS, err); kind != ErrKindLimit {
+		t.Errorf("err kind %s", kind)
+	}
+
+	// результат растет, пока команда не будет остановлена
+	task = newTask("while true; do head -c 1024 /dev/zero >> {output}; sleep 0.01; done", &config.Limits{MaxOutputSize: 4096})
+	if err = executeTask(context.TODO(), task); limitOf(err) != LimitOutputSize {
+		t.Errorf("max_output_size err %v", err)
+	}
+	task = newTask("head -c 100 /dev/zero > {output}", &config.Limits{MaxOutputSize: 4096})
+	if err = executeTask(context.TODO(), task); err != nil {
+		t.Errorf("small output err %v", err)
+	}
+
+	// ошибка лимита сохраняется в шагах
+	task = newTask("", &config.Limits{MaxOutputSize: 10})
+	task.Cmd, task.Args = "", nil
+	task.Steps = []*Step{{Name: "big", Cmd: sh, Args: []string{"-c", "head -c 100 /dev/zero > {output}"}}}
+	if err = executeTask(context.TODO(), task); limitOf(err) != LimitOutputSize || task.Steps[0].State != ERROR {
+		t.Errorf("step max_output_size err %v", err)
+	}
+
+	if runtime.GOOS == "linux" {
+		task = newTask("sleep 0.2; cut -d' ' -f19 /proc/$$/stat > {output}; grep Cpus_allowed_list /proc/$$/status >> {output}",
+			&config.Limits{Priority: PriorityBelowNormal, CpuAffinity: []int{0}})
+		if err = executeTask(context.TODO(), task); err != nil {
+			t.Fatal(err)
+		}
+		buffer, _ := os.ReadFile(task.Outputs[len(task.Outputs)-1].Path)
+		if fields := strings.Fields(string(buffer)); len(fields) != 3 || fields[0] != "10" || fields[2] != "0" {
+			t.Errorf("priority and affinity %q", buffer)
+		}
+
+		// без cgroup_root max_memory не применить, команда не запускается
+		task = newTask("touch {output}", &config.Limits{MaxMemory: 1 << 30})
+		if err = executeTask(context.TODO(), task); err == nil || !strings.Contains(err.Error(), "cgroup_root") {
+			t.Errorf("max_memory without cgroup err %v", err)
+		}
+		if err = ValidateLimits(task.Limits); err == nil {
+			t.Error("max_memory without cgroup_root")
+		}
+	}
+
+	if err = ValidateLimits(&config.Limits{MaxTime: -1, Priority: "realtime", CpuAffinity: []int{1024}}); err == nil ||
+		strings.Count(err.Error(), "\n") != 2 {
+		t.Errorf("validate err %v", err)
+	}
+}
+
+func TestLimitsCeiling(t *testing.T) {
+	config.InitFromJson(strings.NewReader(`{"limits":{"max_memory":1000,"max_time":60,"priority":"normal","cpu_affinity":[0]},"cgroup_root":"/sys/fs/cgroup/agent"}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+
+	var task = &Task{Limits: &config.Limits{MaxMemory: 2000, MaxTime: 30, MaxOutputSize: 10, Priority: PriorityIdle}}
+	if limits := task.limits(); limits.MaxMemory != 1000 || limits.MaxTime != 30 || limits.MaxOutputSize != 10 ||
+		limits.Priority != PriorityIdle || len(limits.CpuAffinity) != 1 {
+		t.Errorf("limits %+v", limits)
+	}
+	if err := ValidateLimits(task.Limits); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateLimits(&config.Limits{Priority: PriorityHigh}); err == nil {
+		t.Error("priority above config")
+	}
+	if runtime.NumCPU() > 1 {
+		if err := ValidateLimits(&config.Limits{CpuAffinity: []int{1}}); err == nil {
+			t.Error("cpu not in config")
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// ErrPauseState задание нельзя приостановить или продолжить в текущем состоянии
+var ErrPauseState = errors.New("Задание завершено или не может быть приостановлено")
+
+// pauseGate пауза задания. На паузе не запускаются этапы и команды, передача файлов
+// ждет продолжения, запущенные процессы команд приостановлены.
+type pauseGate struct {
+	lock   sync.Mutex
+	paused bool
+	// resumed закрывается при продолжении
+	resumed chan struct{}
+	// prev состояние задания до паузы, восстанавливается при продолжении
+	prev StateCode
+	// parked задание снято с очереди на время паузы
+	parked bool
+	procs  map[*procTree]struct{}
+	// pausedAt начало текущей паузы, pausedFor длительность завершенных пауз
+	pausedAt  time.Time
+	pausedFor time.Duration
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{procs: make(map[*procTree]struct{})}
+}
+
+type pauseKey struct{}
+
+// withPause передает пауза задания через ctx в передачу файлов
+func withPause(ctx context.Context, gate *pauseGate) context.Context {
+	return context.WithValue(ctx, pauseKey{}, gate)
+}
+
+// waitPause ждет продолжения задания из ctx, если оно на паузе
+func waitPause(ctx context.Context) error {
+	var gate, _ = ctx.Value(pauseKey{}).(*pauseGate)
+	return gate.wait(ctx)
+}
+
+// wait ждет продолжения или отмены ctx
+func (c *pauseGate) wait(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	if !c.paused {
+		c.lock.Unlock()
+		return nil
+	}
+	var resumed = c.resumed
+	c.lock.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pause ставит на паузу задание в состоянии state и приостанавливает процессы команд.
+// false, если задание уже на паузе.
+func (c *pauseGate) pause(state StateCode) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		return false
+	}
+	c.paused = true
+	c.prev = state
+	c.resumed = make(chan struct{})
+	c.pausedAt = time.Now()
+	for tree := range c.procs {
+		if err := tree.suspend(); err != nil {
+			log.Error("Process %d suspend error: %+v", tree.cmd.Process.Pid, err)
+		}
+	}
+	return true
+}
+
+// resume продолжает задание. Возвращает состояние до паузы и было ли задание снято с очереди.
+func (c *pauseGate) resume() (StateCode, bool, bool) {
+	if c == nil {
+		return CREATE, false, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.paused {
+		return CREATE, false, false
+	}
+	c.paused = false
+	close(c.resumed)
+	c.pausedFor += time.Since(c.pausedAt)
+	for tree := range c.procs {
+		if err := tree.resume(); err != nil {
+			log.Error("Process %d resume error: %+v", tree.cmd.Process.Pid, err)
+		}
+	}
+	var parked = c.parked
+	c.parked = false
+	return c.prev, parked, true
+}
+
+// repark снова ставит на паузу снятое с очереди задание, если его не удалось вернуть в очередь
+func (c *pauseGate) repark(prev StateCode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused = true
+	c.parked = true
+	c.prev = prev
+	c.resumed = make(chan struct{})
+	c.pausedAt = time.Now()
+}
+
+// pausedTime сколько задание провело на паузе, resumed - канал продолжения, если задание сейчас на паузе
+func (c *pauseGate) pausedTime() (time.Duration, chan struct{}) {
+	if c == nil {
+		return 0, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		return c.pausedFor + time.Since(c.pausedAt), c.resumed
+	}
+	return c.pausedFor, nil
+}
+
+// park снимает задание с очереди, если оно на паузе
+func (c *pauseGate) park() bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		c.parked = true
+	}
+	return c.paused
+}
+
+// holdState на паузе новое состояние задания запоминается до продолжения
+func (c *pauseGate) holdState(state StateCode) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		c.prev = state
+	}
+	return c.paused
+}
+
+// addProc учитывает запущенную команду, на паузе она сразу приостанавливается
+func (c *pauseGate) addProc(tree *procTree) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.procs[tree] = struct{}{}
+	if c.paused {
+		if err := tree.suspend(); err != nil {
+			log.Error("Process %d suspend error: %+v", tree.cmd.Process.Pid, err)
+		}
+	}
+}
+
+func (c *pauseGate) removeProc(tree *procTree) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.procs, tree)
+}
+
+// Pause ставит задание на паузу: задание в очереди не запускается до продолжения,
+// выполняющееся задание приостанавливает команды и передачу файлов
+func (c *Worker) Pause(id string) error {
+	task, ok := c.store.Load(id)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	task.stateLock.Lock()
+	defer task.stateLock.Unlock()
+	switch task.State {
+	case PAUSED:
+		return nil
+	case ERROR, FINISH, CANCEL:
+		return ErrPauseState
+	}
+	if task.pause == nil || !task.pause.pause(task.State) {
+		return ErrPauseState
+	}
+	task.State = PAUSED
+	log.Info("Task %s paused", id)
+	return nil
+}
+
+// Resume продолжает задание после паузы. Снятое с очереди задание возвращается в нее,
+// если в очереди нет места, то задание остается на паузе и возвращается ErrQueueFull
+func (c *Worker) Resume(id string) error {
+	task, ok := c.store.Load(id)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	// порядок блокировок как в feedBacklog: admitLock, затем stateLock
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	task.stateLock.Lock()
+	prev, parked, ok := task.pause.resume()
+	if !ok {
+		var state = task.State
+		task.stateLock.Unlock()
+		if state == ERROR || state == FINISH {
+			return ErrPauseState
+		}
+		return nil
+	}
+	if parked && len(c.taskQueue) == cap(c.taskQueue) {
+		task.pause.repark(prev)
+		task.stateLock.Unlock()
+		return ErrQueueFull
+	}
+	if task.State == PAUSED {
+		task.State = prev
+	}
+	task.stateLock.Unlock()
+	// задание уже в store, в очередь оно отправляется после снятия stateLock,
+	// отмененное до этого задание воркер не запустит (startProc)
+	if parked {
+		c.taskQueue <- task
+	}
+	log.Info("Task %s resumed", id)
+	return nil
+}
+
+// queueGate пауза агента. Воркеры не берут новые задания, выполняющиеся задания завершаются.
+type queueGate struct {
+	lock sync.Mutex
+	// resumed закрывается при продолжении, nil - агент не на паузе
+	resumed chan struct{}
+}
+
+// wait ждет продолжения агента или отмены ctx
+func (c *queueGate) wait(ctx context.Context) error {
+	c.lock.Lock()
+	var resumed = c.resumed
+	c.lock.Unlock()
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PauseQueue ставит агент на паузу: новые задания из очереди не запускаются до ResumeQueue,
+// выполняющиеся задания завершаются
+func (c *Worker) PauseQueue() {
+	c.queuePause.lock.Lock()
+	defer c.queuePause.lock.Unlock()
+	if c.queuePause.resumed != nil {
+		return
+	}
+	c.queuePause.resumed = make(chan struct{})
+	log.Info("Worker paused, running tasks will finish")
+}
+
+// ResumeQueue продолжает запуск заданий из очереди после PauseQueue
+func (c *Worker) ResumeQueue() {
+	c.queuePause.lock.Lock()
+	defer c.queuePause.lock.Unlock()
+	if c.queuePause.resumed == nil {
+		return
+	}
+	close(c.queuePause.resumed)
+	c.queuePause.resumed = nil
+	log.Info("Worker resumed")
+}
+
+// IsQueuePaused агент на паузе
+func (c *Worker) IsQueuePaused() bool {
+	c.queuePause.lock.Lock()
+	defer c.queuePause.lock.Unlock()
+	return c.queuePause.resumed != nil
+}
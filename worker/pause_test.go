@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+)
+
+func TestWorkerPause(t *testing.T) {
+	var w, sh = runWorker(t)
+	var outDir = t.TempDir()
+	var newTask = func(id string) *Task {
+		return shTask(t, sh, id, outDir, "for i in 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15; do echo $i >> {output}; sleep 0.05; done")
+	}
+	var outSize = func(task *Task) int64 {
+		info, err := os.Stat(filepath.Join(outDir, task.ID+"_0"))
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+
+	var first, second = newTask("101"), newTask("102")
+	w.ExecTask(first)
+	waitState(t, first, PROCESS)
+	for outSize(first) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := w.Pause(first.ID); err != nil || first.GetState() != PAUSED {
+		t.Fatalf("pause err %v state %s", err, first.GetState())
+	}
+	// процесс приостановлен, результат не растет
+	time.Sleep(100 * time.Millisecond)
+	var size = outSize(first)
+	time.Sleep(300 * time.Millisecond)
+	if outSize(first) != size {
+		t.Errorf("output grows on pause %d -> %d", size, outSize(first))
+	}
+
+	// задание в очереди снимается с нее до продолжения
+	w.ExecTask(second)
+	if err := w.Pause(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resume(first.ID); err != nil || first.GetState() != PROCESS {
+		t.Fatalf("resume err %v state %s", err, first.GetState())
+	}
+	waitState(t, first, FINISH)
+	time.Sleep(200 * time.Millisecond)
+	if second.GetState() != PAUSED || outSize(second) != 0 {
+		t.Errorf("parked task state %s output %d", second.GetState(), outSize(second))
+	}
+	if err := w.Resume(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, second, FINISH)
+
+	if err := w.Pause(first.ID); err != ErrPauseState {
+		t.Errorf("pause finished err %v", err)
+	}
+	if err := w.Pause("missing"); err != ErrTaskNotFound {
+		t.Errorf("pause missing err %v", err)
+	}
+}
+
+func TestWorkerPauseQueue(t *testing.T) {
+	var w, sh = runWorker(t)
+	var outDir = t.TempDir()
+	var running, queued = shTask(t, sh, "201", outDir, "sleep 0.3; cp {input} {output}"), shTask(t, sh, "202", outDir, "sleep 0.3; cp {input} {output}")
+	w.ExecTask(running)
+	waitState(t, running, PROCESS)
+	w.PauseQueue()
+	if !w.IsQueuePaused() {
+		t.Fatal("worker is not paused")
+	}
+
+	// выполняющееся задание завершается, новое не запускается
+	w.ExecTask(queued)
+	waitState(t, running, FINISH)
+	time.Sleep(200 * time.Millisecond)
+	if queued.GetState() != CREATE {
+		t.Fatalf("queued task state %s on pause", queued.GetState())
+	}
+
+	w.ResumeQueue()
+	if w.IsQueuePaused() {
+		t.Fatal("worker is paused after resume")
+	}
+	waitState(t, queued, FINISH)
+}
+
+func TestWorkerPauseMaxTime(t *testing.T) {
+	var w, sh = runWorker(t)
+	var task = shTask(t, sh, "103", t.TempDir(), "sleep 0.8; cp {input} {output}")
+	task.Limits = &config.Limits{MaxTime: 1}
+	w.ExecTask(task)
+	waitState(t, task, PROCESS)
+	// пауза дольше max_time не считается во время выполнения команды
+	if err := w.Pause(task.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := w.Resume(task.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, task, FINISH)
+}
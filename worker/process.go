@@ -0,0 +1,233 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// Stdin стандартный ввод команды: файл или содержимое
+type Stdin struct {
+	// File путь файла, поддерживает переменные шаблонов, например {input}
+	File string `json:"file,omitempty"`
+	// Content содержимое стандартного ввода
+	Content string `json:"content,omitempty"`
+}
+
+// cmdSpec команда для запуска
+type cmdSpec struct {
+	name string
+	args []string
+	// dir рабочая папка, если пустая - Task.WorkingDir
+	dir   string
+	stdin *Stdin
+	// vars переменные шаблонов для Stdin.File
+	vars map[string]string
+	// success правила успешного завершения, nil - успех только при коде 0
+	success *SuccessPolicy
+	// outputs файлы и папки результатов команды для лимита max_output_size
+	outputs []string
+	// stdout вывод команды, nil - в stdout сервиса
+	stdout io.Writer
+}
+
+// ValidateProcess проверяет окружение, рабочую папку и stdin команды
+func ValidateProcess(env map[string]string, workingDir string, stdin *Stdin, vars map[string]string) error {
+	var msg []string
+	for key, val := range env {
+		if len(key) == 0 || strings.ContainsAny(key, "=\x00") || strings.ContainsRune(val, 0) {
+			msg = append(msg, fmt.Sprintf("env: некорректная переменная %q", key))
+		}
+	}
+	if err := ValidateWorkDir(workingDir); err != nil {
+		msg = append(msg, err.Error())
+	}
+	if err := stdin.validate(vars); err != nil {
+		msg = append(msg, err.Error())
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "\n"))
+	}
+	return nil
+}
+
+// ValidateWorkDir проверяет, что рабочая папка абсолютная и лежит в work_roots конфига
+func ValidateWorkDir(dir string) error {
+	if len(dir) == 0 {
+		return nil
+	}
+	if !filepath.IsAbs(dir) {
+		return errors.Errorf("Рабочая папка %s должна быть абсолютной", dir)
+	}
+	if !config.Load().IsWorkDirAllowed(dir) {
+		return errors.Errorf("Рабочая папка %s вне разрешенных work_roots", dir)
+	}
+	return nil
+}
+
+func (c *Stdin) validate(vars map[string]string) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.File) > 0 && len(c.Content) > 0 {
+		return errors.New("stdin: задается либо file, либо content")
+	}
+	if len(c.File) > 0 {
+		if err := ValidateArgs([]string{c.File}, vars); err != nil {
+			return errors.Errorf("stdin.file: %s", err)
+		}
+	}
+	return nil
+}
+
+// cmdEnv окружение команд задания: разрешенные в env_allow переменные сервиса и Env задания.
+// nil - команда получает окружение сервиса целиком.
+func (c *Task) cmdEnv() []string {
+	var cfg = config.Load()
+	if len(c.Env) == 0 && len(cfg.EnvAllow) == 0 {
+		return nil
+	}
+
+	var res []string
+	for _, it := range os.Environ() {
+		var name, _, _ = strings.Cut(it, "=")
+		if _, ok := c.findEnv(name); ok || !cfg.IsEnvAllowed(name) {
+			continue
+		}
+		res = append(res, it)
+	}
+	for key, val := range c.Env {
+		res = append(res, key+"="+val)
+	}
+	return res
+}
+
+// findEnv ищет переменную задания, без учета регистра как в windows
+func (c *Task) findEnv(name string) (string, bool) {
+	for key, val := range c.Env {
+		if strings.EqualFold(key, name) {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// isStdinAllowed файл stdin лежит в папке входящих файлов, результатов или file_roots
+func (c *Task) isStdinAllowed(filePath string) bool {
+	var cfg = config.Load()
+	return config.IsSubPath(c.InDir, filePath) || config.IsSubPath(c.GetOutDir(), filePath) ||
+		(len(cfg.FileRoots) > 0 && cfg.IsFileAllowed(filePath))
+}
+
+// runCmd запускает команду и ждет ее завершения.
+// Если setCmd, то дерево процессов команды сохраняется в task.proc для остановки.
+// При отмене ctx все процессы команды получают мягкую остановку, через stop_grace - kill.
+func runCmd(ctx context.Context, task *Task, spec *cmdSpec, setCmd bool, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, spec.name, spec.args...)
+	cmd.Env = task.cmdEnv()
+	cmd.Dir = spec.dir
+	if len(cmd.Dir) == 0 {
+		cmd.Dir = task.WorkingDir
+	}
+	cmd.Stdout = os.Stdout
+	if spec.stdout != nil {
+		cmd.Stdout = spec.stdout
+	}
+	cmd.Stderr = stderr
+	var limits = task.limits()
+	tree, err := newProcTree(cmd, &limits)
+	if err != nil {
+		return err
+	}
+	cmd.Cancel = func() error { return tree.stop(stopGrace()) }
+
+	matcher, err := spec.success.newOutputMatcher()
+	if err != nil {
+		return err
+	}
+	var lines []*lineWriter
+	if matcher != nil {
+		lines = []*lineWriter{matcher.writer(), matcher.writer()}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, lines[0])
+		cmd.Stderr = io.MultiWriter(stderr, lines[1])
+	}
+
+	if stdin := spec.stdin; stdin != nil {
+		if len(stdin.File) > 0 {
+			args, err := renderArgs([]string{stdin.File}, spec.vars, nil)
+			if err != nil {
+				return err
+			}
+			// относительный путь от рабочей папки, как у самой команды
+			var filePath = args[0]
+			if !filepath.IsAbs(filePath) && len(cmd.Dir) > 0 {
+				filePath = filepath.Join(cmd.Dir, filePath)
+			}
+			if !task.isStdinAllowed(filePath) {
+				return errors.Errorf("stdin %s вне in_dir, папки результатов и file_roots", filePath)
+			}
+			file, err := os.Open(filePath)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer file.Close()
+			cmd.Stdin = file
+		} else {
+			cmd.Stdin = strings.NewReader(stdin.Content)
+		}
+	}
+
+	// на паузе команда не запускается
+	if err := task.pause.wait(ctx); err != nil {
+		return err
+	}
+	// запускаем
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// оставшиеся после команды процессы убиваются
+	defer tree.release()
+	if err := tree.attach(); err != nil {
+		log.Error("Task %s process tree attach error: %+v", task.ID, err)
+	}
+	if setCmd {
+		task.proc = tree
+	}
+	task.pause.addProc(tree)
+	defer task.pause.removeProc(tree)
+	var watch = watchOutputs(spec.outputs, limits.MaxOutputSize, func() { tree.stop(stopGrace()) })
+	// ждём завершения
+	err = cmd.Wait()
+	if limitErr := watch.close(); limitErr != nil {
+		return limitErr
+	}
+	if err != nil && ctx.Err() == nil {
+		if limitErr := tree.violation(); limitErr != nil {
+			return limitErr
+		}
+	}
+	if spec.success == nil || ctx.Err() != nil {
+		return err
+	}
+	// код выхода и вывод проверяются по правилам success
+	var code = 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		code = exitErr.ExitCode()
+	}
+	for _, it := range lines {
+		it.Close()
+	}
+	return matcher.result(spec.success, code)
+}
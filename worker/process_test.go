@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/config"
+)
+
+func TestRunCmdProcess(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	var workDir, inDir = t.TempDir(), t.TempDir()
+	config.InitFromJson(strings.NewReader(`{"work_roots":["` + filepath.ToSlash(workDir) + `"],"env_allow":["PATH"]}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+	t.Setenv("AGENT_SECRET", "secret")
+
+	var task = &Task{
+		ID:         "555",
+		InDir:      inDir,
+		OutDir:     inDir,
+		WorkingDir: workDir,
+		Env:        map[string]string{"MODE": "fast"},
+	}
+	var run = func(script string, stdin *Stdin, vars map[string]string) (string, error) {
+		var stderr bytes.Buffer
+		var spec = &cmdSpec{name: sh, args: []string{"-c", script + " >&2"}, stdin: stdin, vars: vars}
+		err := runCmd(context.TODO(), task, spec, false, &stderr)
+		return strings.TrimSpace(stderr.String()), err
+	}
+
+	if out, err := run("echo $MODE:$AGENT_SECRET:$(pwd)", nil, nil); err != nil || out != "fast::"+workDir {
+		t.Errorf("env and dir %q err %v", out, err)
+	}
+	if out, err := run("cat", &Stdin{Content: "inline"}, nil); err != nil || out != "inline" {
+		t.Errorf("stdin content %q err %v", out, err)
+	}
+
+	var input = filepath.Join(inDir, "555_0")
+	os.WriteFile(input, []byte("from file"), 0644)
+	if out, err := run("cat", &Stdin{File: "{input}"}, map[string]string{"input": input}); err != nil || out != "from file" {
+		t.Errorf("stdin file %q err %v", out, err)
+	}
+	// файл вне папок задания
+	if _, err := run("cat", &Stdin{File: "/etc/hostname"}, nil); err == nil {
+		t.Error("expected stdin path error")
+	}
+
+	if err := ValidateProcess(nil, filepath.Join(workDir, "sub"), nil, nil); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateProcess(nil, t.TempDir(), nil, nil); err == nil {
+		t.Error("expected work_roots error")
+	}
+	if err := ValidateProcess(map[string]string{"A=B": "1"}, "", &Stdin{File: "a", Content: "b"}, nil); err == nil {
+		t.Error("expected env and stdin errors")
+	}
+}
+
+func TestRunCmdSuccess(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	var task = &Task{ID: "555"}
+	var run = func(script string, policy *SuccessPolicy) error {
+		var stderr bytes.Buffer
+		var spec = &cmdSpec{name: sh, args: []string{"-c", script}, success: policy}
+		return runCmd(context.TODO(), task, spec, false, &stderr)
+	}
+
+	var policy = &SuccessPolicy{
+		ExitCodes: []int{0, 1},
+		FailOn:    []string{`^ERROR`},
+		SucceedOn: []string{`completed with warnings`},
+		Messages:  map[string]string{"3": "Файл поврежден"},
+	}
+	var tests = []struct {
+		script string
+		policy *SuccessPolicy
+		ok     bool
+		msg    string
+	}{
+		{"exit 0", nil, true, ""},
+		{"exit 1", nil, false, "exit status 1"},
+		{"exit 1", policy, true, ""},
+		{"exit 3", policy, false, "Файл поврежден"},
+		{"echo ERROR: bad input >&2", policy, false, "ERROR: bad input"},
+		{"printf 'ok\\nERROR at end'", policy, false, "ERROR at end"},
+		{"echo completed with warnings; exit 5", policy, true, ""},
+		{"exit 5", policy, false, "exit code 5"},
+	}
+	for _, it := range tests {
+		err := run(it.script, it.policy)
+		if it.ok != (err == nil) || (err != nil && !strings.Contains(err.Error(), it.msg)) {
+			t.Errorf("%s: err %v", it.script, err)
+		}
+	}
+
+	if err = (&SuccessPolicy{FailOn: []string{"("}, Messages: map[string]string{"x": "y"}}).Validate(); err == nil {
+		t.Error("expected success policy error")
+	}
+}
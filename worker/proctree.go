@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// procTree все процессы команды: группа процессов в linux, Job Object в windows.
+// Остановка - мягкий сигнал всему дереву, через grace - kill всего дерева.
+type procTree struct {
+	cmd *exec.Cmd
+	procGroup
+
+	lock     sync.Mutex
+	timer    *time.Timer
+	released bool
+}
+
+// newProcTree настраивает запуск cmd в отдельной группе с лимитами ресурсов, вызывается до cmd.Start.
+// Ошибка, если лимиты нельзя применить, тогда команда не запускается
+func newProcTree(cmd *exec.Cmd, limits *config.Limits) (*procTree, error) {
+	var res = &procTree{cmd: cmd}
+	if err := res.prepare(cmd, limits); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// attach подключает запущенную команду к дереву и применяет лимиты
+func (c *procTree) attach() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.procGroup.attach(c.cmd)
+}
+
+// violation ошибка LimitError, если команда завершилась из-за лимита памяти
+func (c *procTree) violation() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.released {
+		return nil
+	}
+	return c.procGroup.violation()
+}
+
+// stop мягкая остановка дерева, через grace - kill. Если мягкий сигнал не доставлен, то сразу kill
+func (c *procTree) stop(grace time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.released || c.timer != nil {
+		return nil
+	}
+	if err := c.signal(c.cmd); err != nil {
+		log.Debug("Process %d graceful stop error: %+v, kill\n", c.cmd.Process.Pid, err)
+		return c.killAll(c.cmd)
+	}
+	c.timer = time.AfterFunc(grace, func() {
+		if err := c.kill(); err != nil {
+			log.Error("Process %d kill error: %+v", c.cmd.Process.Pid, err)
+		}
+	})
+	return nil
+}
+
+// suspend приостанавливает все процессы дерева
+func (c *procTree) suspend() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.released {
+		return nil
+	}
+	return c.procGroup.suspend(c.cmd)
+}
+
+// resume продолжает приостановленные процессы дерева
+func (c *procTree) resume() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.released {
+		return nil
+	}
+	return c.procGroup.resume(c.cmd)
+}
+
+// kill принудительно завершает все процессы дерева
+func (c *procTree) kill() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.released {
+		return nil
+	}
+	return c.killAll(c.cmd)
+}
+
+// release вызывается после завершения команды: процессы, оставшиеся в дереве, убиваются
+func (c *procTree) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.released {
+		return
+	}
+	c.released = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.killAll(c.cmd)
+	c.close()
+}
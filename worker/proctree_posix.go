@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import (
+	"os/exec"
+	"syscall"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+// procGroup группа процессов с id процесса команды и лимиты ресурсов группы
+type procGroup struct {
+	limitGroup
+}
+
+func (c *procGroup) prepare(cmd *exec.Cmd, limits *config.Limits) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return c.limitGroup.prepare(cmd, limits)
+}
+
+func (c *procGroup) attach(cmd *exec.Cmd) error {
+	return c.apply(cmd)
+}
+
+// signal SIGTERM всей группе
+func (c *procGroup) signal(cmd *exec.Cmd) error {
+	return killGroup(cmd, syscall.SIGTERM)
+}
+
+// killAll SIGKILL всей группе
+func (c *procGroup) killAll(cmd *exec.Cmd) error {
+	return killGroup(cmd, syscall.SIGKILL)
+}
+
+// suspend SIGSTOP всей группе
+func (c *procGroup) suspend(cmd *exec.Cmd) error {
+	return killGroup(cmd, syscall.SIGSTOP)
+}
+
+// resume SIGCONT всей группе
+func (c *procGroup) resume(cmd *exec.Cmd) error {
+	return killGroup(cmd, syscall.SIGCONT)
+}
+
+func killGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		return errors.WithStack(err)
+	}
+	return nil
+}
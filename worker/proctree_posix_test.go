@@ -0,0 +1,120 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+)
+
+// isAlive процесс существует и не зомби
+func isAlive(pid int) bool {
+	buffer, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	var fields = strings.Fields(string(buffer[bytes.LastIndexByte(buffer, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// aliveAfter процесс pid еще жив через timeout. SIGKILL доставляется не мгновенно,
+// поэтому процесс проверяется до timeout, а не один раз
+func aliveAfter(pid int, timeout time.Duration) bool {
+	var deadline = time.Now().Add(timeout)
+	for isAlive(pid) {
+		if time.Now().After(deadline) {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRunCmdStopTree(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	if _, err = os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc not found")
+	}
+	config.InitFromJson(strings.NewReader(`{"stop_grace":1}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+
+	var dir = t.TempDir()
+	var pids = filepath.Join(dir, "pids")
+	var run = func(script string) (time.Duration, []int) {
+		ctx, cancel := context.WithCancel(context.TODO())
+		var task = &Task{ID: "555", WorkingDir: dir}
+		var done = make(chan error)
+		go func() {
+			var stderr bytes.Buffer
+			done <- runCmd(ctx, task, &cmdSpec{name: sh, args: []string{"-c", script}}, true, &stderr)
+		}()
+
+		// ждем запуска дочерних процессов
+		var res []int
+		for range 100 {
+			if buffer, _ := os.ReadFile(pids); bytes.Count(buffer, []byte("\n")) >= 2 {
+				for _, it := range strings.Fields(string(buffer)) {
+					pid, _ := strconv.Atoi(it)
+					res = append(res, pid)
+				}
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if len(res) == 0 {
+			t.Fatal("children not started")
+		}
+		// время считается от остановки, запуск под -race бывает долгим
+		var stopped = time.Now()
+		cancel()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("expected stop error")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("command not stopped")
+		}
+		if task.proc == nil {
+			t.Error("task.proc not set")
+		}
+		os.Remove(pids)
+		return time.Since(stopped), res
+	}
+
+	// обертка запускает дочерние процессы, которые держат stderr
+	elapsed, children := run(`sleep 60 & echo $! >> pids; sh -c 'sleep 60' & echo $! >> pids; wait`)
+	for _, pid := range children {
+		if aliveAfter(pid, 2*time.Second) {
+			t.Errorf("child %d alive after stop", pid)
+		}
+	}
+	// мягкая остановка не ждет kill через stop_grace
+	if elapsed >= time.Second {
+		t.Errorf("graceful stop took %s", elapsed)
+	}
+
+	// процессы игнорируют SIGTERM - kill через stop_grace
+	elapsed, children = run(`trap '' TERM; sh -c 'trap "" TERM; sleep 60' & echo $! >> pids; sleep 60 & echo $! >> pids; wait`)
+	for _, pid := range children {
+		if aliveAfter(pid, 2*time.Second) {
+			t.Errorf("child %d alive after kill", pid)
+		}
+	}
+	if elapsed < time.Second {
+		t.Errorf("kill before stop_grace %s", elapsed)
+	}
+}
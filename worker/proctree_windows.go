@@ -0,0 +1,239 @@
+//go:build windows
+// +build windows
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+// jobMsgJobMemoryLimit сообщение completion port о превышении JobMemoryLimit (JOB_OBJECT_MSG_JOB_MEMORY_LIMIT)
+const jobMsgJobMemoryLimit = 10
+
+// jobAssociateCompletionPort JOBOBJECT_ASSOCIATE_COMPLETION_PORT
+type jobAssociateCompletionPort struct {
+	CompletionKey  uintptr
+	CompletionPort windows.Handle
+}
+
+// jobProcessIdList JOBOBJECT_BASIC_PROCESS_ID_LIST на jobMaxProcesses процессов
+type jobProcessIdList struct {
+	NumberOfAssignedProcesses uint32
+	NumberOfProcessIdsInList  uint32
+	ProcessIdList             [jobMaxProcesses]uintptr
+}
+
+const jobMaxProcesses = 256
+
+var (
+	modntdll             = windows.NewLazySystemDLL("ntdll.dll")
+	procNtSuspendProcess = modntdll.NewProc("NtSuspendProcess")
+	procNtResumeProcess  = modntdll.NewProc("NtResumeProcess")
+)
+
+// priorityClass классы приоритета для приоритетов limits
+var priorityClass = map[string]uint32{
+	PriorityIdle:        windows.IDLE_PRIORITY_CLASS,
+	PriorityBelowNormal: windows.BELOW_NORMAL_PRIORITY_CLASS,
+	PriorityNormal:      windows.NORMAL_PRIORITY_CLASS,
+	PriorityAboveNormal: windows.ABOVE_NORMAL_PRIORITY_CLASS,
+	PriorityHigh:        windows.HIGH_PRIORITY_CLASS,
+}
+
+// procGroup Job Object, в который входят команда и все ее дочерние процессы.
+// При закрытии job оставшиеся процессы завершаются (JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE).
+// Лимиты памяти, процессоров и приоритета задаются для всего job.
+type procGroup struct {
+	limits *config.Limits
+	job    windows.Handle
+	// port completion port job для сообщения о превышении памяти
+	port windows.Handle
+}
+
+// prepare новая группа процессов консоли, чтобы Ctrl+Break получила только команда.
+// Процесс запускается приостановленным и продолжается в attach после добавления в job,
+// поэтому все его дочерние процессы попадают в job.
+func (c *procGroup) prepare(cmd *exec.Cmd, limits *config.Limits) error {
+	c.limits = limits
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.CREATE_SUSPENDED}
+	return nil
+}
+
+// attach добавляет приостановленный процесс команды в job с лимитами и продолжает его.
+// Процесс продолжается и при ошибке job, тогда он работает без лимитов.
+// Если продолжить процесс не удалось, то он убивается, иначе команда не завершится.
+func (c *procGroup) attach(cmd *exec.Cmd) error {
+	var err = c.assign(cmd)
+	if resumeErr := resumeProcess(cmd.Process.Pid); resumeErr != nil {
+		cmd.Process.Kill()
+		return resumeErr
+	}
+	return err
+}
+
+// resumeProcess продолжает процесс, запущенный с CREATE_SUSPENDED
+func resumeProcess(pid int) error {
+	process, err := windows.OpenProcess(windows.PROCESS_SUSPEND_RESUME, false, uint32(pid))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer windows.CloseHandle(process)
+	if status, _, _ := procNtResumeProcess.Call(uintptr(process)); status != 0 {
+		return errors.Errorf("NtResumeProcess pid %d status 0x%x", pid, status)
+	}
+	return nil
+}
+
+// assign создает job с лимитами и добавляет в него процесс команды
+func (c *procGroup) assign(cmd *exec.Cmd) error {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var info = windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if c.limits.MaxMemory > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_JOB_MEMORY
+		info.JobMemoryLimit = uintptr(c.limits.MaxMemory)
+	}
+	if len(c.limits.CpuAffinity) > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_AFFINITY
+		for _, cpu := range c.limits.CpuAffinity {
+			info.BasicLimitInformation.Affinity |= 1 << cpu
+		}
+	}
+	if class, ok := priorityClass[c.limits.Priority]; ok {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_PRIORITY_CLASS
+		info.BasicLimitInformation.PriorityClass = class
+	}
+	if _, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return errors.WithStack(err)
+	}
+	c.job = job
+
+	if c.limits.MaxMemory > 0 {
+		if err = c.associatePort(); err != nil {
+			return err
+		}
+	}
+
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer windows.CloseHandle(process)
+	return errors.WithStack(windows.AssignProcessToJobObject(job, process))
+}
+
+// associatePort подключает к job completion port, чтобы узнать о превышении памяти
+func (c *procGroup) associatePort() error {
+	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 1)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var info = jobAssociateCompletionPort{CompletionKey: uintptr(c.job), CompletionPort: port}
+	if _, err = windows.SetInformationJobObject(c.job, windows.JobObjectAssociateCompletionPortInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(port)
+		return errors.WithStack(err)
+	}
+	c.port = port
+	return nil
+}
+
+// signal Ctrl+Break группе процессов команды. У сервиса без консоли не доставляется,
+// тогда дерево сразу убивается
+func (c *procGroup) signal(cmd *exec.Cmd) error {
+	return errors.WithStack(windows.GenerateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(cmd.Process.Pid)))
+}
+
+// killAll завершает все процессы job, без job - только процесс команды
+func (c *procGroup) killAll(cmd *exec.Cmd) error {
+	if c.job == 0 {
+		if err := cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+	return errors.WithStack(windows.TerminateJobObject(c.job, 1))
+}
+
+// suspend приостанавливает все процессы job через NtSuspendProcess
+func (c *procGroup) suspend(cmd *exec.Cmd) error {
+	return c.eachProcess(cmd, procNtSuspendProcess)
+}
+
+// resume продолжает все процессы job через NtResumeProcess
+func (c *procGroup) resume(cmd *exec.Cmd) error {
+	return c.eachProcess(cmd, procNtResumeProcess)
+}
+
+// eachProcess вызывает fn ntdll для процессов job, без job - для процесса команды
+func (c *procGroup) eachProcess(cmd *exec.Cmd, fn *windows.LazyProc) error {
+	var pids = []uintptr{uintptr(cmd.Process.Pid)}
+	if c.job != 0 {
+		var list jobProcessIdList
+		if err := windows.QueryInformationJobObject(c.job, windows.JobObjectBasicProcessIdList,
+			uintptr(unsafe.Pointer(&list)), uint32(unsafe.Sizeof(list)), nil); err != nil && err != windows.ERROR_MORE_DATA {
+			return errors.WithStack(err)
+		}
+		pids = list.ProcessIdList[:list.NumberOfProcessIdsInList]
+	}
+
+	var msg []string
+	for _, pid := range pids {
+		process, err := windows.OpenProcess(windows.PROCESS_SUSPEND_RESUME, false, uint32(pid))
+		if err != nil {
+			// процесс мог уже завершиться
+			continue
+		}
+		if status, _, _ := fn.Call(uintptr(process)); status != 0 {
+			msg = append(msg, fmt.Sprintf("%s pid %d status 0x%x", fn.Name, pid, status))
+		}
+		windows.CloseHandle(process)
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, ", "))
+	}
+	return nil
+}
+
+// violation LimitError, если job сообщил о превышении JobMemoryLimit
+func (c *procGroup) violation() error {
+	if c.port == 0 {
+		return nil
+	}
+	for {
+		var msg uint32
+		var key uintptr
+		var overlapped *windows.Overlapped
+		if err := windows.GetQueuedCompletionStatus(c.port, &msg, &key, &overlapped, 0); err != nil {
+			return nil
+		}
+		if msg == jobMsgJobMemoryLimit {
+			return &LimitError{Limit: LimitMemory, Msg: fmt.Sprintf("процессы команды превысили %d байт", c.limits.MaxMemory)}
+		}
+	}
+}
+
+func (c *procGroup) close() {
+	if c.job != 0 {
+		windows.CloseHandle(c.job)
+		c.job = 0
+	}
+	if c.port != 0 {
+		windows.CloseHandle(c.port)
+		c.port = 0
+	}
+}
@@ -0,0 +1,194 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+var (
+	// ErrRerunState перезапустить можно только завершенное или упавшее задание
+	ErrRerunState = errors.New("Задание еще выполняется")
+	// ErrRerunFiles файлы задания, нужные для перезапуска с этапа, уже удалены
+	ErrRerunFiles = errors.New("Файлы задания для перезапуска с этапа уже удалены")
+)
+
+// ParseStage этап, с которого перезапускается задание: download, process, verify, saving
+func ParseStage(name string) (StateCode, bool) {
+	for _, state := range []StateCode{DOWNLOAD, PROCESS, VERIFY, SAVING} {
+		if strings.EqualFold(name, state.String()) {
+			return state, true
+		}
+	}
+	return CREATE, false
+}
+
+// newTaskID случайный ключ задания той же длины, что и хеш запроса
+func newTaskID() string {
+	var buffer = make([]byte, 32)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// Clone копия завершенного (FINISH) или упавшего (ERROR) задания с новым ключом для повторного запуска.
+// С этапа process копия получает входящие файлы задания, с verify и saving - его результаты,
+// они доступны, пока задание хранится в агенте. Копия не запускается.
+func (c *Worker) Clone(id string, from StateCode) (*Task, error) {
+	task, ok := c.store.Load(id)
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if state := task.GetState(); state != FINISH && state != ERROR {
+		return nil, ErrRerunState
+	}
+	if from == VERIFY && task.Verify == nil {
+		return nil, errors.New("У задания нет проверок verify")
+	}
+
+	var res = task.clone(newTaskID())
+	if from == CREATE || from == DOWNLOAD {
+		if len(task.Uploads) > 0 {
+			var names []string
+			for _, it := range task.Uploads {
+				names = append(names, it.Name)
+			}
+			res.AddUploads(names)
+		}
+		return res, nil
+	}
+
+	res.from = from
+	var err error
+	if from == PROCESS {
+		err = res.linkInputs(task)
+	} else {
+		err = res.linkOutputs(task)
+	}
+	if err != nil {
+		clearFolders(res)
+		return nil, err
+	}
+	log.Info("Task %s cloned to %s from %s", task.ID, res.ID, from)
+	return res, nil
+}
+
+// clone задание с тем же запросом и новым ключом, без результатов обработки
+func (c *Task) clone(id string) *Task {
+	var res = &Task{
+		ID:         id,
+		InDir:      c.InDir,
+		OutDir:     c.OutDir,
+		Urls:       c.Urls,
+		InputMode:  c.InputMode,
+		Cmd:        c.Cmd,
+		Args:       c.Args,
+		OutExt:     c.OutExt,
+		OutGlob:    c.OutGlob,
+		Env:        c.Env,
+		WorkingDir: c.WorkingDir,
+		Stdin:      c.Stdin,
+		Success:    c.Success,
+		Limits:     c.Limits,
+		Vars:       c.Vars,
+		Checksum:   c.Checksum,
+		Verify:     c.Verify,
+		Tags:       c.Tags,
+		Request:    c.Request,
+	}
+	for _, it := range c.Steps {
+		var step = *it
+		step.State = CREATE
+		step.Msg = ""
+		step.Log = ""
+		res.Steps = append(res.Steps, &step)
+	}
+	if c.Workflow != nil {
+		res.Workflow = &Workflow{Parallel: c.Workflow.Parallel}
+		for _, it := range c.Workflow.Nodes {
+			var node = *it
+			node.State = CREATE
+			node.Msg = ""
+			node.Log = ""
+			res.Workflow.Nodes = append(res.Workflow.Nodes, &node)
+		}
+	}
+	for _, it := range c.Destinations {
+		var dst = *it
+		dst.State = CREATE
+		dst.Msg = ""
+		dst.Files = nil
+		res.Destinations = append(res.Destinations, &dst)
+	}
+	return res
+}
+
+// linkInputs входящие файлы задания task под именами копии
+func (c *Task) linkInputs(task *Task) error {
+	if len(task.Files) == 0 {
+		return ErrRerunFiles
+	}
+	for idx, fileName := range task.Files {
+		var name = c.nextFileName()
+		if err := linkFile(filepath.Join(task.InDir, fileName), filepath.Join(c.InDir, name)); err != nil {
+			return err
+		}
+		var source string
+		if idx < len(task.Sources) {
+			source = task.Sources[idx]
+		}
+		c.addFile(name, source)
+	}
+	return nil
+}
+
+// linkOutputs результаты команд задания task под именами копии: ключ задания в начале имени заменяется ключом копии
+func (c *Task) linkOutputs(task *Task) error {
+	if len(task.Outputs) == 0 {
+		return ErrRerunFiles
+	}
+	for _, dir := range task.outDirs {
+		rel, err := filepath.Rel(task.GetOutDir(), dir)
+		if err != nil || !strings.HasPrefix(rel, task.ID) {
+			return errors.Errorf("папка результатов %s не относится к заданию %s", dir, task.ID)
+		}
+		if err = c.makeOutDir(filepath.Join(c.GetOutDir(), c.ID+strings.TrimPrefix(rel, task.ID))); err != nil {
+			return err
+		}
+	}
+	for _, out := range task.Outputs {
+		// файлы с суммами и манифест копия пишет заново
+		if isChecksumFile(task, out) {
+			continue
+		}
+		if !strings.HasPrefix(out.Name, task.ID) {
+			return errors.Errorf("результат %s не относится к заданию %s", out.Name, task.ID)
+		}
+		var name = c.ID + strings.TrimPrefix(out.Name, task.ID)
+		var filePath = filepath.Join(c.GetOutDir(), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := linkFile(out.Path, filePath); err != nil {
+			return err
+		}
+		c.Outputs = append(c.Outputs, &OutFile{Name: name, Path: filePath})
+	}
+	return nil
+}
+
+// linkFile жесткая ссылка на файл, если не получилось - копия
+func linkFile(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return ErrRerunFiles
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(context.Background(), src, dst)
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWorkerClone(t *testing.T) {
+	var w, sh = runWorker(t)
+	var saveDir = t.TempDir()
+	var task = shTask(t, sh, "401", t.TempDir(), "cat {input} {input} > {output}")
+	task.Sources = []string{"a.mp4"}
+	task.Destinations = []*Destination{{Type: DestDir, Dir: saveDir}}
+	task.Checksum = ChecksumOptions{Sidecar: true, Manifest: true}
+
+	if _, err := w.Clone("missing", CREATE); err != ErrTaskNotFound {
+		t.Errorf("missing err %v", err)
+	}
+	w.ExecTask(task)
+	waitState(t, task, FINISH)
+	var sidecar = filepath.Join(task.GetOutDir(), "401_0.sha256")
+	sum, _ := os.ReadFile(sidecar)
+
+	// с process: входящий файл задания, команда выполняется заново
+	clone, err := w.Clone(task.ID, PROCESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.ID == task.ID || len(clone.ID) != 64 || clone.Files[0] != clone.ID+"_0" || clone.Sources[0] != "a.mp4" {
+		t.Fatalf("clone %s files %v sources %v", clone.ID, clone.Files, clone.Sources)
+	}
+	w.ExecTask(clone)
+	waitState(t, clone, FINISH)
+	if buffer, _ := os.ReadFile(filepath.Join(saveDir, clone.ID+"_0")); string(buffer) != "xx" {
+		t.Errorf("clone output %q", buffer)
+	}
+
+	// с saving: результаты задания сохраняются без обработки
+	os.Remove(filepath.Join(task.InDir, "401_0"))
+	if _, err = w.Clone(task.ID, PROCESS); err != ErrRerunFiles {
+		t.Errorf("removed inputs err %v", err)
+	}
+	clone, err = w.Clone(task.ID, SAVING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.ExecTask(clone)
+	waitState(t, clone, FINISH)
+	if buffer, _ := os.ReadFile(filepath.Join(saveDir, clone.ID+"_0")); string(buffer) != "xx" {
+		t.Errorf("saved output %q", buffer)
+	}
+	// файлы с суммами копия пишет заново, не через ссылки на файлы задания
+	if buffer, _ := os.ReadFile(sidecar); len(sum) == 0 || string(buffer) != string(sum) {
+		t.Errorf("task sidecar %q, was %q", buffer, sum)
+	}
+	var names []string
+	for _, out := range clone.Outputs {
+		names = append(names, out.Name)
+	}
+	if !slices.Equal(names, []string{clone.ID + "_0", clone.ID + "_0.sha256", clone.ID + "_manifest.json"}) {
+		t.Errorf("clone outputs %v", names)
+	}
+	if _, err = w.Clone(task.ID, VERIFY); err == nil {
+		t.Error("verify without checks")
+	}
+}
+
+func TestParseStage(t *testing.T) {
+	if state, ok := ParseStage("Process"); !ok || state != PROCESS {
+		t.Errorf("process %s", state)
+	}
+	if _, ok := ParseStage("finish"); ok {
+		t.Error("finish is not a stage")
+	}
+}
@@ -0,0 +1,195 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+	"mediamagi.ru/win-file-agent/s3"
+)
+
+const (
+	DestS3 = "s3"
+
+	s3Attempts   = 5
+	s3RetryDelay = 5 * time.Second
+)
+
+// S3 настройки S3-совместимого хранилища назначения.
+// Пустые endpoint, region и ключи берутся из профиля s3 в конфиге.
+type S3 struct {
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	Bucket    string `json:"bucket"`
+	// PartSize размер части multipart загрузки в байтах, по умолчанию 16MiB
+	PartSize int64 `json:"part_size,omitempty"`
+	// Concurrency количество частей, загружаемых параллельно, по умолчанию 4
+	Concurrency int `json:"concurrency,omitempty"`
+	// NoVerify не сверять ETag с md5 загруженных данных (для хранилищ с шифрованием SSE-KMS/SSE-C)
+	NoVerify bool `json:"no_verify,omitempty"`
+}
+
+func (c *S3) client() *s3.Client {
+	var profile = config.Load().S3
+	var client = &s3.Client{
+		Endpoint: profile.Endpoint,
+		Region:   profile.Region,
+		Cred:     s3.Credentials{AccessKey: profile.AccessKey, SecretKey: profile.SecretKey},
+	}
+	if c == nil {
+		return client
+	}
+	if len(c.Endpoint) > 0 {
+		client.Endpoint = c.Endpoint
+	}
+	if len(c.Region) > 0 {
+		client.Region = c.Region
+	}
+	if len(c.AccessKey) > 0 {
+		client.Cred = s3.Credentials{AccessKey: c.AccessKey, SecretKey: c.SecretKey}
+	}
+	return client
+}
+
+// s3Retry повторяет fn до s3Attempts раз. В fn передается признак повторной попытки.
+// Ошибки доступа и отсутствия объекта не повторяются.
+func s3Retry(ctx context.Context, taskID, name string, fn func(resume bool) error) error {
+	var resume = false
+	for attempt := 1; ; attempt++ {
+		var err = fn(resume)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= s3Attempts || s3StatusBelow(err, http.StatusInternalServerError) {
+			return err
+		}
+
+		log.Error("Task %s s3 %s attempt %d/%d failed: %+v", taskID, name, attempt, s3Attempts, err)
+		resume = true
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * s3RetryDelay):
+		}
+	}
+}
+
+// s3StatusBelow ошибка хранилища с http статусом меньше status
+func s3StatusBelow(err error, status int) bool {
+	s3Err, ok := errors.Cause(err).(*s3.Error)
+	return ok && s3Err.StatusCode < status
+}
+
+// s3Sink загрузка результатов в S3-совместимое хранилище.
+// Большие файлы загружаются частями, после обрыва догружаются недостающие части.
+// После загрузки ETag объекта сверяется с md5 данных.
+type s3Sink struct{}
+
+func (s3Sink) ValidateDest(dst *Destination) error {
+	if dst.S3 == nil || len(dst.S3.Bucket) == 0 {
+		return errors.New("Не задан bucket s3")
+	}
+	if len(dst.S3.client().Endpoint) == 0 {
+		return errors.New("Не задан endpoint s3")
+	}
+	return nil
+}
+
+func (s3Sink) Save(ctx context.Context, task *Task, dst *Destination) error {
+	var uploader = &s3.Uploader{
+		Client:      dst.S3.client(),
+		PartSize:    dst.S3.PartSize,
+		Concurrency: dst.S3.Concurrency,
+		Verify:      !dst.S3.NoVerify,
+		// на паузе задания части не загружаются
+		Wait: waitPause,
+	}
+
+	for _, out := range task.Outputs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var key = path.Join(dst.Dir, out.Name)
+		var err = s3Retry(ctx, task.ID, "upload "+key, func(bool) error {
+			_, err := uploader.Upload(ctx, dst.S3.Bucket, key, out.Path)
+			return err
+		})
+		if err != nil {
+			return errors.Errorf("s3 upload Task %s err %+v bucket %s key %s", task.ID, err, dst.S3.Bucket, key)
+		}
+		log.Debug("Task %s s3Sink successfully, bucket %s key %s\n", task.ID, dst.S3.Bucket, key)
+	}
+	return nil
+}
+
+// s3Fetcher скачивание по ссылкам s3://bucket/key из хранилища профиля s3 конфига.
+// После обрыва скачивание продолжается с размера локального файла.
+type s3Fetcher struct{}
+
+func (s3Fetcher) ValidateUrl(src *url.URL) error {
+	if src.Host == "" || len(strings.Trim(src.Path, "/")) == 0 {
+		return errors.Errorf("Некорректный URL: %s", src.Redacted())
+	}
+	return nil
+}
+
+func (s3Fetcher) Fetch(ctx context.Context, task *Task, src *url.URL, dst string) error {
+	var client = (*S3)(nil).client()
+	if len(client.Endpoint) == 0 {
+		return errors.New("Не задан endpoint s3 в конфиге")
+	}
+	var bucket, key = src.Host, strings.TrimPrefix(src.Path, "/")
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Errorf("os.Create Task %s err %+v filePath %s", task.ID, err, dst)
+	}
+	defer out.Close()
+
+	return s3Retry(ctx, task.ID, "get "+src.String(), func(bool) error {
+		offset, err := out.Seek(0, io.SeekEnd)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if offset > 0 {
+			log.Info("Task %s s3 get resume %s from %d", task.ID, src, offset)
+		}
+
+		body, info, err := client.GetObject(ctx, bucket, key, offset)
+		if err != nil {
+			if s3Err, ok := errors.Cause(err).(*s3.Error); ok && offset > 0 &&
+				s3Err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				// файл уже скачан целиком
+				return nil
+			}
+			return err
+		}
+		defer body.Close()
+
+		n, err := io.Copy(out, &ctxReader{ctx: ctx, r: body})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if info.Size >= 0 && n != info.Size {
+			return errors.Errorf("s3 get Task %s %s size mismatch: got %d expected %d", task.ID, src, n, info.Size)
+		}
+		return nil
+	})
+}
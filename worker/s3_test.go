@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/s3"
+	"mediamagi.ru/win-file-agent/s3/s3test"
+)
+
+func TestS3SinkAndFetcher(t *testing.T) {
+	var cred = s3.Credentials{AccessKey: "minio", SecretKey: "minio123"}
+	var srv = s3test.NewServer(cred)
+	defer srv.Close()
+
+	config.InitFromJson(strings.NewReader(`{"s3":{"endpoint":"` + srv.URL + `","access_key":"minio","secret_key":"minio123"}}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+
+	var outPath = filepath.Join(t.TempDir(), "222_0.mp4")
+	if err := os.WriteFile(outPath, []byte("s3 result"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var dst = &Destination{Type: DestS3, Dir: "out", S3: &S3{Bucket: "media"}}
+	if err := ValidateDest(dst); err != nil {
+		t.Fatal(err)
+	}
+	var task = &Task{
+		ID:           "222",
+		Outputs:      []*OutFile{{Name: "222_0.mp4", Path: outPath}},
+		Destinations: []*Destination{dst},
+	}
+	if err := saveOutputs(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := srv.Object("media", "out/222_0.mp4"); string(data) != "s3 result" {
+		t.Errorf("object %q", data)
+	}
+
+	var inPath = filepath.Join(t.TempDir(), "in.mp4")
+	if err := ValidateUrl("s3://media/out/222_0.mp4", InputModeUrls); err != nil {
+		t.Fatal(err)
+	}
+	var src, _ = url.Parse("s3://media/out/222_0.mp4")
+	if err := (s3Fetcher{}).Fetch(context.TODO(), task, src, inPath); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(inPath); string(data) != "s3 result" {
+		t.Errorf("fetched %q", data)
+	}
+
+	var buffer, _ = json.Marshal(&Destination{Type: DestS3, S3: &S3{Bucket: "b", SecretKey: "secret"}})
+	if strings.Contains(string(buffer), `"secret"`) {
+		t.Errorf("secret in json: %s", buffer)
+	}
+}
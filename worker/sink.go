@@ -0,0 +1,254 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// Sink сохраняет исходящие файлы задания (task.Outputs) в место назначения.
+// Реализации регистрируются по типу назначения через RegisterSink.
+type Sink interface {
+	Save(ctx context.Context, task *Task, dst *Destination) error
+}
+
+// DestValidator проверяет настройки назначения при создании задания.
+type DestValidator interface {
+	ValidateDest(dst *Destination) error
+}
+
+const (
+	DestDir = "dir"
+	DestFtp = "ftp"
+)
+
+// Destination место сохранения результатов задания
+type Destination struct {
+	Type string `json:"type"`
+	// Dir папка для типа dir, папка на сервере для ftp или префикс ключа для s3
+	Dir string `json:"dir,omitempty"`
+	Ftp *Ftp   `json:"ftp,omitempty"`
+	S3  *S3    `json:"s3,omitempty"`
+	// Http настройки для типа http
+	Http *Http `json:"http,omitempty"`
+	// Params параметры для зарегистрированных извне Sink
+	Params map[string]string `json:"params,omitempty"`
+	// Optional ошибка сохранения не переводит задание в ERROR
+	Optional bool `json:"optional,omitempty"`
+	// результат сохранения
+	State StateCode `json:"state"`
+	Msg   string    `json:"msg"`
+	// Files результат сохранения по файлам, заполняется назначениями http
+	Files []*DestFile `json:"files,omitempty"`
+}
+
+// DestFile результат сохранения одного файла
+type DestFile struct {
+	Name string `json:"name"`
+	// Code http код ответа, 0 если ответа не было
+	Code int    `json:"code"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+// MarshalJSON скрывает пароли при выдаче задания
+func (c Destination) MarshalJSON() ([]byte, error) {
+	type destination Destination
+	var d = destination(c)
+	if d.Ftp != nil {
+		var f = *d.Ftp
+		f.Pass = hiddenSecret(f.Pass)
+		d.Ftp = &f
+	}
+	if d.Http != nil {
+		d.Http = d.Http.hidden()
+	}
+	if d.S3 != nil {
+		var s = *d.S3
+		s.SecretKey = hiddenSecret(s.SecretKey)
+		d.S3 = &s
+	}
+	return json.Marshal(d)
+}
+
+func hiddenSecret(val string) string {
+	if len(val) == 0 {
+		return val
+	}
+	return "***"
+}
+
+var sinks = struct {
+	lock sync.RWMutex
+	data map[string]Sink
+}{data: make(map[string]Sink)}
+
+func init() {
+	RegisterSink(DestDir, dirSink{})
+	RegisterSink(DestFtp, ftpSink{})
+	RegisterSink(DestS3, s3Sink{})
+	RegisterSink(DestHttp, httpSink{})
+}
+
+// RegisterSink регистрирует Sink для типа назначения, заменяя существующий.
+func RegisterSink(destType string, s Sink) {
+	sinks.lock.Lock()
+	sinks.data[strings.ToLower(destType)] = s
+	sinks.lock.Unlock()
+}
+
+func getSink(destType string) (Sink, bool) {
+	sinks.lock.RLock()
+	s, ok := sinks.data[strings.ToLower(destType)]
+	sinks.lock.RUnlock()
+	return s, ok
+}
+
+// ValidateDest проверяет, что для назначения есть Sink и его настройки корректны.
+func ValidateDest(dst *Destination) error {
+	s, ok := getSink(dst.Type)
+	if !ok {
+		return errors.Errorf("Неизвестный тип назначения: %s", dst.Type)
+	}
+	if v, ok := s.(DestValidator); ok {
+		return v.ValidateDest(dst)
+	}
+	return nil
+}
+
+// saveOutputs сохраняет результаты во все назначения задания параллельно.
+func saveOutputs(ctx context.Context, task *Task) error {
+	var wg sync.WaitGroup
+	var errs = make([]error, len(task.Destinations))
+	for idx, dst := range task.Destinations {
+		task.update(func() { dst.State = SAVING })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var err error
+			if s, ok := getSink(dst.Type); ok {
+				err = s.Save(ctx, task, dst)
+			} else {
+				err = errors.Errorf("unknown destination type %s", dst.Type)
+			}
+			if err != nil {
+				log.Error("Task %s destination %d %s error: %+v", task.ID, idx, dst.Type, err)
+				task.update(func() {
+					dst.State = ERROR
+					dst.Msg = err.Error()
+				})
+				if !dst.Optional {
+					errs[idx] = errors.Wrapf(err, "destination %d %s", idx, dst.Type)
+				}
+				return
+			}
+			task.update(func() { dst.State = FINISH })
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirSink копирует результаты в локальную или сетевую папку
+type dirSink struct{}
+
+func (dirSink) ValidateDest(dst *Destination) error {
+	if len(dst.Dir) == 0 {
+		return errors.New("Не задана папка назначения dir")
+	}
+	return nil
+}
+
+func (dirSink) Save(ctx context.Context, task *Task, dst *Destination) error {
+	for _, out := range task.Outputs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var filePath = filepath.Join(dst.Dir, filepath.FromSlash(out.Name))
+		if filepath.Clean(filePath) == filepath.Clean(out.Path) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := copyFile(ctx, out.Path, filePath); err != nil {
+			return err
+		}
+		log.Debug("Task %s dirSink successfully, filePath %s\n", task.ID, filePath)
+	}
+	return nil
+}
+
+func copyFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, &ctxReader{ctx: ctx, r: in}); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(out.Close())
+}
+
+// ftpSink загрузка результатов на ftp с докачкой и проверкой контрольной суммы
+type ftpSink struct{}
+
+func (ftpSink) ValidateDest(dst *Destination) error {
+	if dst.Ftp == nil || len(dst.Ftp.Addr) == 0 {
+		return errors.New("Не задан адрес ftp сервера")
+	}
+	return nil
+}
+
+func (ftpSink) Save(ctx context.Context, task *Task, dst *Destination) error {
+	var fc = &ftpConn{taskID: task.ID, cfg: dst.Ftp}
+	defer fc.close()
+
+	for _, out := range task.Outputs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var name = out.Name
+		if len(dst.Dir) > 0 {
+			name = path.Join(dst.Dir, name)
+		}
+		if err := fc.store(ctx, name, out.Path); err != nil {
+			return err
+		}
+		if err := fc.verify(ctx, name, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+const (
+	DestHttp = "http"
+
+	// шаблоны в Http.Url
+	TASK_ID   = "{task_id}"
+	FILE_NAME = "{file_name}"
+
+	httpAttempts = 5
+)
+
+// httpRetryDelay пауза перед повтором загрузки, растет с каждой попыткой
+var httpRetryDelay = 5 * time.Second
+
+// httpPublicHeaders заголовки без секретов, значения остальных скрываются при выдаче задания
+var httpPublicHeaders = []string{"Accept", "Cache-Control", "Content-Disposition", "Content-Language", "Content-Type", "User-Agent"}
+
+// Http настройки загрузки результатов на http сервер
+type Http struct {
+	// Method PUT (по умолчанию) - тело запроса содержимое файла,
+	// POST - multipart/form-data с файлом в поле Field
+	Method string `json:"method,omitempty"`
+	// Url адрес загрузки, {task_id} и {file_name} заменяются на id задания и имя файла
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Token передается в заголовке Authorization: Bearer
+	Token string `json:"token,omitempty"`
+	// Field имя поля формы для POST, по умолчанию file
+	Field string `json:"field,omitempty"`
+}
+
+func (c *Http) method() string {
+	if len(c.Method) == 0 {
+		return http.MethodPut
+	}
+	return strings.ToUpper(c.Method)
+}
+
+func (c *Http) field() string {
+	if len(c.Field) == 0 {
+		return "file"
+	}
+	return c.Field
+}
+
+func (c *Http) fileUrl(taskID, fileName string) string {
+	var r = strings.NewReplacer(
+		TASK_ID, url.PathEscape(taskID),
+		FILE_NAME, escapePath(fileName),
+	)
+	return r.Replace(c.Url)
+}
+
+// escapePath экранирует сегменты пути, сохраняя разделители /
+func escapePath(p string) string {
+	var segs = strings.Split(p, "/")
+	for idx, it := range segs {
+		segs[idx] = url.PathEscape(it)
+	}
+	return strings.Join(segs, "/")
+}
+
+// hidden копия настроек со скрытыми токеном и значениями заголовков, кроме httpPublicHeaders
+func (c *Http) hidden() *Http {
+	var h = *c
+	h.Token = hiddenSecret(h.Token)
+	if len(h.Headers) > 0 {
+		h.Headers = make(map[string]string, len(c.Headers))
+		for k, v := range c.Headers {
+			if !slices.ContainsFunc(httpPublicHeaders, func(it string) bool { return strings.EqualFold(it, k) }) {
+				v = hiddenSecret(v)
+			}
+			h.Headers[k] = v
+		}
+	}
+	return &h
+}
+
+// httpSink загрузка результатов на http сервер, каждый файл отдельным запросом.
+// Файл передается потоком (chunked), успехом считается ответ 2xx.
+// После обрыва соединения, ответа 5xx или 429 файл загружается заново, до httpAttempts раз.
+// Коды ответов сохраняются в Destination.Files.
+type httpSink struct{}
+
+func (httpSink) ValidateDest(dst *Destination) error {
+	if dst.Http == nil || len(dst.Http.Url) == 0 {
+		return errors.New("Не задан url http назначения")
+	}
+	switch dst.Http.method() {
+	case http.MethodPut, http.MethodPost:
+	default:
+		return errors.Errorf("Неподдерживаемый метод http назначения: %s", dst.Http.Method)
+	}
+	u, err := url.Parse(dst.Http.fileUrl("id", "file"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("Некорректный url http назначения: %s", dst.Http.Url)
+	}
+	return nil
+}
+
+func (httpSink) Save(ctx context.Context, task *Task, dst *Destination) error {
+	// Files выдаются в задании во время загрузки, поэтому меняются под stateLock
+	task.update(func() { dst.Files = make([]*DestFile, 0, len(task.Outputs)) })
+	for _, out := range task.Outputs {
+		var name = out.Name
+		var res = &DestFile{Name: name}
+		task.update(func() { dst.Files = append(dst.Files, res) })
+
+		code, err := httpRetry(ctx, task.ID, "upload "+name, func() (int, error) {
+			return httpUpload(ctx, task, dst.Http, name, out.Path)
+		})
+		task.update(func() {
+			res.Code = code
+			if err != nil {
+				res.Msg = err.Error()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		log.Debug("Task %s httpSink successfully, fileName %s code %d\n", task.ID, name, code)
+	}
+	return nil
+}
+
+// httpRetry повторяет fn до httpAttempts раз, пока нет ответа или сервер отвечает 5xx или 429.
+// Возвращает код ответа последней попытки.
+func httpRetry(ctx context.Context, taskID, name string, fn func() (int, error)) (int, error) {
+	for attempt := 1; ; attempt++ {
+		code, err := fn()
+		if err == nil {
+			return code, nil
+		}
+		if ctx.Err() != nil {
+			return code, ctx.Err()
+		}
+		var temporary = code == 0 || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+		if attempt >= httpAttempts || !temporary {
+			return code, err
+		}
+
+		log.Error("Task %s http %s attempt %d/%d failed: %+v", taskID, name, attempt, httpAttempts, err)
+
+		select {
+		case <-ctx.Done():
+			return code, ctx.Err()
+		case <-time.After(time.Duration(attempt) * httpRetryDelay):
+		}
+	}
+}
+
+// httpUpload отправляет файл и возвращает код ответа
+func httpUpload(ctx context.Context, task *Task, cfg *Http, fileName, filePath string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, errors.Errorf("os.Open Task %s err %+v filePath %s", task.ID, err, filePath)
+	}
+	defer file.Close()
+
+	// io.Reader без длины отправляется с Transfer-Encoding: chunked
+	var body io.Reader = &ctxReader{ctx: ctx, r: file}
+	var contentType string
+	if cfg.method() == http.MethodPost {
+		pr, pw := io.Pipe()
+		var mw = multipart.NewWriter(pw)
+		contentType = mw.FormDataContentType()
+		go func() {
+			part, err := mw.CreateFormFile(cfg.field(), path.Base(fileName))
+			if err == nil {
+				_, err = io.Copy(part, &ctxReader{ctx: ctx, r: file})
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		body = pr
+	}
+
+	var fileUrl = cfg.fileUrl(task.ID, fileName)
+	req, err := http.NewRequestWithContext(ctx, cfg.method(), fileUrl, body)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, errors.Errorf("http upload Task %s err %+v fileName %s", task.ID, err, fileName)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.Errorf("http upload Task %s fileName %s status %s", task.ID, fileName, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,183 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+func TestSaveOutputs(t *testing.T) {
+	var outDir = t.TempDir()
+	var archive = t.TempDir()
+	var outPath = filepath.Join(outDir, "111_0.mp4")
+	if err := os.WriteFile(outPath, []byte("result"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterSink("fail", failSink{})
+	var task = &Task{
+		ID:      "111",
+		OutDir:  outDir,
+		Outputs: []*OutFile{{Name: "111_0.mp4", Path: outPath}},
+		Destinations: []*Destination{
+			{Type: DestDir, Dir: archive},
+			{Type: "fail", Optional: true},
+		},
+	}
+	if err := saveOutputs(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Destinations[0].State != FINISH || task.Destinations[1].State != ERROR {
+		t.Errorf("states %v %v", task.Destinations[0].State, task.Destinations[1].State)
+	}
+	buffer, err := os.ReadFile(filepath.Join(archive, "111_0.mp4"))
+	if err != nil || string(buffer) != "result" {
+		t.Errorf("archive %q err %v", buffer, err)
+	}
+
+	task.Destinations[1].Optional = false
+	if err = saveOutputs(context.TODO(), task); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDestinationJson(t *testing.T) {
+	var buffer, _ = json.Marshal(&Destination{Type: DestFtp, Ftp: &Ftp{Addr: "addr", Login: "login", Pass: "secret"}})
+	if strings.Contains(string(buffer), "secret") {
+		t.Errorf("password in json: %s", buffer)
+	}
+
+	if err := ValidateDest(&Destination{Type: "unknown"}); err == nil {
+		t.Error("expected unknown type error")
+	}
+	if err := ValidateDest(&Destination{Type: DestFtp}); err == nil {
+		t.Error("expected ftp addr error")
+	}
+}
+
+type failSink struct{}
+
+func (failSink) Save(ctx context.Context, task *Task, dst *Destination) error {
+	return errors.New("fail")
+}
+
+func TestHttpSink(t *testing.T) {
+	var delay = httpRetryDelay
+	httpRetryDelay = time.Millisecond
+	defer func() { httpRetryDelay = delay }()
+
+	var lock sync.Mutex
+	var received = make(map[string]string)
+	var attempts = make(map[string]int)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts[r.URL.Path]++
+		var attempt = attempts[r.URL.Path]
+		lock.Unlock()
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Custom") != "1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.Contains(r.URL.Path, "fail") || (strings.Contains(r.URL.Path, "flaky") && attempt == 1) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var data []byte
+		if r.Method == http.MethodPost {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ = io.ReadAll(file)
+		} else {
+			data, _ = io.ReadAll(r.Body)
+			if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+				w.WriteHeader(http.StatusLengthRequired)
+				return
+			}
+		}
+		lock.Lock()
+		received[r.Method+" "+r.URL.Path] = string(data)
+		lock.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	var outPath = filepath.Join(t.TempDir(), "333_0.mp4")
+	if err := os.WriteFile(outPath, []byte("http result"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var task = &Task{
+		ID:      "333",
+		Outputs: []*OutFile{{Name: "333_0.mp4", Path: outPath}},
+	}
+	var cfg = Http{
+		Url:     srv.URL + "/ingest/{task_id}/{file_name}",
+		Headers: map[string]string{"X-Custom": "1"},
+		Token:   "token",
+	}
+	var post = cfg
+	post.Method = "post"
+	var fail = cfg
+	fail.Url = srv.URL + "/fail/{file_name}"
+	var flaky = cfg
+	flaky.Url = srv.URL + "/flaky/{file_name}"
+	var denied = cfg
+	denied.Url = srv.URL + "/denied/{file_name}"
+	denied.Token = "other"
+	task.Destinations = []*Destination{
+		{Type: DestHttp, Http: &cfg},
+		{Type: DestHttp, Http: &post},
+		{Type: DestHttp, Http: &fail, Optional: true},
+		{Type: DestHttp, Http: &flaky},
+		{Type: DestHttp, Http: &denied, Optional: true},
+	}
+	for _, dst := range task.Destinations {
+		if err := ValidateDest(dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stop = marshalLoop(task)
+	if err := saveOutputs(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	if received["PUT /ingest/333/333_0.mp4"] != "http result" || received["POST /ingest/333/333_0.mp4"] != "http result" {
+		t.Errorf("received %v", received)
+	}
+	if files := task.Destinations[0].Files; len(files) != 1 || files[0].Code != http.StatusCreated {
+		t.Errorf("put files %+v", files)
+	}
+	if files := task.Destinations[2].Files; len(files) != 1 || files[0].Code != http.StatusInternalServerError ||
+		task.Destinations[2].State != ERROR {
+		t.Errorf("fail files %+v", files)
+	}
+
+	// 5xx повторяется до httpAttempts раз, 4xx не повторяется
+	if received["PUT /flaky/333_0.mp4"] != "http result" || attempts["/fail/333_0.mp4"] != httpAttempts ||
+		attempts["/denied/333_0.mp4"] != 1 {
+		t.Errorf("attempts %v", attempts)
+	}
+
+	cfg.Headers["Content-Type"] = "video/mp4"
+	var buffer, _ = json.Marshal(task.Destinations[0])
+	if strings.Contains(string(buffer), `"token":"token"`) || !strings.Contains(string(buffer), `"X-Custom":"***"`) ||
+		!strings.Contains(string(buffer), `"Content-Type":"video/mp4"`) {
+		t.Errorf("headers in json: %s", buffer)
+	}
+	if err := ValidateDest(&Destination{Type: DestHttp, Http: &Http{Url: "ftp://host/{file_name}"}}); err == nil {
+		t.Error("expected url error")
+	}
+}
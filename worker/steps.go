@@ -0,0 +1,287 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// stepLogSize сколько последних байт stderr шага хранится в Step.Log
+const stepLogSize = 4096
+
+// Step шаг цепочки команд задания. Результаты шага передаются следующему шагу
+// как {input}, результаты последнего шага (и шагов с Keep) - результаты задания.
+type Step struct {
+	Name string   `json:"name"`
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+	// Dir рабочая папка команды, по умолчанию working_dir задания
+	Dir    string `json:"dir,omitempty"`
+	OutExt string `json:"out_ext,omitempty"`
+	// Stdin стандартный ввод команды
+	Stdin *Stdin `json:"stdin,omitempty"`
+	// Success правила успешного завершения команды, по умолчанию success задания
+	Success *SuccessPolicy `json:"success,omitempty"`
+	// Outputs шаблон результатов в папке {output_dir}, как outputs задания
+	Outputs string `json:"outputs,omitempty"`
+	// Pass шаблон имен результатов, которые передаются следующему шагу, по умолчанию все
+	Pass string `json:"pass,omitempty"`
+	// Keep результаты шага сохраняются вместе с результатами задания
+	Keep bool `json:"keep,omitempty"`
+	// processing
+	State StateCode `json:"state"`
+	Msg   string    `json:"msg,omitempty"`
+	// Log последние строки stderr команды
+	Log string `json:"log,omitempty"`
+}
+
+func (c *Step) isMultiOut() bool {
+	return len(c.Outputs) > 0 || argsUse(c.Args, "output_dir")
+}
+
+func (c *Step) outGlob() string {
+	if len(c.Outputs) == 0 {
+		return "*"
+	}
+	return c.Outputs
+}
+
+// ValidateSteps проверяет шаги задания, пустые имена заполняются step<номер>
+func ValidateSteps(steps []*Step, vars map[string]string) error {
+	var msg []string
+	for idx, step := range steps {
+		if step == nil {
+			msg = append(msg, fmt.Sprintf("steps[%d]: пустой шаг", idx))
+			continue
+		}
+		if len(step.Name) == 0 {
+			step.Name = fmt.Sprintf("step%d", idx+1)
+		}
+		if len(step.Cmd) == 0 {
+			msg = append(msg, fmt.Sprintf("steps[%d]: не задана команда запуска", idx))
+		}
+		if err := ValidateArgs(step.Args, vars); err != nil {
+			msg = append(msg, fmt.Sprintf("steps[%d]: %s", idx, err))
+		}
+		if err := ValidateProcess(nil, step.Dir, step.Stdin, vars); err != nil {
+			msg = append(msg, fmt.Sprintf("steps[%d]: %s", idx, err))
+		}
+		if err := step.Success.Validate(); err != nil {
+			msg = append(msg, fmt.Sprintf("steps[%d]: %s", idx, err))
+		}
+		for _, pattern := range []string{step.Outputs, step.Pass} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				msg = append(msg, fmt.Sprintf("steps[%d]: некорректный шаблон %s", idx, pattern))
+			}
+		}
+		if len(step.OutExt) > 0 && step.OutExt[0] != '.' {
+			step.OutExt = "." + step.OutExt
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "\n"))
+	}
+	return nil
+}
+
+// stepInput входящий файл шага: номер исходного файла задания и путь
+type stepInput struct {
+	idx  int
+	path string
+}
+
+// executeSteps выполняет шаги задания по очереди, каждый шаг для всех своих входящих файлов.
+// Промежуточные результаты удаляются после выполнения цепочки.
+func executeSteps(ctx context.Context, task *Task) error {
+	var inputs = make([]stepInput, len(task.Files))
+	for idx, fileName := range task.Files {
+		inputs[idx] = stepInput{idx: idx, path: filepath.Join(task.InDir, fileName)}
+	}
+
+	var runner = &outputRunner{task: task, setCmd: true}
+	defer runner.clear()
+
+	for stepIdx, step := range task.Steps {
+		var keep = step.Keep || stepIdx == len(task.Steps)-1
+		task.update(func() { step.State = PROCESS })
+		next, err := runStep(ctx, runner, stepIdx, keep, inputs)
+		if err != nil {
+			task.update(func() {
+				step.State = ERROR
+				step.Msg = err.Error()
+			})
+			if _, ok := limitCause(err); ok {
+				return errors.WithMessagef(err, "step %s", step.Name)
+			}
+			return errors.Errorf("step %s err %+v", step.Name, err)
+		}
+		task.update(func() { step.State = FINISH })
+		log.Debug("Task %s step %s successfully, outputs %d\n", task.ID, step.Name, len(next))
+
+		if len(next) == 0 && stepIdx < len(task.Steps)-1 {
+			return errors.Errorf("step %s не передал файлов следующему шагу", step.Name)
+		}
+		inputs = next
+	}
+	return nil
+}
+
+// runStep выполняет шаг для каждого входящего файла и возвращает входящие файлы следующего шага
+func runStep(ctx context.Context, runner *outputRunner, stepIdx int, keep bool, inputs []stepInput) ([]stepInput, error) {
+	var task = runner.task
+	var step = task.Steps[stepIdx]
+	var stderr = &tailWriter{max: stepLogSize}
+	defer task.update(func() { step.Log = stderr.String() })
+
+	var next []stepInput
+	for idx, in := range inputs {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		var base = fmt.Sprintf("%s_s%d_%d", task.Files[in.idx], stepIdx, idx)
+		outputs, err := runner.run(ctx, step, keep, base, in.idx, []string{in.path}, stderr)
+		if err != nil {
+			return nil, err
+		}
+		next = append(next, step.pass(in.idx, outputs)...)
+	}
+	return next, nil
+}
+
+// pass результаты, которые передаются следующему шагу
+func (c *Step) pass(idx int, outputs []*OutFile) []stepInput {
+	var res []stepInput
+	for _, out := range outputs {
+		if ok, _ := path.Match(c.Pass, path.Base(out.Name)); ok || len(c.Pass) == 0 {
+			res = append(res, stepInput{idx: idx, path: out.Path})
+		}
+	}
+	return res
+}
+
+// outputRunner запускает команды шагов и учитывает их результаты: результаты с keep
+// добавляются в результаты задания, остальные удаляются в clear
+type outputRunner struct {
+	task *Task
+	// setCmd сохранять запущенную команду в task.proc, только если команды не выполняются параллельно
+	setCmd bool
+
+	lock  sync.Mutex
+	temps []string
+}
+
+// run выполняет команду шага для входящих файлов inputs ({input} - первый из них, {inputs} - все).
+// base имя результата, idx номер исходного файла задания для {input.name} и {index}.
+func (c *outputRunner) run(ctx context.Context, step *Step, keep bool, base string, idx int,
+	inputs []string, stderr io.Writer) ([]*OutFile, error) {
+
+	var task = c.task
+	var outDir = filepath.Join(task.GetOutDir(), base)
+	var output = filepath.Join(task.GetOutDir(), base) + step.OutExt
+	var multiOut = step.isMultiOut()
+	if multiOut {
+		output = filepath.Join(outDir, base) + step.OutExt
+		if err := c.addDir(keep, outDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var vars = task.fileVars(idx, inputs[0], output, outDir)
+	args, err := renderArgs(step.Args, vars, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	// результат фиксируется до запуска, чтобы удалить его и при ошибке
+	var outputs = []*OutFile{{Name: base + step.OutExt, Path: output}}
+	if !multiOut {
+		c.add(keep, outputs...)
+	}
+
+	var spec = &cmdSpec{name: step.Cmd, args: args, dir: step.Dir, stdin: step.Stdin, vars: vars,
+		success: step.Success, outputs: []string{output}}
+	if multiOut {
+		spec.outputs = []string{outDir}
+	}
+	if spec.success == nil {
+		spec.success = task.Success
+	}
+	if err = runCmd(ctx, task, spec, c.setCmd, stderr); err != nil {
+		return nil, wrapCmdErr(err, stderr, step.Cmd, args)
+	}
+	if multiOut {
+		if outputs, err = task.globOutputs(outDir, step.outGlob()); err != nil {
+			return nil, err
+		}
+		if keep {
+			c.add(keep, outputs...)
+		}
+	}
+	log.Debug("Task %s step %s exec.Command successfully, cmd %+v, args %+v\n", task.ID, step.Name, step.Cmd, args)
+	return outputs, nil
+}
+
+func (c *outputRunner) add(keep bool, outputs ...*OutFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if keep {
+		c.task.update(func() { c.task.Outputs = append(c.task.Outputs, outputs...) })
+		return
+	}
+	for _, out := range outputs {
+		c.temps = append(c.temps, out.Path)
+	}
+}
+
+func (c *outputRunner) addDir(keep bool, dir string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if keep {
+		return c.task.makeOutDir(dir)
+	}
+	c.temps = append(c.temps, dir)
+	return errors.WithStack(os.MkdirAll(dir, 0755))
+}
+
+// clear удаляет промежуточные результаты
+func (c *outputRunner) clear() {
+	for _, it := range c.temps {
+		if err := os.RemoveAll(it); err != nil {
+			log.Error("Task %s os.RemoveAll error, filePath %s, err %+v\n", c.task.ID, it, err)
+		}
+	}
+}
+
+// tailWriter хранит последние max байт записанного
+type tailWriter struct {
+	max  int
+	lock sync.Mutex
+	buf  []byte
+}
+
+func (c *tailWriter) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.buf = append(c.buf, p...)
+	if len(c.buf) > c.max {
+		c.buf = append(c.buf[:0], c.buf[len(c.buf)-c.max:]...)
+	}
+	return len(p), nil
+}
+
+func (c *tailWriter) String() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return string(c.buf)
+}
@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecuteSteps(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	var inDir, outDir = t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(inDir, "555_0"), []byte("in"), 0644)
+
+	var task = &Task{
+		ID:     "555",
+		InDir:  inDir,
+		OutDir: outDir,
+		Files:  []string{"555_0"},
+		Steps: []*Step{
+			{Cmd: sh, Args: []string{"-c", "cp {input} {output}"}, OutExt: ".a", Keep: true},
+			{Cmd: sh, Args: []string{"-c", "cd {output_dir} && cp {input} x.b && cp {input} y.c"}, Pass: "*.b"},
+			{Cmd: sh, Args: []string{"-c", "cat {input} > {output} && echo done >&2"}, OutExt: ".d"},
+		},
+	}
+	if err = ValidateSteps(task.Steps, nil); err != nil {
+		t.Fatal(err)
+	}
+	var stop = marshalLoop(task)
+	if err = executeTask(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	var names []string
+	for _, out := range task.Outputs {
+		names = append(names, out.Name)
+	}
+	if strings.Join(names, ",") != "555_0_s0_0.a,555_0_s2_0.d" {
+		t.Errorf("outputs %v", names)
+	}
+	if buffer, _ := os.ReadFile(filepath.Join(outDir, "555_0_s2_0.d")); string(buffer) != "in" {
+		t.Errorf("last step output %q", buffer)
+	}
+	// промежуточная папка шага 2 удалена
+	if _, err = os.Stat(filepath.Join(outDir, "555_0_s1_0")); !os.IsNotExist(err) {
+		t.Errorf("temp dir not removed: %v", err)
+	}
+	for _, step := range task.Steps {
+		if step.State != FINISH {
+			t.Errorf("step %s state %s", step.Name, step.State)
+		}
+	}
+	if task.Steps[2].Name != "step3" || task.Steps[2].Log != "done\n" {
+		t.Errorf("step %s log %q", task.Steps[2].Name, task.Steps[2].Log)
+	}
+
+	// ошибка шага
+	task.Outputs = nil
+	task.Steps[1].Args = []string{"-c", "echo broken >&2; exit 3"}
+	if err = executeTask(context.TODO(), task); err == nil {
+		t.Fatal("expected step error")
+	}
+	if task.Steps[1].State != ERROR || task.Steps[1].Log != "broken\n" || len(task.Steps[1].Msg) == 0 {
+		t.Errorf("step %+v", task.Steps[1])
+	}
+}
@@ -0,0 +1,166 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+// SuccessPolicy правила успешного завершения команды. Порядок проверки:
+// совпадение с FailOn - ошибка, совпадение с SucceedOn - успех, иначе код выхода из ExitCodes.
+type SuccessPolicy struct {
+	// ExitCodes коды выхода, которые считаются успехом, по умолчанию [0]
+	ExitCodes []int `json:"exit_codes,omitempty"`
+	// FailOn регулярные выражения на строки stdout и stderr, при совпадении команда завершилась с ошибкой
+	FailOn []string `json:"fail_on,omitempty"`
+	// SucceedOn регулярные выражения на строки stdout и stderr, при совпадении команда завершилась успешно
+	SucceedOn []string `json:"succeed_on,omitempty"`
+	// Messages сообщения об ошибке для кодов выхода, {"2":"Файл поврежден"}
+	Messages map[string]string `json:"messages,omitempty"`
+}
+
+// Validate проверяет регулярные выражения и коды сообщений
+func (c *SuccessPolicy) Validate() error {
+	if c == nil {
+		return nil
+	}
+	var msg []string
+	for _, it := range slices.Concat(c.FailOn, c.SucceedOn) {
+		if _, err := regexp.Compile(it); err != nil {
+			msg = append(msg, fmt.Sprintf("success: некорректное выражение %s: %s", it, err))
+		}
+	}
+	for code := range c.Messages {
+		if _, err := strconv.Atoi(code); err != nil {
+			msg = append(msg, fmt.Sprintf("success: messages некорректный код выхода %s", code))
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "\n"))
+	}
+	return nil
+}
+
+func (c *SuccessPolicy) isExitCodeOk(code int) bool {
+	if c == nil || len(c.ExitCodes) == 0 {
+		return code == 0
+	}
+	return slices.Contains(c.ExitCodes, code)
+}
+
+// exitError ошибка по коду выхода с сообщением из Messages
+func (c *SuccessPolicy) exitError(code int) error {
+	if c != nil {
+		if msg, ok := c.Messages[strconv.Itoa(code)]; ok {
+			return errors.Errorf("exit code %d: %s", code, msg)
+		}
+	}
+	return errors.Errorf("exit code %d", code)
+}
+
+// outputMatcher проверяет построчно вывод команды на FailOn и SucceedOn
+type outputMatcher struct {
+	failOn    []*regexp.Regexp
+	succeedOn []*regexp.Regexp
+
+	lock    sync.Mutex
+	fail    string
+	succeed bool
+}
+
+// newOutputMatcher nil, если в правилах нет выражений
+func (c *SuccessPolicy) newOutputMatcher() (*outputMatcher, error) {
+	if c == nil || len(c.FailOn)+len(c.SucceedOn) == 0 {
+		return nil, nil
+	}
+	var res = &outputMatcher{}
+	for _, it := range c.FailOn {
+		re, err := regexp.Compile(it)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		res.failOn = append(res.failOn, re)
+	}
+	for _, it := range c.SucceedOn {
+		re, err := regexp.Compile(it)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		res.succeedOn = append(res.succeedOn, re)
+	}
+	return res, nil
+}
+
+func (c *outputMatcher) matchLine(line []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, re := range c.failOn {
+		if len(c.fail) == 0 && re.Match(line) {
+			c.fail = string(bytes.TrimSpace(line))
+		}
+	}
+	for _, re := range c.succeedOn {
+		if re.Match(line) {
+			c.succeed = true
+		}
+	}
+}
+
+// writer поток вывода, stdout и stderr проверяются отдельно, чтобы не склеивать строки
+func (c *outputMatcher) writer() *lineWriter {
+	return &lineWriter{fn: c.matchLine}
+}
+
+// lineWriter передает в fn записанные данные по строкам
+type lineWriter struct {
+	fn  func(line []byte)
+	buf []byte
+}
+
+func (c *lineWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		var idx = bytes.IndexAny(c.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+		if idx > 0 {
+			c.fn(c.buf[:idx])
+		}
+		c.buf = c.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Close передает в fn последнюю строку без перевода строки
+func (c *lineWriter) Close() error {
+	if len(c.buf) > 0 {
+		c.fn(c.buf)
+		c.buf = nil
+	}
+	return nil
+}
+
+// result итог команды по коду выхода и выводу
+func (c *outputMatcher) result(policy *SuccessPolicy, code int) error {
+	if c != nil {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if len(c.fail) > 0 {
+			return errors.Errorf("exit code %d, в выводе ошибка: %s", code, c.fail)
+		}
+		if c.succeed {
+			return nil
+		}
+	}
+	if policy.isExitCodeOk(code) {
+		return nil
+	}
+	return policy.exitError(code)
+}
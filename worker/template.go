@@ -0,0 +1,331 @@
+package worker
+
+import (
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+// Шаблоны Args: {name} или {name|filter|filter:arg}, {{ - символ {.
+// {...} с неизвестным именем и незакрытая { остаются в аргументе как есть: %{pts} у ffmpeg, JSON.
+// Переменные входящего файла:
+//   - {inputs} пути всех входящих файлов узла workflow, отдельным аргументом - по аргументу на файл
+//   - {input} путь входящего файла, {input.name} исходное имя файла (из ссылки или uploads),
+//     {input.stem} имя без расширения, {input.ext} расширение с точкой
+//   - {index} номер входящего файла с 0
+//   - {output} путь результата, {output_dir} папка результатов файла, {out_dir} папка результатов задания
+//   - {task.id} id задания
+//   - {var.<имя>} переменная из vars задания
+//
+// Фильтры: quote - в двойных кавычках, basename - имя файла из пути,
+// default:<значение> - значение, если переменная пустая или не задана в vars,
+// join:<разделитель> - склеить {inputs} в один аргумент. Аргумент фильтра с | или } пишется
+// в кавычках: {inputs|join:"|"}.
+
+// INPUTS_NAME переменная со списком входящих файлов
+const INPUTS_NAME = "inputs"
+
+// VAR_PREFIX префикс пользовательских переменных из Task.Vars
+const VAR_PREFIX = "var."
+
+// argNames переменные шаблонов, кроме пользовательских
+var argNames = map[string]bool{
+	"input":      true,
+	"inputs":     true,
+	"input.name": true,
+	"input.stem": true,
+	"input.ext":  true,
+	"index":      true,
+	"output":     true,
+	"output_dir": true,
+	"out_dir":    true,
+	"task.id":    true,
+}
+
+// probeArgNames переменные шаблонов args probe команды, которая проверяет один результат
+var probeArgNames = map[string]bool{
+	"output":  true,
+	"out_dir": true,
+	"task.id": true,
+}
+
+// argFilters фильтры шаблонов, arg - аргумент после :
+var argFilters = map[string]func(val, arg string) string{
+	"quote": func(val, _ string) string {
+		return `"` + strings.ReplaceAll(val, `"`, `\"`) + `"`
+	},
+	"basename": func(val, _ string) string {
+		return filepath.Base(val)
+	},
+	"default": func(val, arg string) string {
+		if len(val) == 0 {
+			return arg
+		}
+		return val
+	},
+	// join разделитель для {inputs}, применяется в renderArgs
+	"join": func(val, _ string) string {
+		return val
+	},
+}
+
+type argFilter struct {
+	name string
+	arg  string
+}
+
+// argPart часть шаблона: текст или переменная с фильтрами
+type argPart struct {
+	text    string
+	name    string
+	filters []argFilter
+}
+
+// parseArg разбирает шаблон аргумента
+func parseArg(s string) ([]argPart, error) {
+	var parts []argPart
+	var text strings.Builder
+	for len(s) > 0 {
+		var idx = strings.IndexByte(s, '{')
+		if idx < 0 {
+			text.WriteString(s)
+			break
+		}
+		text.WriteString(s[:idx])
+		s = s[idx:]
+		if strings.HasPrefix(s, "{{") {
+			text.WriteByte('{')
+			s = s[2:]
+			continue
+		}
+
+		fields, end, err := splitPlaceholder(s)
+		if err != nil || !isArgName(strings.TrimSpace(fields[0])) {
+			// не переменная, внутри могут быть переменные: {"file":"{output}"}
+			text.WriteByte('{')
+			s = s[1:]
+			continue
+		}
+		s = s[end+1:]
+
+		var part = argPart{name: strings.TrimSpace(fields[0])}
+		for _, it := range fields[1:] {
+			name, arg, _ := strings.Cut(it, ":")
+			name = strings.TrimSpace(name)
+			if unquoted, err := strconv.Unquote(arg); err == nil {
+				arg = unquoted
+			}
+			if _, ok := argFilters[name]; !ok {
+				return nil, errors.Errorf("неизвестный фильтр %s в {%s}", name, part.name)
+			}
+			part.filters = append(part.filters, argFilter{name: name, arg: arg})
+		}
+		if text.Len() > 0 {
+			parts = append(parts, argPart{text: text.String()})
+			text.Reset()
+		}
+		parts = append(parts, part)
+	}
+	if text.Len() > 0 {
+		parts = append(parts, argPart{text: text.String()})
+	}
+	return parts, nil
+}
+
+// isArgName имя переменной шаблонов, {...} с другими именами - текст
+func isArgName(name string) bool {
+	return argNames[name] || strings.HasPrefix(name, VAR_PREFIX)
+}
+
+// splitPlaceholder делит {...} в начале s по | и возвращает части и индекс }.
+// | и } внутри кавычек "..." не разделяют, например {inputs|join:"|"}.
+func splitPlaceholder(s string) ([]string, int, error) {
+	var fields []string
+	var start, quoted = 1, false
+	for idx := 1; idx < len(s); idx++ {
+		switch s[idx] {
+		case '\\':
+			if quoted {
+				idx++
+			}
+		case '"':
+			quoted = !quoted
+		case '|', '}':
+			if quoted {
+				continue
+			}
+			fields = append(fields, s[start:idx])
+			start = idx + 1
+			if s[idx] == '}' {
+				return fields, idx, nil
+			}
+		}
+	}
+	return nil, 0, errors.Errorf("не закрыта { в %s", s)
+}
+
+func (c *argPart) hasFilter(name string) bool {
+	for _, it := range c.filters {
+		if it.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateArgs проверяет шаблоны аргументов: синтаксис, переменные и фильтры.
+// Переменные var.<имя> должны быть в vars или иметь фильтр default.
+func ValidateArgs(args []string, vars map[string]string) error {
+	return validateArgs(args, vars, argNames)
+}
+
+// validateArgs как ValidateArgs с допустимыми переменными names
+func validateArgs(args []string, vars map[string]string, names map[string]bool) error {
+	var msg []string
+	for idx, arg := range args {
+		parts, err := parseArg(arg)
+		if err != nil {
+			msg = append(msg, "args["+strconv.Itoa(idx)+"]: "+err.Error())
+			continue
+		}
+		for _, part := range parts {
+			if len(part.name) == 0 || names[part.name] {
+				continue
+			}
+			if name, ok := strings.CutPrefix(part.name, VAR_PREFIX); ok {
+				if _, ok = vars[name]; ok || part.hasFilter("default") {
+					continue
+				}
+			}
+			msg = append(msg, "args["+strconv.Itoa(idx)+"]: неизвестная переменная {"+part.name+"}")
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "\n"))
+	}
+	return nil
+}
+
+// argsUse есть ли в шаблонах аргументов переменная name
+func argsUse(args []string, name string) bool {
+	for _, arg := range args {
+		parts, _ := parseArg(arg)
+		for _, part := range parts {
+			if part.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// argVars значения переменных шаблонов для входящего файла с номером idx
+func (c *Task) argVars(idx int) map[string]string {
+	var fileName = c.Files[idx]
+	return c.fileVars(idx, filepath.Join(c.InDir, fileName), c.GetOutPath(fileName), c.GetOutDirPath(fileName))
+}
+
+// fileVars значения переменных шаблонов с заданными путями входящего файла и результата,
+// {input.name} всегда исходное имя файла задания с номером idx
+func (c *Task) fileVars(idx int, input, output, outputDir string) map[string]string {
+	var source = c.Files[idx]
+	if idx < len(c.Sources) && len(c.Sources[idx]) > 0 {
+		source = c.Sources[idx]
+	}
+	var ext = path.Ext(source)
+
+	var res = map[string]string{
+		"input":      input,
+		"input.name": source,
+		"input.stem": strings.TrimSuffix(source, ext),
+		"input.ext":  ext,
+		"index":      strconv.Itoa(idx),
+		"output":     output,
+		"output_dir": outputDir,
+		"out_dir":    c.GetOutDir(),
+		"task.id":    c.ID,
+	}
+	for key, val := range c.Vars {
+		res[VAR_PREFIX+key] = val
+	}
+	return res
+}
+
+// outputVars значения переменных шаблонов probe команды для результата output
+func (c *Task) outputVars(output string) map[string]string {
+	var res = map[string]string{
+		"output":  output,
+		"out_dir": c.GetOutDir(),
+		"task.id": c.ID,
+	}
+	for key, val := range c.Vars {
+		res[VAR_PREFIX+key] = val
+	}
+	return res
+}
+
+// renderArgs подставляет переменные в шаблоны аргументов. {inputs} - список входящих файлов
+// (по умолчанию только {input}): аргумент из одной {inputs} раскрывается в несколько аргументов,
+// внутри текста файлы склеиваются через пробел или разделитель фильтра join.
+func renderArgs(args []string, vars map[string]string, inputs []string) ([]string, error) {
+	if inputs == nil {
+		inputs = []string{vars["input"]}
+	}
+
+	var res = make([]string, 0, len(args))
+	for _, arg := range args {
+		parts, err := parseArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 && parts[0].name == INPUTS_NAME && !parts[0].hasFilter("join") {
+			for _, it := range inputs {
+				res = append(res, parts[0].apply(it))
+			}
+			continue
+		}
+
+		var b strings.Builder
+		for _, part := range parts {
+			if len(part.name) == 0 {
+				b.WriteString(part.text)
+				continue
+			}
+			if part.name == INPUTS_NAME {
+				var vals = make([]string, len(inputs))
+				for idx, it := range inputs {
+					vals[idx] = part.apply(it)
+				}
+				b.WriteString(strings.Join(vals, part.joinSep()))
+				continue
+			}
+			val, ok := vars[part.name]
+			if !ok && !part.hasFilter("default") {
+				return nil, errors.Errorf("неизвестная переменная {%s}", part.name)
+			}
+			b.WriteString(part.apply(val))
+		}
+		res = append(res, b.String())
+	}
+	return res, nil
+}
+
+func (c *argPart) apply(val string) string {
+	for _, it := range c.filters {
+		val = argFilters[it.name](val, it.arg)
+	}
+	return val
+}
+
+// joinSep разделитель фильтра join, по умолчанию пробел
+func (c *argPart) joinSep() string {
+	for _, it := range c.filters {
+		if it.name == "join" {
+			return it.arg
+		}
+	}
+	return " "
+}
@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderArgs(t *testing.T) {
+	var task = &Task{
+		ID:      "777",
+		InDir:   "in",
+		OutDir:  "out",
+		OutExt:  ".mp4",
+		Files:   []string{"777_0", "777_1"},
+		Sources: []string{"movie.final.mov", ""},
+		Vars:    map[string]string{"bitrate": "500k", "title": `say "hi"`},
+		Args: []string{
+			"-i", "{input}",
+			"-b:v", "{var.bitrate}",
+			"-metadata", "title={var.title|quote}",
+			"-preset", "{var.preset|default:fast}",
+			"{out_dir}/{input.stem}_{index}{input.ext}",
+			"{output|basename}",
+			"drawtext=text=%{{pts}",
+		},
+	}
+	if err := ValidateArgs(task.Args, task.Vars); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := renderArgs(task.Args, task.argVars(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{
+		"-i", filepath.Join("in", "777_0"),
+		"-b:v", "500k",
+		"-metadata", `title="say \"hi\""`,
+		"-preset", "fast",
+		"out/movie.final_0.mov",
+		"777_0.mp4",
+		"drawtext=text=%{pts}",
+	}
+	if strings.Join(args, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("args %q", args)
+	}
+
+	// {inputs} отдельным аргументом и через join
+	args, err = renderArgs([]string{"{inputs|basename}", `concat:{inputs|join:"|"}`, "{inputs|join:,}"},
+		task.argVars(0), []string{"a/1.ts", "a/2.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, " ") != "1.ts 2.ts concat:a/1.ts|a/2.ts a/1.ts,a/2.ts" {
+		t.Errorf("inputs %q", args)
+	}
+
+	// {...} не из переменных шаблонов остается как есть
+	args, err = renderArgs([]string{"drawtext=text=%{pts}", `{"format":{"file":"{output|basename}"}}`, "{}", "{inptu", "{input"},
+		task.argVars(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, " ") != `drawtext=text=%{pts} {"format":{"file":"777_0.mp4"}} {} {inptu {input` {
+		t.Errorf("pass through %q", args)
+	}
+
+	// без исходного имени используется имя файла в in_dir
+	args, _ = renderArgs([]string{"{input.name}"}, task.argVars(1), nil)
+	if args[0] != "777_1" {
+		t.Errorf("input.name %q", args[0])
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	var tests = []struct {
+		arg string
+		ok  bool
+	}{
+		{"{input}", true},
+		{"-i{input}.mp4", true},
+		{"{inptu}", true},
+		{"{var.crf}", false},
+		{"{var.crf|default:23}", true},
+		{"{input|upper}", false},
+		{"{input", true},
+		{"{}", true},
+		{"{{input}", true},
+		{`{inputs|join:"|"}`, true},
+		{`{inputs|join:"|}`, true},
+		{`{"format":{"name":"{var.fmt}"}}`, false},
+	}
+	for _, it := range tests {
+		if err := ValidateArgs([]string{it.arg}, nil); it.ok != (err == nil) {
+			t.Errorf("%s: err %v", it.arg, err)
+		}
+	}
+}
@@ -1,15 +1,34 @@
 package worker
 
 import (
-	"os/exec"
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
+	"sync"
+	"time"
 
 	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
 )
 
 const (
 	INPUT  = "{input}"
 	OUTPUT = "{output}"
+	// OUTPUT_DIR папка результатов одного входящего файла, для команд с несколькими результатами
+	OUTPUT_DIR = "{output_dir}"
+)
+
+// InputMode способ интерпретации Urls задания
+type InputMode string
+
+const (
+	// InputModeUrls каждая ссылка - один входящий файл
+	InputModeUrls InputMode = ""
+	// InputModeFtpGlob ссылки ftp:// с шаблоном, например ftp://host/in/*.mov,
+	// обрабатываются все подходящие под шаблон файлы
+	InputModeFtpGlob InputMode = "ftp_glob"
 )
 
 type StateCode int8
@@ -21,9 +40,21 @@ const (
 	SAVING
 	CANCEL
 	FINISH
+	// VERIFY проверка результатов перед сохранением, добавлен после FINISH для совместимости кодов
+	VERIFY
+	// PAUSED задание на паузе, после продолжения возвращается в прежнее состояние
+	PAUSED
 	ERROR StateCode = 127
 )
 
+// категории ошибок Task.ErrKind, кроме названий этапов
+const (
+	ErrKindVerify = "verify"
+	ErrKindCancel = "cancel"
+	ErrKindUpload = "upload"
+	ErrKindLimit  = "limit"
+)
+
 func (c StateCode) String() string {
 	switch c {
 	case CREATE:
@@ -38,6 +69,10 @@ func (c StateCode) String() string {
 		return "CANCEL"
 	case FINISH:
 		return "FINISH"
+	case VERIFY:
+		return "VERIFY"
+	case PAUSED:
+		return "PAUSED"
 	case ERROR:
 		return "ERROR"
 	default:
@@ -48,25 +83,176 @@ func (c StateCode) String() string {
 type Task struct {
 	ID string `json:"id"`
 	// request
-	InDir  string   `json:"in_dir"`
-	OutDir string   `json:"out_dir"`
-	Urls   []string `json:"urls"`
-	Cmd    string   `json:"cmd"`
-	Args   []string `json:"args"`
-	OutExt string   `json:"out_ext"`
+	InDir     string    `json:"in_dir"`
+	OutDir    string    `json:"out_dir"`
+	Urls      []string  `json:"urls"`
+	InputMode InputMode `json:"input_mode"`
+	Cmd       string    `json:"cmd"`
+	Args      []string  `json:"args"`
+	OutExt    string    `json:"out_ext"`
+	// OutGlob шаблон результатов в папке {output_dir}, например *.ts.
+	// Если задан или в Args есть {output_dir}, то результатами считаются все подходящие файлы
+	OutGlob string `json:"out_glob,omitempty"`
+	// Steps цепочка команд вместо Cmd и Args
+	Steps []*Step `json:"steps,omitempty"`
+	// Workflow граф команд с map и reduce узлами вместо Cmd и Args
+	Workflow *Workflow `json:"workflow,omitempty"`
+	// Env переменные окружения команд, дополняют разрешенные в env_allow переменные сервиса
+	Env map[string]string `json:"env,omitempty"`
+	// WorkingDir рабочая папка команд, внутри work_roots конфига
+	WorkingDir string `json:"working_dir,omitempty"`
+	// Stdin стандартный ввод команды Cmd
+	Stdin *Stdin `json:"stdin,omitempty"`
+	// Success правила успешного завершения команд: коды выхода и выражения на вывод
+	Success *SuccessPolicy `json:"success,omitempty"`
+	// Limits ограничения ресурсов команд, дополняют limits конфига
+	Limits *config.Limits `json:"limits,omitempty"`
+	// Vars пользовательские переменные для {var.<имя>} в Args
+	Vars map[string]string `json:"vars,omitempty"`
+	// Checksum дополнительные контрольные суммы и файлы с ними
+	Checksum ChecksumOptions `json:"checksum"`
+	// Verify проверки результатов перед сохранением, nil - этап VERIFY пропускается
+	Verify *VerifyOptions `json:"verify,omitempty"`
+	// Destinations куда сохраняются результаты, в каждом свой статус сохранения
+	Destinations []*Destination `json:"destinations"`
+	// Uploads входящие файлы, которые загружаются в агент запросом
+	Uploads []*UploadFile `json:"uploads,omitempty"`
+	// Tags метки задания для отбора в списке заданий
+	Tags []string `json:"tags,omitempty"`
+	// Request исходный запрос задания, сохраняется при остановке агента для перезапуска
+	Request json.RawMessage `json:"-"`
 	// processing
-	Files []string  `json:"files"`
-	State StateCode `json:"state"`
-	Msg   string    `json:"msg"`
+	// Created время, когда задание принято агентом
+	Created time.Time `json:"created"`
+	Files   []string  `json:"files"`
+	// Sources исходные имена входящих файлов Files (из ссылки или uploads) для {input.name}
+	Sources []string   `json:"sources"`
+	Outputs []*OutFile `json:"outputs"`
+	State   StateCode  `json:"state"`
+	Msg     string     `json:"msg"`
+	// ErrKind категория ошибки при State ERROR: download, process, verify, saving, upload, cancel, limit
+	ErrKind string `json:"err_kind,omitempty"`
+	// stateLock State, Msg и ErrKind меняются воркером, паузой и отменой задания из разных горутин,
+	// их нужно читать через GetState, GetErrKind, GetMsg. Остальные поля, которые выдает MarshalJSON,
+	// во время выполнения меняются через update
+	stateLock sync.RWMutex
+
+	// proc дерево процессов выполняемой команды, для принудительной остановки
+	proc *procTree
+	// pause пауза задания, nil если задание не передано в Worker
+	pause *pauseGate
+	// outDirs созданные папки {output_dir}
+	outDirs []string
+	// from этап, с которого запускается копия задания (Clone), CREATE - все этапы
+	from StateCode
+
+	// wait ожидание загрузки Uploads, nil если задание файлов не ждет
+	wait *uploadWait
+}
+
+// taskJSON Task без своего MarshalJSON
+type taskJSON Task
+
+// MarshalJSON задание с состоянием, прочитанным под stateLock, пароли в ссылках скрыты
+func (c *Task) MarshalJSON() ([]byte, error) {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return json.Marshal(&struct {
+		*taskJSON
+		Urls []string `json:"urls"`
+	}{(*taskJSON)(c), RedactUrls(c.Urls)})
+}
+
+// GetState состояние задания
+func (c *Task) GetState() StateCode {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.State
+}
 
-	cmd       *exec.Cmd `json:"-"`
-	ftp       *Ftp      `json:"-"`
-	saveToFtp bool      `json:"-"`
+// GetErrKind категория ошибки задания в состоянии ERROR
+func (c *Task) GetErrKind() string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.ErrKind
 }
 
-func (c *Task) SaveToFtp(ftp *Ftp) {
-	c.saveToFtp = true
-	c.ftp = ftp
+// GetMsg ошибка задания в состоянии ERROR
+func (c *Task) GetMsg() string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.Msg
+}
+
+// update меняет поля задания в fn под stateLock, чтобы не мешать MarshalJSON
+func (c *Task) update(fn func()) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	fn()
+}
+
+// OutFile исходящий файл задания
+type OutFile struct {
+	// Name имя файла относительно GetOutDir
+	Name string `json:"name"`
+	Path string `json:"-"`
+	// Size и контрольные суммы заполняются после обработки
+	Size   int64  `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+	Md5    string `json:"md5,omitempty"`
+}
+
+// FindOutput ищет исходящий файл по имени
+func (c *Task) FindOutput(name string) (*OutFile, bool) {
+	for _, out := range c.Outputs {
+		if out.Name == name {
+			return out, true
+		}
+	}
+	return nil, false
+}
+
+// IsTmpOut результаты собираются во временной папке и удаляются после сохранения
+func (c *Task) IsTmpOut() bool {
+	return len(c.OutDir) == 0
+}
+
+// addFile добавляет входящий файл fileName с исходным именем source
+func (c *Task) addFile(fileName, source string) {
+	c.Files = append(c.Files, fileName)
+	c.Sources = append(c.Sources, source)
+}
+
+// nextFileName имя для очередного входящего файла в InDir
+func (c *Task) nextFileName() string {
+	return fmt.Sprintf("%s_%d", c.ID, len(c.Files))
+}
+
+// Cmds команды задания: Cmd, команды шагов Steps и узлов Workflow без повторов
+func (c *Task) Cmds() []string {
+	var res []string
+	var add = func(cmd string) {
+		if len(cmd) > 0 && !slices.Contains(res, cmd) {
+			res = append(res, cmd)
+		}
+	}
+	add(c.Cmd)
+	for _, it := range c.Steps {
+		add(it.Cmd)
+	}
+	if c.Workflow != nil {
+		for _, it := range c.Workflow.Nodes {
+			add(it.Cmd)
+		}
+	}
+	return res
+}
+
+// setCreated время приема задания, если оно еще не задано
+func (c *Task) setCreated() {
+	if c.Created.IsZero() {
+		c.Created = time.Now()
+	}
 }
 
 func (c *Task) GetOutDir() string {
@@ -77,12 +263,88 @@ func (c *Task) GetOutDir() string {
 }
 
 func (c *Task) GetOutPath(fileName string) string {
+	if c.IsMultiOut() {
+		return filepath.Join(c.GetOutDirPath(fileName), fileName) + c.OutExt
+	}
 	var filePath = filepath.Join(c.GetOutDir(), fileName)
 	return filePath + c.OutExt
 }
 
+// IsMultiOut команда создает несколько результатов на входящий файл в папке {output_dir}
+func (c *Task) IsMultiOut() bool {
+	if len(c.OutGlob) > 0 {
+		return true
+	}
+	return argsUse(c.Args, "output_dir")
+}
+
+// GetOutDirPath папка результатов входящего файла fileName для {output_dir}
+func (c *Task) GetOutDirPath(fileName string) string {
+	return filepath.Join(c.GetOutDir(), fileName)
+}
+
+// outGlob шаблон результатов, по умолчанию все файлы
+func (c *Task) outGlob() string {
+	if len(c.OutGlob) == 0 {
+		return "*"
+	}
+	return c.OutGlob
+}
+
+func (c *Task) addOutput(fileName string) {
+	c.Outputs = append(c.Outputs, &OutFile{
+		Name: fileName + c.OutExt,
+		Path: c.GetOutPath(fileName),
+	})
+}
+
+// collectOutputs добавляет в результаты файлы папки {output_dir} по шаблону OutGlob
+func (c *Task) collectOutputs(fileName string) error {
+	outputs, err := c.globOutputs(c.GetOutDirPath(fileName), c.outGlob())
+	if err != nil {
+		return err
+	}
+	c.Outputs = append(c.Outputs, outputs...)
+	return nil
+}
+
+// globOutputs файлы папки dir по шаблону pattern, имена относительно GetOutDir
+func (c *Task) globOutputs(dir, pattern string) ([]*OutFile, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, errors.Errorf("outputs %s err %+v", pattern, err)
+	}
+
+	var res []*OutFile
+	for _, filePath := range matches {
+		if info, err := os.Stat(filePath); err != nil || info.IsDir() {
+			continue
+		}
+		name, err := filepath.Rel(c.GetOutDir(), filePath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		res = append(res, &OutFile{Name: filepath.ToSlash(name), Path: filePath})
+	}
+	if len(res) == 0 {
+		return nil, errors.Errorf("нет результатов по шаблону %s в папке %s", pattern, dir)
+	}
+	return res, nil
+}
+
+// makeOutDir создает папку {output_dir}, она удаляется целиком вместе с результатами
+func (c *Task) makeOutDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	c.outDirs = append(c.outDirs, dir)
+	return nil
+}
+
 type Ftp struct {
 	Addr  string `json:"addr"`
 	Login string `json:"login"`
 	Pass  string `json:"pass"`
+	// Tls подключение по ftps (implicit TLS)
+	Tls bool `json:"tls,omitempty"`
 }
@@ -0,0 +1,195 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+var (
+	ErrTaskNotFound    = errors.New("Задание не найдено")
+	ErrUploadUnknown   = errors.New("Файл не объявлен в uploads задания")
+	ErrUploadDuplicate = errors.New("Файл уже загружен или загружается")
+	ErrUploadClosed    = errors.New("Задание не ожидает загрузки файлов")
+	ErrUploadTooLarge  = errors.New("Превышен допустимый размер файла")
+)
+
+// UploadFile входящий файл, который передается в агент запросом,
+// а не скачивается по ссылке
+type UploadFile struct {
+	Name string `json:"name"`
+	// File имя файла в InDir
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	Done bool   `json:"done"`
+
+	receiving bool
+}
+
+// uploadWait ожидание загрузки входящих файлов задания
+type uploadWait struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+// AddUploads объявляет входящие файлы, которые будут загружены в агент.
+// Имена файлов в InDir резервируются сразу, поэтому скачанные по Urls файлы идут после них.
+func (c *Task) AddUploads(names []string) {
+	for _, name := range names {
+		var fileName = c.nextFileName()
+		c.addFile(fileName, name)
+		c.Uploads = append(c.Uploads, &UploadFile{Name: name, File: fileName})
+	}
+}
+
+// WaitUploads сохраняет задание, которое ждет загрузки входящих файлов.
+// После загрузки последнего файла задание ставится в очередь,
+// если файлы не загружены за timeout, то задание переводится в ERROR.
+func (c *Worker) WaitUploads(task *Task, timeout time.Duration) {
+	var wait = &uploadWait{}
+	wait.lock.Lock()
+	defer wait.lock.Unlock()
+	task.wait = wait
+	task.pause = newPauseGate()
+	task.setCreated()
+	c.store.Store(task.ID, task)
+	wait.timer = time.AfterFunc(timeout, func() {
+		c.closeUploads(task, errors.Errorf("Истекло время ожидания загрузки файлов %s", timeout))
+	})
+}
+
+// waitsUploads задание ждет загрузки входящих файлов
+func (c *Task) waitsUploads() bool {
+	var wait = c.wait
+	if wait == nil {
+		return false
+	}
+	wait.lock.Lock()
+	defer wait.lock.Unlock()
+	return !wait.closed
+}
+
+// closeUploads прекращает ожидание файлов, удаляет загруженные и переводит задание в ERROR.
+// Возвращает false, если задание не ожидало файлов.
+func (c *Worker) closeUploads(task *Task, err error) bool {
+	var wait = task.wait
+	if wait == nil {
+		return false
+	}
+	wait.lock.Lock()
+	if wait.closed {
+		wait.lock.Unlock()
+		return false
+	}
+	wait.closed = true
+	wait.timer.Stop()
+	wait.lock.Unlock()
+
+	log.Error("Task %s uploads closed: %+v", task.ID, err)
+	clearFolders(task)
+	var kind = ErrKindUpload
+	if err == context.Canceled {
+		kind = ErrKindCancel
+	}
+	c.fail(task.ID, kind, err)
+	return true
+}
+
+// Upload сохраняет файл name задания id из r, не больше maxSize байт (0 - без ограничения).
+// Если это последний ожидаемый файл, то задание ставится в очередь, а если в ней нет места,
+// то ждет места в агенте (ExecTaskLater).
+func (c *Worker) Upload(ctx context.Context, id, name string, r io.Reader, maxSize int64) (*UploadFile, error) {
+	task, ok := c.store.Load(id)
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	var wait = task.wait
+	if wait == nil {
+		return nil, ErrUploadClosed
+	}
+
+	wait.lock.Lock()
+	var idx = slices.IndexFunc(task.Uploads, func(it *UploadFile) bool { return it.Name == name })
+	switch {
+	case idx < 0:
+		wait.lock.Unlock()
+		return nil, ErrUploadUnknown
+	case wait.closed:
+		wait.lock.Unlock()
+		return nil, ErrUploadClosed
+	case task.Uploads[idx].Done || task.Uploads[idx].receiving:
+		wait.lock.Unlock()
+		return nil, ErrUploadDuplicate
+	}
+	var up = task.Uploads[idx]
+	up.receiving = true
+	wait.lock.Unlock()
+
+	var filePath = filepath.Join(task.InDir, up.File)
+	size, err := writeUpload(ctx, filePath, r, maxSize)
+
+	wait.lock.Lock()
+	up.receiving = false
+	if err == nil && wait.closed {
+		err = ErrUploadClosed
+	}
+	if err != nil {
+		wait.lock.Unlock()
+		if rmErr := os.Remove(filePath); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Error("Task %s os.Remove error, filePath %s, err %+v\n", task.ID, filePath, rmErr)
+		}
+		return nil, err
+	}
+	// Uploads выдаются в задании, поэтому Done и Size меняются и под stateLock
+	task.update(func() {
+		up.Done = true
+		up.Size = size
+	})
+	var ready = !slices.ContainsFunc(task.Uploads, func(it *UploadFile) bool { return !it.Done })
+	if ready {
+		wait.closed = true
+		wait.timer.Stop()
+	}
+	wait.lock.Unlock()
+
+	log.Debug("Task %s upload %s saved to %s, size %d\n", task.ID, name, filePath, size)
+	if ready {
+		log.Info("Task %s all uploads received", task.ID)
+		// запрос загрузки не ждет места в очереди
+		c.ExecTaskLater(task)
+	}
+	return up, nil
+}
+
+func writeUpload(ctx context.Context, filePath string, r io.Reader, maxSize int64) (int64, error) {
+	out, err := os.Create(filePath)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer out.Close()
+
+	var src = &ctxReader{ctx: ctx, r: r}
+	var n int64
+	if maxSize > 0 {
+		// читаем на байт больше, чтобы отличить файл ровно maxSize
+		n, err = io.Copy(out, io.LimitReader(src, maxSize+1))
+		if err == nil && n > maxSize {
+			err = ErrUploadTooLarge
+		}
+	} else {
+		n, err = io.Copy(out, src)
+	}
+	if err != nil {
+		return n, errors.WithStack(err)
+	}
+	return n, errors.WithStack(out.Close())
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/store"
+)
+
+func TestUpload(t *testing.T) {
+	var ctx, cf = context.WithCancel(context.TODO())
+	defer cf()
+	var w = New(store.NewRam[string, *Task](ctx))
+
+	var task = &Task{ID: "444", InDir: t.TempDir()}
+	task.AddUploads([]string{"a.mp4", "b.mp4"})
+	w.WaitUploads(task, time.Minute)
+	var stop = marshalLoop(task)
+	defer stop()
+
+	if _, err := w.Upload(ctx, "444", "c.mp4", strings.NewReader("c"), 0); err != ErrUploadUnknown {
+		t.Errorf("unknown err %v", err)
+	}
+	if _, err := w.Upload(ctx, "444", "a.mp4", strings.NewReader("too large"), 3); errors.Cause(err) != ErrUploadTooLarge {
+		t.Errorf("too large err %v", err)
+	}
+	if _, err := w.Upload(ctx, "444", "a.mp4", strings.NewReader("aaa"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Upload(ctx, "444", "a.mp4", strings.NewReader("aaa"), 0); err != ErrUploadDuplicate {
+		t.Errorf("duplicate err %v", err)
+	}
+	if len(w.taskQueue) != 0 {
+		t.Fatal("task queued before all uploads")
+	}
+	if _, err := w.Upload(ctx, "444", "b.mp4", strings.NewReader("bbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.taskQueue) != 1 {
+		t.Fatal("task not queued")
+	}
+	if _, err := w.Upload(ctx, "444", "b.mp4", strings.NewReader("bbb"), 0); err != ErrUploadClosed {
+		t.Errorf("after start err %v", err)
+	}
+	if buffer, _ := os.ReadFile(filepath.Join(task.InDir, task.Files[1])); string(buffer) != "bbb" {
+		t.Errorf("file %q", buffer)
+	}
+
+	// без места в очереди задание ждет его в агенте, а не падает в ошибку
+	for w.queueRoom() > 0 {
+		w.taskQueue <- &Task{}
+	}
+	var later = &Task{ID: "445", InDir: t.TempDir()}
+	later.AddUploads([]string{"a.mp4"})
+	w.WaitUploads(later, time.Minute)
+	if _, err := w.Upload(ctx, "445", "a.mp4", strings.NewReader("aaa"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.backlog) != 1 || later.GetState() != CREATE {
+		t.Errorf("backlog %d state %v", len(w.backlog), later.GetState())
+	}
+}
+
+func TestUploadTimeout(t *testing.T) {
+	var ctx, cf = context.WithCancel(context.TODO())
+	defer cf()
+	var w = New(store.NewRam[string, *Task](ctx))
+
+	var task = &Task{ID: "555", InDir: t.TempDir()}
+	task.AddUploads([]string{"a.mp4", "b.mp4"})
+	w.WaitUploads(task, 50*time.Millisecond)
+	if _, err := w.Upload(ctx, "555", "a.mp4", strings.NewReader("aaa"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if task.GetState() != ERROR {
+		t.Errorf("state %v", task.GetState())
+	}
+	if _, err := os.Stat(filepath.Join(task.InDir, task.Files[0])); !os.IsNotExist(err) {
+		t.Errorf("uploaded file not removed: %v", err)
+	}
+	if _, err := w.Upload(ctx, "555", "b.mp4", strings.NewReader("bbb"), 0); err != ErrUploadClosed {
+		t.Errorf("closed err %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// VerifyOptions проверки результатов перед сохранением (этап VERIFY)
+type VerifyOptions struct {
+	// MinSize минимальный размер каждого результата в байтах
+	MinSize int64 `json:"min_size,omitempty"`
+	// Ext допустимые расширения результатов, например [".mp4"]
+	Ext []string `json:"ext,omitempty"`
+	// Count ожидаемое количество результатов, 0 - не проверять
+	Count int `json:"count,omitempty"`
+	// Probe команда проверки каждого результата
+	Probe *ProbeOptions `json:"probe,omitempty"`
+}
+
+// ProbeOptions команда, которая выводит JSON описание результата (например ffprobe),
+// и правила на этот JSON. Args - шаблоны, как args задания, с переменными {output} (путь результата),
+// {out_dir}, {task.id} и {var.<имя>}.
+type ProbeOptions struct {
+	Cmd   string      `json:"cmd"`
+	Args  []string    `json:"args"`
+	Rules []ProbeRule `json:"rules"`
+}
+
+// ProbeRule правило на JSON вывод probe команды.
+// Path путь через точку, * - любой элемент массива, например streams.*.codec_type.
+// Правило выполнено, если условию удовлетворяет хотя бы одно найденное значение.
+type ProbeRule struct {
+	Path  string `json:"path"`
+	Op    string `json:"op"`
+	Value any    `json:"value,omitempty"`
+}
+
+// операции ProbeRule
+const (
+	ProbeOpExists = "exists"
+	ProbeOpEq     = "eq"
+	ProbeOpNe     = "ne"
+	ProbeOpGt     = "gt"
+	ProbeOpGte    = "gte"
+	ProbeOpLt     = "lt"
+	ProbeOpLte    = "lte"
+)
+
+// VerifyError результат не прошел проверку. Задание переходит в ERROR с err_kind verify.
+type VerifyError struct {
+	Name string
+	Msg  string
+}
+
+func (c *VerifyError) Error() string {
+	if len(c.Name) == 0 {
+		return "verify: " + c.Msg
+	}
+	return fmt.Sprintf("verify %s: %s", c.Name, c.Msg)
+}
+
+// Validate проверяет настройки при создании задания и приводит расширения к виду .ext,
+// vars - переменные задания для шаблонов args probe
+func (c *VerifyOptions) Validate(vars map[string]string) error {
+	for idx, ext := range c.Ext {
+		if len(ext) > 0 && ext[0] != '.' {
+			c.Ext[idx] = "." + ext
+		}
+	}
+	if c.MinSize < 0 || c.Count < 0 {
+		return errors.New("verify: min_size и count не могут быть отрицательными")
+	}
+	if c.Probe == nil {
+		return nil
+	}
+	if len(c.Probe.Cmd) == 0 {
+		return errors.New("verify: не задана команда probe")
+	}
+	if err := validateArgs(c.Probe.Args, vars, probeArgNames); err != nil {
+		return errors.New("verify: probe " + err.Error())
+	}
+	for idx, rule := range c.Probe.Rules {
+		if len(rule.Path) == 0 {
+			return errors.Errorf("verify: rules[%d] не задан path", idx)
+		}
+		switch rule.Op {
+		case ProbeOpExists:
+		case ProbeOpEq, ProbeOpNe, ProbeOpGt, ProbeOpGte, ProbeOpLt, ProbeOpLte:
+			if rule.Value == nil {
+				return errors.Errorf("verify: rules[%d] не задан value", idx)
+			}
+		default:
+			return errors.Errorf("verify: rules[%d] неизвестная операция %s", idx, rule.Op)
+		}
+	}
+	return nil
+}
+
+// verifyOutputs проверяет результаты задания по task.Verify
+func verifyOutputs(ctx context.Context, task *Task) error {
+	var opts = task.Verify
+	if opts.Count > 0 && len(task.Outputs) != opts.Count {
+		return &VerifyError{Msg: fmt.Sprintf("ожидалось результатов %d, получено %d", opts.Count, len(task.Outputs))}
+	}
+
+	for _, out := range task.Outputs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		info, err := os.Stat(out.Path)
+		if err != nil {
+			return &VerifyError{Name: out.Name, Msg: err.Error()}
+		}
+		if info.Size() == 0 || info.Size() < opts.MinSize {
+			return &VerifyError{Name: out.Name, Msg: fmt.Sprintf("размер %d меньше допустимого %d", info.Size(), max(opts.MinSize, 1))}
+		}
+		if len(opts.Ext) > 0 && !slices.ContainsFunc(opts.Ext, func(ext string) bool {
+			return strings.EqualFold(ext, filepath.Ext(out.Name))
+		}) {
+			return &VerifyError{Name: out.Name, Msg: fmt.Sprintf("расширение %s не из %v", filepath.Ext(out.Name), opts.Ext)}
+		}
+		if opts.Probe != nil {
+			if err = probeOutput(ctx, task, opts.Probe, out); err != nil {
+				return err
+			}
+		}
+		log.Debug("Task %s verify successfully, fileName %s\n", task.ID, out.Name)
+	}
+	return nil
+}
+
+func probeOutput(ctx context.Context, task *Task, probe *ProbeOptions, out *OutFile) error {
+	args, err := renderArgs(probe.Args, task.outputVars(out.Path), nil)
+	if err != nil {
+		return &VerifyError{Name: out.Name, Msg: fmt.Sprintf("probe %s: %s", probe.Cmd, err)}
+	}
+
+	// как команды задания: окружение env_allow, working_dir, лимиты и остановка всего дерева процессов
+	var stdout, stderr bytes.Buffer
+	if err = runCmd(ctx, task, &cmdSpec{name: probe.Cmd, args: args, stdout: &stdout}, false, &stderr); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &VerifyError{Name: out.Name, Msg: fmt.Sprintf("probe %s: %s %s", probe.Cmd, err, strings.TrimSpace(stderr.String()))}
+	}
+
+	var doc any
+	if err = json.Unmarshal(stdout.Bytes(), &doc); err != nil {
+		return &VerifyError{Name: out.Name, Msg: fmt.Sprintf("probe %s: некорректный JSON: %s", probe.Cmd, err)}
+	}
+	for _, rule := range probe.Rules {
+		if !rule.match(doc) {
+			return &VerifyError{Name: out.Name, Msg: fmt.Sprintf("probe правило не выполнено: %s %s %v", rule.Path, rule.Op, rule.Value)}
+		}
+	}
+	log.Debug("Task %s probe successfully, fileName %s\n", task.ID, out.Name)
+	return nil
+}
+
+func (c *ProbeRule) match(doc any) bool {
+	var values = lookupJson(doc, strings.Split(c.Path, "."))
+	if c.Op == ProbeOpExists {
+		return len(values) > 0
+	}
+	for _, val := range values {
+		if compareJson(val, c.Op, c.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJson значения по пути, * раскрывается во все элементы массива или объекта
+func lookupJson(doc any, path []string) []any {
+	if len(path) == 0 {
+		return []any{doc}
+	}
+	var key, rest = path[0], path[1:]
+	var res []any
+	switch node := doc.(type) {
+	case map[string]any:
+		if key == "*" {
+			for _, it := range node {
+				res = append(res, lookupJson(it, rest)...)
+			}
+		} else if it, ok := node[key]; ok {
+			res = lookupJson(it, rest)
+		}
+	case []any:
+		if key == "*" {
+			for _, it := range node {
+				res = append(res, lookupJson(it, rest)...)
+			}
+		} else if idx, err := strconv.Atoi(key); err == nil && idx >= 0 && idx < len(node) {
+			res = lookupJson(node[idx], rest)
+		}
+	}
+	return res
+}
+
+// compareJson сравнивает значение JSON с ожидаемым. Строки с числами
+// (ffprobe выводит duration как "12.5") сравниваются как числа.
+func compareJson(val any, op string, expected any) bool {
+	a, aNum := jsonNumber(val)
+	b, bNum := jsonNumber(expected)
+	if aNum && bNum {
+		switch op {
+		case ProbeOpEq:
+			return a == b
+		case ProbeOpNe:
+			return a != b
+		case ProbeOpGt:
+			return a > b
+		case ProbeOpGte:
+			return a >= b
+		case ProbeOpLt:
+			return a < b
+		case ProbeOpLte:
+			return a <= b
+		}
+		return false
+	}
+
+	var as, bs = fmt.Sprint(val), fmt.Sprint(expected)
+	switch op {
+	case ProbeOpEq:
+		return as == bs
+	case ProbeOpNe:
+		return as != bs
+	}
+	return false
+}
+
+func jsonNumber(val any) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
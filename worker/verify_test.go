@@ -0,0 +1,157 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
+)
+
+func TestVerifyOutputs(t *testing.T) {
+	var outDir = t.TempDir()
+	var outPath = filepath.Join(outDir, "777_0.mp4")
+	if err := os.WriteFile(outPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		opts VerifyOptions
+		ok   bool
+	}{
+		{VerifyOptions{MinSize: 5, Ext: []string{".MP4"}, Count: 1}, true},
+		{VerifyOptions{MinSize: 6}, false},
+		{VerifyOptions{Ext: []string{".mov"}}, false},
+		{VerifyOptions{Count: 2}, false},
+	}
+	for idx, it := range tests {
+		var err = verifyOutputs(context.TODO(), verifyTask(outPath, it.opts))
+		if it.ok != (err == nil) {
+			t.Errorf("%d: err %v", idx, err)
+		}
+		if _, ok := errors.Cause(err).(*VerifyError); err != nil && !ok {
+			t.Errorf("%d: not VerifyError %T", idx, err)
+		}
+	}
+
+	if err := verifyOutputs(context.TODO(), verifyTask(outPath, VerifyOptions{})); err != nil {
+		t.Error(err)
+	}
+	os.WriteFile(outPath, nil, 0644)
+	if err := verifyOutputs(context.TODO(), verifyTask(outPath, VerifyOptions{})); err == nil {
+		t.Error("expected empty file error")
+	}
+}
+
+func TestVerifyProbe(t *testing.T) {
+	echo, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip("echo not found")
+	}
+	var outPath = filepath.Join(t.TempDir(), "777_0.mp4")
+	os.WriteFile(outPath, []byte("hello"), 0644)
+
+	const probeJson = `{"format":{"duration":"12.50"},"streams":[{"codec_type":"audio"},{"codec_type":"video","width":1920}]}`
+	var newTask = func(rules ...ProbeRule) *Task {
+		// args probe - шаблоны, { пишется как {{
+		var arg = strings.ReplaceAll(probeJson, "{", "{{")
+		return verifyTask(outPath, VerifyOptions{Probe: &ProbeOptions{Cmd: echo, Args: []string{arg}, Rules: rules}})
+	}
+
+	var tests = []struct {
+		rule ProbeRule
+		ok   bool
+	}{
+		{ProbeRule{Path: "format.duration", Op: ProbeOpGt, Value: 10.0}, true},
+		{ProbeRule{Path: "format.duration", Op: ProbeOpLt, Value: "10"}, false},
+		{ProbeRule{Path: "streams.*.codec_type", Op: ProbeOpEq, Value: "video"}, true},
+		{ProbeRule{Path: "streams.0.codec_type", Op: ProbeOpEq, Value: "video"}, false},
+		{ProbeRule{Path: "streams.*.width", Op: ProbeOpGte, Value: 1920.0}, true},
+		{ProbeRule{Path: "streams.*.height", Op: ProbeOpExists}, false},
+	}
+	for idx, it := range tests {
+		var err = verifyOutputs(context.TODO(), newTask(it.rule))
+		if it.ok != (err == nil) {
+			t.Errorf("%d: err %v", idx, err)
+		}
+	}
+
+	// некорректный JSON
+	var task = newTask()
+	task.Verify.Probe.Args = []string{"not json"}
+	if _, ok := verifyOutputs(context.TODO(), task).(*VerifyError); !ok {
+		t.Error("expected VerifyError")
+	}
+
+	// probe запускается как команды задания: в working_dir и с окружением env_allow
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return
+	}
+	config.InitFromJson(strings.NewReader(`{"env_allow":["PATH"]}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+	t.Setenv("AGENT_SECRET", "secret")
+	task = newTask(ProbeRule{Path: "dir", Op: ProbeOpEq, Value: filepath.Dir(outPath)}, ProbeRule{Path: "secret", Op: ProbeOpEq, Value: ""})
+	task.WorkingDir = filepath.Dir(outPath)
+	task.Verify.Probe.Cmd = sh
+	task.Verify.Probe.Args = []string{"-c", `printf '{{"dir":"%s","secret":"%s"}' "$(pwd)" "$AGENT_SECRET"`}
+	if err = verifyOutputs(context.TODO(), task); err != nil {
+		t.Error(err)
+	}
+
+	// {output} подставляется по правилам шаблонов args
+	task = newTask(ProbeRule{Path: "name", Op: ProbeOpEq, Value: "777_0.mp4"})
+	task.Verify.Probe.Cmd = sh
+	task.Verify.Probe.Args = []string{"-c", `printf '{{"name":"%s"}' "$1"`, "probe", "{output|basename}"}
+	if err = verifyOutputs(context.TODO(), task); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyValidate(t *testing.T) {
+	var opts = &VerifyOptions{Ext: []string{"mp4", ".mov"}}
+	if err := opts.Validate(nil); err != nil || opts.Ext[0] != ".mp4" {
+		t.Errorf("err %v ext %v", err, opts.Ext)
+	}
+
+	var data = `{"probe":{"cmd":"ffprobe","rules":[{"path":"format.duration","op":"between","value":1}]}}`
+	if err := json.Unmarshal([]byte(data), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.Validate(nil); err == nil {
+		t.Error("expected unknown op error")
+	}
+	opts.Probe.Rules[0].Op = ProbeOpGt
+	opts.Probe.Rules[0].Value = nil
+	if err := opts.Validate(nil); err == nil {
+		t.Error("expected value error")
+	}
+
+	// args probe проверяются как args задания, входящих файлов у probe нет
+	opts.Probe.Rules[0].Value = 1
+	opts.Probe.Args = []string{"-i", "{output|quote}", "{var.fmt}", "{task.id}"}
+	if err := opts.Validate(map[string]string{"fmt": "json"}); err != nil {
+		t.Error(err)
+	}
+	for _, arg := range []string{"{input}", "{output|upper}", "{var.none}"} {
+		opts.Probe.Args = []string{arg}
+		if err := opts.Validate(nil); err == nil {
+			t.Errorf("%s: expected args error", arg)
+		}
+	}
+}
+
+// verifyTask задание с результатом outPath и проверками opts
+func verifyTask(outPath string, opts VerifyOptions) *Task {
+	return &Task{
+		ID:      "777",
+		OutDir:  filepath.Dir(outPath),
+		Outputs: []*OutFile{{Name: filepath.Base(outPath), Path: outPath}},
+		Verify:  &opts,
+	}
+}
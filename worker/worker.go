@@ -5,14 +5,30 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"mediamagi.ru/win-file-agent/config"
+	"mediamagi.ru/win-file-agent/errors"
 	"mediamagi.ru/win-file-agent/log"
 	"mediamagi.ru/win-file-agent/store"
 )
 
+// stages этапы обработки задания в порядке выполнения
+var stages = []struct {
+	state   StateCode
+	handler workerHandler
+	// skip этап не выполняется для задания, nil - выполняется всегда
+	skip func(task *Task) bool
+}{
+	{DOWNLOAD, downloadFiles, nil},
+	{PROCESS, executeTask, nil},
+	{VERIFY, verifyOutputs, func(task *Task) bool { return task.Verify == nil }},
+	{SAVING, checksumOutputs, nil},
+	{SAVING, saveOutputs, nil},
+}
+
 type Worker struct {
 	cancel       context.CancelFunc
 	count        int
@@ -22,8 +38,21 @@ type Worker struct {
 	store        store.Store[string, *Task]
 	storeProc    store.Store[string, context.CancelFunc]
 	shutdownOnce sync.Once
+	// queuePause пауза агента, воркеры не берут новые задания из очереди
+	queuePause *queueGate
+	// drain остановка агента с завершением заданий
+	drain *drainGate
+	// admitLock постановка в очередь: место в ней проверяется и занимается одной операцией
+	admitLock sync.Mutex
+	// backlog задания, которые ждут места в очереди, под admitLock
+	backlog []*Task
+	// clears отложенное удаление файлов заданий
+	clears *clearQueue
 }
 
+// backlogInterval как часто задания из backlog переносятся в очередь
+var backlogInterval = 200 * time.Millisecond
+
 func New(storeT store.Store[string, *Task]) *Worker {
 	var cfg = config.Load()
 	var workerCount = cfg.WorkerCount
@@ -39,10 +68,13 @@ func New(storeT store.Store[string, *Task]) *Worker {
 	}
 
 	return &Worker{
-		count:     workerCount,
-		taskQueue: make(chan *Task, workerQueue),
-		store:     storeT,
-		storeProc: store.NewRam[string, context.CancelFunc](context.TODO()),
+		count:      workerCount,
+		taskQueue:  make(chan *Task, workerQueue),
+		store:      storeT,
+		storeProc:  store.NewRam[string, context.CancelFunc](context.TODO()),
+		queuePause: &queueGate{},
+		drain:      &drainGate{done: make(chan struct{})},
+		clears:     &clearQueue{timers: make(map[*Task]*time.Timer)},
 	}
 }
 
@@ -54,6 +86,7 @@ func (c *Worker) Run(ctx context.Context) error {
 		c.wg.Add(1)
 		go c.workerLoop(ctx)
 	}
+	go c.feedBacklog(ctx)
 
 	return nil
 }
@@ -78,19 +111,83 @@ func (c *Worker) Stop() {
 
 		// 4) Принудительно завершаем «живающие» внешние процессы
 		c.stopAllChildProcesses()
+
+		// 5) После перезапуска агент не знает о заданиях, поэтому их файлы удаляются сразу
+		c.clears.flush()
 	})
 }
 
-func (c *Worker) ExecTask(t *Task) {
+// ExecTask ставит задание в очередь без ожидания, ErrQueueFull если в ней нет места
+func (c *Worker) ExecTask(t *Task) error {
+	return c.ExecBatch([]*Task{t})
+}
+
+// ExecTaskLater ставит задание в очередь, когда в ней появится место. До этого задание
+// хранится в агенте в состоянии CREATE и сохраняется при остановке агента
+func (c *Worker) ExecTaskLater(t *Task) {
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	if c.queueRoom() > 0 {
+		c.enqueue(t)
+		return
+	}
+	c.admit(t)
+	c.backlog = append(c.backlog, t)
+	log.Info("Task %s waits for queue room", t.ID)
+}
+
+// queueRoom место в очереди с учетом заданий backlog, вызывается под admitLock
+func (c *Worker) queueRoom() int {
+	return cap(c.taskQueue) - len(c.taskQueue) - len(c.backlog)
+}
+
+// admit сохраняет принятое задание в store, вызывается под admitLock
+func (c *Worker) admit(t *Task) {
+	if t.pause == nil {
+		t.pause = newPauseGate()
+	}
+	t.setCreated()
 	c.store.Store(t.ID, t)
+}
+
+// enqueue вызывается под admitLock после проверки места в очереди,
+// поэтому отправка в taskQueue не ждет
+func (c *Worker) enqueue(t *Task) {
+	c.admit(t)
 	c.taskQueue <- t
 }
 
+// feedBacklog переносит задания из backlog в очередь по мере освобождения места
+func (c *Worker) feedBacklog(ctx context.Context) {
+	var ticker = time.NewTicker(backlogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.admitLock.Lock()
+		for len(c.backlog) > 0 && len(c.taskQueue) < cap(c.taskQueue) {
+			var t = c.backlog[0]
+			c.backlog = c.backlog[1:]
+			// отмененное задание в очередь не попадает
+			if t.GetState() != ERROR {
+				c.taskQueue <- t
+			}
+		}
+		c.admitLock.Unlock()
+	}
+}
+
 func (c *Worker) StopProc(key string) (bool, error) {
 	var v, ok = c.store.Load(key)
 	if !ok {
 		return ok, nil
 	}
+	if c.closeUploads(v, context.Canceled) {
+		return false, nil
+	}
 
 	c.stopProc(key, v)
 	return false, nil
@@ -104,97 +201,291 @@ func (c *Worker) workerLoop(ctx context.Context) {
 			// Ожидаем завершения текущей задачи (если нужно)
 			return
 		case task := <-c.taskQueue:
+			// на паузе агента взятое из очереди задание ждет продолжения
+			if err := c.queuePause.wait(ctx); err != nil {
+				return
+			}
+			// задание на паузе возвращается в очередь в Resume
+			if task.pause.park() {
+				log.Info("Task %s parked until resume", task.ID)
+				continue
+			}
 			func() {
 				var ctxPrc, cf = context.WithCancel(ctx)
-				c.storeProc.Store(task.ID, cf)
+				ctxPrc = withPause(ctxPrc, task.pause)
+				if !c.startProc(task, cf) {
+					// задание отменено в очереди
+					cf()
+					return
+				}
+				var finished = false
 				defer func() {
 					c.storeProc.Delete(task.ID)
-					clearFolders(task)
+					if !finished && task.GetErrKind() == ErrKindCancel {
+						clearFolders(task)
+						return
+					}
+					// файлы задания нужны для скачивания результатов и перезапуска с этапа,
+					// пока задание хранится в агенте
+					var retention = errorRetention
+					if finished {
+						retention = outputRetention()
+					}
+					c.clears.later(task, retention)
 				}()
 
-				var handlers = map[StateCode]workerHandler{
-					DOWNLOAD: downloadFiles,
-					PROCESS:  executeTask,
-					SAVING:   ftpStore,
-				}
-				for state, handler := range handlers {
-					c.setState(task.ID, state)
-					if err := handler(ctxPrc, task); err != nil {
-						log.Error("Task %s %s error: %+v", task.ID, state, err)
-						c.setState(task.ID, ERROR, err)
+				var started = task.from == CREATE
+				for _, it := range stages {
+					// копия задания начинается с этапа from
+					if started = started || it.state == task.from; !started {
+						continue
+					}
+					if it.skip != nil && it.skip(task) {
+						continue
+					}
+					// на паузе следующий этап не начинается
+					var err = task.pause.wait(ctxPrc)
+					if err == nil {
+						c.setState(task.ID, it.state)
+						err = it.handler(ctxPrc, task)
+					}
+					if err != nil {
+						log.Error("Task %s %s error: %+v", task.ID, it.state, err)
+						c.fail(task.ID, errKind(ctxPrc, it.state, err), err)
 						return
 					}
 				}
 
 				log.Info("Task %s finished successfully", task.ID)
+				finished = true
 				c.setState(task.ID, FINISH)
 			}()
 		}
 	}
 }
 
+// stopAllChildProcesses убивает деревья процессов, которые не завершились после отмены контекста
 func (c *Worker) stopAllChildProcesses() {
-	c.store.Range(c.stopProc)
+	// stopProc меняет состояние заданий в store, поэтому не внутри Range
+	var tasks []*Task
+	c.store.Range(func(key string, task *Task) bool {
+		tasks = append(tasks, task)
+		return true
+	})
+	for _, task := range tasks {
+		c.stopProc(task.ID, task)
+		if proc := task.proc; proc != nil && task.GetState() == PROCESS {
+			if err := proc.kill(); err != nil {
+				log.Error("Failed to kill child %s: %+v", task.ID, err)
+			} else {
+				log.Info("Killed child %s", task.ID)
+			}
+		}
+	}
 }
 
+// startProc сохраняет отмену cf задания, которое воркер взял из очереди.
+// false, если задание уже отменено в очереди
+func (c *Worker) startProc(task *Task, cf context.CancelFunc) bool {
+	task.stateLock.Lock()
+	defer task.stateLock.Unlock()
+	if task.State == ERROR {
+		return false
+	}
+	c.storeProc.Store(task.ID, cf)
+	return true
+}
+
+// stopProc отменяет контекст задания. Команда останавливается в runCmd:
+// мягкая остановка всего дерева процессов, через stop_grace - kill
 func (c *Worker) stopProc(key string, task *Task) bool {
-	if cf, ok := c.storeProc.Load(key); ok {
-		cf()
+	task.stateLock.Lock()
+	// процессы продолжаются, чтобы получить сигнал остановки
+	var prev, parked, resumed = task.pause.resume()
+	if resumed && !parked && task.State == PAUSED {
+		task.State = prev
 	}
+	var state = task.State
+	var cf, running = c.storeProc.Load(key)
+	// задание в очереди или снятое с нее на паузе не запускается,
+	// проверка и отмена под stateLock, как и в startProc
+	var queued = parked || (!running && state == CREATE)
+	if queued {
+		c.failLocked(task, ErrKindCancel, context.Canceled)
+	}
+	task.stateLock.Unlock()
 
-	if task.State != PROCESS {
+	if queued {
+		c.store.SetTimeout(key, time.Now().Add(errorRetention))
+		if parked {
+			log.Info("Task %s canceled on pause", key)
+		} else {
+			log.Info("Task %s canceled in queue", key)
+		}
+		clearFolders(task)
 		return true
 	}
+	if running {
+		cf()
+	}
+	if state == PROCESS {
+		log.Info("Task %s stopping child processes", key)
+	}
+	return true
+}
 
-	var cmd = task.cmd
-	if cmd == nil {
-		log.Error("Task %s cmd == nil", key)
-		return true
+func (c *Worker) setState(id string, state StateCode) {
+	task, ok := c.store.Load(id)
+	if !ok {
+		return
 	}
-	// 1) Если процесс уже завершён – skip
-	if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
-		return true
+	task.stateLock.Lock()
+	// на паузе новое состояние запоминается до продолжения
+	if state != FINISH && task.pause.holdState(state) {
+		task.stateLock.Unlock()
+		return
+	}
+	task.State = state
+	task.stateLock.Unlock()
+	if state == FINISH {
+		c.store.SetTimeout(id, time.Now().Add(outputRetention()))
 	}
+}
 
-	// 2) Отправляем graceful‑kill (Ctrl+C) – но для cmd.exe/PowerShell это не всегда работает.
-	// Лучше сразу kill
-	if err := cmd.Process.Kill(); err != nil {
-		log.Error("Failed to kill child %s: %+v", key, err)
-	} else {
-		log.Info("Killed child %s", key)
+// fail переводит задание в ERROR, kind - категория ошибки ErrKind
+func (c *Worker) fail(id, kind string, err error) {
+	task, ok := c.store.Load(id)
+	if !ok {
+		return
 	}
+	task.stateLock.Lock()
+	c.failLocked(task, kind, err)
+	task.stateLock.Unlock()
+	c.store.SetTimeout(id, time.Now().Add(errorRetention))
+}
 
-	return true
+// failLocked как fail, вызывается под task.stateLock. Время хранения задания
+// задается после снятия stateLock: store читает состояние заданий под своей блокировкой,
+// поэтому блокировки store под stateLock не берутся
+func (c *Worker) failLocked(task *Task, kind string, err error) {
+	task.State = ERROR
+	task.ErrKind = kind
+	task.Msg = fmt.Sprintf("%s", []error{err})
 }
 
-func (c *Worker) setState(id string, state StateCode, errs ...error) {
-	if task, ok := c.store.Load(id); ok {
-		task.State = state
-		if state == ERROR {
-			task.Msg = fmt.Sprintf("%s", errs)
-			c.store.SetTimeout(id, time.Now().Add(time.Minute))
-		}
-		if state == FINISH {
-			c.store.SetTimeout(id, time.Now().Add(time.Minute))
+// errKind категория ошибки задания: cancel при отмене, verify если результат
+// не прошел проверку, иначе этап, на котором произошла ошибка
+func errKind(ctx context.Context, state StateCode, err error) string {
+	if ctx.Err() != nil {
+		return ErrKindCancel
+	}
+	if _, ok := errors.Cause(err).(*VerifyError); ok {
+		return ErrKindVerify
+	}
+	if _, ok := limitCause(err); ok {
+		return ErrKindLimit
+	}
+	return strings.ToLower(state.String())
+}
+
+// errorRetention сколько задание хранится после ERROR
+var errorRetention = time.Minute
+
+// outputRetention сколько задание и его результаты хранятся после FINISH
+func outputRetention() time.Duration {
+	if sec := config.Load().OutputRetention; sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return time.Minute
+}
+
+// stopGrace сколько команда завершается после мягкой остановки
+func stopGrace() time.Duration {
+	if sec := config.Load().StopGrace; sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// clearQueue удаление файлов заданий по истечении времени хранения.
+// Таймеры не переживают остановку агента, поэтому при остановке файлы удаляются сразу (flush)
+type clearQueue struct {
+	lock   sync.Mutex
+	timers map[*Task]*time.Timer
+	// flushed агент остановлен, файлы новых заданий удаляются без ожидания
+	flushed bool
+}
+
+// later удаляет файлы задания через after
+func (c *clearQueue) later(task *Task, after time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.flushed {
+		clearFolders(task)
+		return
+	}
+	c.timers[task] = time.AfterFunc(after, func() {
+		c.lock.Lock()
+		var _, ok = c.timers[task]
+		delete(c.timers, task)
+		c.lock.Unlock()
+		// после flush таймер мог сработать, но файлы уже удалены
+		if ok {
+			clearFolders(task)
 		}
+	})
+}
+
+// flush удаляет файлы всех заданий, ожидающих удаления
+func (c *clearQueue) flush() {
+	c.lock.Lock()
+	c.flushed = true
+	var tasks = make([]*Task, 0, len(c.timers))
+	for task, timer := range c.timers {
+		timer.Stop()
+		tasks = append(tasks, task)
 	}
+	clear(c.timers)
+	c.lock.Unlock()
+
+	for _, task := range tasks {
+		clearFolders(task)
+	}
+	log.Info("Files of %d finished tasks removed on shutdown", len(tasks))
 }
 
 func clearFolders(task *Task) {
-	// удаляем файлы
+	clearInputs(task)
+	clearOutputs(task)
+}
+
+// clearInputs удаляет входящие файлы
+func clearInputs(task *Task) {
 	for _, fileName := range task.Files {
 		var filePath = filepath.Join(task.InDir, fileName)
 		if err := os.Remove(filePath); err != nil {
 			log.Error("Task %s os.Remove error, filePath %s, err %+v\n", task.ID, filePath, err)
 		}
 		log.Debug("Task %s os.Remove successfully, filePath %s\n", task.ID, filePath)
-		if task.saveToFtp {
-			filePath = task.GetOutPath(fileName)
-			if err := os.Remove(filePath); err != nil {
-				log.Error("Task %s os.Remove error, filePath %s, err %+v\n", task.ID, filePath, err)
-			} else {
-				log.Debug("Task %s os.Remove successfully, filePath %s\n", task.ID, filePath)
-			}
+	}
+}
+
+// clearOutputs удаляет результаты, если они собирались во временной папке
+func clearOutputs(task *Task) {
+	if !task.IsTmpOut() {
+		return
+	}
+	for _, out := range task.Outputs {
+		if err := os.Remove(out.Path); err != nil {
+			log.Error("Task %s os.Remove error, filePath %s, err %+v\n", task.ID, out.Path, err)
+		} else {
+			log.Debug("Task %s os.Remove successfully, filePath %s\n", task.ID, out.Path)
+		}
+	}
+	// папки {output_dir} вместе с файлами, не попавшими под шаблон
+	for _, dir := range task.outDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error("Task %s os.RemoveAll error, dir %s, err %+v\n", task.ID, dir, err)
 		}
 	}
 }
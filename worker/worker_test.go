@@ -2,11 +2,17 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"mediamagi.ru/win-file-agent/config"
 	"mediamagi.ru/win-file-agent/store"
 )
 
@@ -36,7 +42,7 @@ func TestWorker(t *testing.T) {
 				//	}
 				//	return
 				//}
-				if t.State == FINISH || t.State == ERROR {
+				if state := t.GetState(); state == FINISH || state == ERROR {
 					return
 				}
 
@@ -76,3 +82,84 @@ func defaultTask() *Task {
 		OutExt: ".mp4",
 	}
 }
+
+// runWorker запущенный Worker для теста и путь к sh, без sh тест пропускается
+func runWorker(t *testing.T) (*Worker, string) {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	var ctx, cf = context.WithCancel(context.TODO())
+	t.Cleanup(cf)
+	var w = New(store.NewRam[string, *Task](ctx))
+	if err = w.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return w, sh
+}
+
+// shTask задание с командой sh -c script и входящим файлом <id>_0 в новой папке
+func shTask(t *testing.T, sh, id, outDir, script string) *Task {
+	t.Helper()
+	var inDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(inDir, id+"_0"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &Task{ID: id, InDir: inDir, OutDir: outDir, Files: []string{id + "_0"}, Cmd: sh,
+		Args: []string{"-c", script}}
+}
+
+// waitState ждет, пока задание перейдет в состояние state
+func waitState(t *testing.T, task *Task, state StateCode) {
+	t.Helper()
+	for range 250 {
+		if task.GetState() == state {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("task %s state %s, expected %s", task.ID, task.GetState(), state)
+}
+
+func TestWorkerStopClears(t *testing.T) {
+	config.InitFromJson(strings.NewReader(`{"worker_count":1,"worker_queue":10,"output_retention":3600}`))
+	defer config.InitFromJson(strings.NewReader(`{"port":8099,"worker_count":1,"worker_queue":10}`))
+
+	var w, sh = runWorker(t)
+	var task = shTask(t, sh, "321", t.TempDir(), "cp {input} {output}")
+	var input = filepath.Join(task.InDir, task.Files[0])
+	w.ExecTask(task)
+	waitState(t, task, FINISH)
+	// файлы хранятся output_retention, но не дольше работы агента
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(input); err != nil {
+		t.Fatalf("input removed before retention: %v", err)
+	}
+	w.Stop()
+	if _, err := os.Stat(input); !os.IsNotExist(err) {
+		t.Errorf("input is not removed on stop: %v", err)
+	}
+}
+
+// marshalLoop выдает задание в json, как GET /task, пока не вызвана stop.
+// С -race проверяет, что выполнение задания меняет выдаваемые поля под stateLock
+func marshalLoop(task *Task) (stop func()) {
+	var done = make(chan struct{})
+	var stopped = make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				json.Marshal(task)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,310 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"mediamagi.ru/win-file-agent/errors"
+	"mediamagi.ru/win-file-agent/log"
+)
+
+// режимы узла workflow
+const (
+	// NodeMap команда выполняется для каждого входящего файла, файлы обрабатываются параллельно
+	NodeMap = "map"
+	// NodeReduce команда выполняется один раз для всех входящих файлов ({inputs})
+	NodeReduce = "reduce"
+)
+
+// DefaultParallel сколько команд workflow выполняется одновременно по умолчанию
+const DefaultParallel = 2
+
+// Workflow граф команд задания. Узел запускается, когда завершены все узлы из его Needs,
+// независимые узлы и файлы map узлов выполняются параллельно, не больше Parallel команд.
+type Workflow struct {
+	Parallel int     `json:"parallel,omitempty"`
+	Nodes    []*Node `json:"nodes"`
+}
+
+// Node узел workflow. Входящие файлы узла - результаты узлов Needs (с учетом их Pass)
+// или входящие файлы задания, если Needs пустой. Результаты узлов, от которых никто
+// не зависит (и узлов с Keep), - результаты задания, остальные удаляются после выполнения.
+type Node struct {
+	Step
+	Needs []string `json:"needs,omitempty"`
+	// Mode map (по умолчанию) или reduce
+	Mode string `json:"mode,omitempty"`
+}
+
+var nodeNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (c *Workflow) parallel() int {
+	if c.Parallel <= 0 {
+		return DefaultParallel
+	}
+	return c.Parallel
+}
+
+func (c *Workflow) findNode(name string) *Node {
+	for _, node := range c.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// isTerminal от узла не зависит ни один другой узел
+func (c *Workflow) isTerminal(name string) bool {
+	for _, node := range c.Nodes {
+		if slices.Contains(node.Needs, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate проверяет граф: имена узлов, зависимости, циклы и команды узлов
+func (c *Workflow) Validate(vars map[string]string) error {
+	if len(c.Nodes) == 0 {
+		return errors.New("workflow: не заданы nodes")
+	}
+	if c.Parallel < 0 {
+		return errors.New("workflow: parallel не может быть отрицательным")
+	}
+
+	var msg []string
+	var steps = make([]*Step, 0, len(c.Nodes))
+	for idx, node := range c.Nodes {
+		if node == nil {
+			return errors.Errorf("workflow: nodes[%d] пустой узел", idx)
+		}
+		steps = append(steps, &node.Step)
+	}
+	if err := ValidateSteps(steps, vars); err != nil {
+		msg = append(msg, err.Error())
+	}
+
+	for idx, node := range c.Nodes {
+		if !nodeNameRe.MatchString(node.Name) {
+			msg = append(msg, fmt.Sprintf("nodes[%d]: имя %s может содержать только латиницу, цифры, _ и -", idx, node.Name))
+		} else if c.findNode(node.Name) != node {
+			msg = append(msg, fmt.Sprintf("nodes[%d]: повторяется имя %s", idx, node.Name))
+		}
+		switch node.Mode {
+		case "", NodeMap, NodeReduce:
+		default:
+			msg = append(msg, fmt.Sprintf("nodes[%d]: неизвестный mode %s", idx, node.Mode))
+		}
+		for _, need := range node.Needs {
+			if c.findNode(need) == nil {
+				msg = append(msg, fmt.Sprintf("nodes[%d]: неизвестный узел %s в needs", idx, need))
+			}
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "\n"))
+	}
+
+	// поиск цикла обходом в глубину
+	var state = make(map[string]int)
+	var visit func(node *Node) bool
+	visit = func(node *Node) bool {
+		switch state[node.Name] {
+		case 1:
+			return false
+		case 2:
+			return true
+		}
+		state[node.Name] = 1
+		for _, need := range node.Needs {
+			if !visit(c.findNode(need)) {
+				return false
+			}
+		}
+		state[node.Name] = 2
+		return true
+	}
+	for _, node := range c.Nodes {
+		if !visit(node) {
+			return errors.Errorf("workflow: цикл в needs узла %s", node.Name)
+		}
+	}
+	return nil
+}
+
+// nodeResult результат выполнения узла
+type nodeResult struct {
+	node    *Node
+	outputs []stepInput
+	err     error
+}
+
+// executeWorkflow выполняет узлы workflow по мере готовности их зависимостей.
+// После первой ошибки новые узлы не запускаются, а выполняющиеся отменяются.
+func executeWorkflow(ctx context.Context, task *Task) error {
+	var wf = task.Workflow
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var runner = &outputRunner{task: task}
+	defer runner.clear()
+
+	var files = make([]stepInput, len(task.Files))
+	for idx, fileName := range task.Files {
+		files[idx] = stepInput{idx: idx, path: filepath.Join(task.InDir, fileName)}
+	}
+
+	var sem = make(chan struct{}, wf.parallel())
+	var results = make(chan nodeResult)
+	var outputs = make(map[string][]stepInput)
+	var running = 0
+	var firstErr error
+
+	// состояния узлов выдаются в задании во время выполнения и меняются под stateLock,
+	// читаются без блокировки, потому что меняются только в этой горутине
+	var ready = func(node *Node) bool {
+		if firstErr != nil || node.State != CREATE {
+			return false
+		}
+		return !slices.ContainsFunc(node.Needs, func(need string) bool { return wf.findNode(need).State != FINISH })
+	}
+
+	for {
+		for _, node := range wf.Nodes {
+			if !ready(node) {
+				continue
+			}
+
+			var inputs = files
+			if len(node.Needs) > 0 {
+				inputs = nil
+				for _, need := range node.Needs {
+					inputs = append(inputs, outputs[need]...)
+				}
+			}
+			var keep = node.Keep || wf.isTerminal(node.Name)
+			task.update(func() { node.State = PROCESS })
+			running++
+			go func(node *Node) {
+				outs, err := runNode(ctx, runner, sem, node, keep, inputs)
+				results <- nodeResult{node: node, outputs: outs, err: err}
+			}(node)
+		}
+		if running == 0 {
+			break
+		}
+
+		var res = <-results
+		running--
+		if res.err != nil {
+			task.update(func() {
+				res.node.State = ERROR
+				res.node.Msg = res.err.Error()
+			})
+			if firstErr == nil {
+				firstErr = errors.Errorf("node %s err %+v", res.node.Name, res.err)
+				if _, ok := limitCause(res.err); ok {
+					firstErr = errors.WithMessagef(res.err, "node %s", res.node.Name)
+				}
+				cancel()
+			}
+			continue
+		}
+		task.update(func() { res.node.State = FINISH })
+		outputs[res.node.Name] = res.outputs
+		log.Debug("Task %s node %s successfully, outputs %d\n", task.ID, res.node.Name, len(res.outputs))
+	}
+
+	if firstErr != nil {
+		task.update(func() {
+			for _, node := range wf.Nodes {
+				if node.State == CREATE {
+					node.State = CANCEL
+				}
+			}
+		})
+		return firstErr
+	}
+
+	// узлы выполняются параллельно, порядок результатов по имени
+	task.update(func() {
+		sort.SliceStable(task.Outputs, func(i, j int) bool { return task.Outputs[i].Name < task.Outputs[j].Name })
+	})
+	return nil
+}
+
+// runNode выполняет узел: map - для каждого входящего файла параллельно, reduce - один раз для всех.
+// Возвращает результаты, которые передаются зависимым узлам.
+func runNode(ctx context.Context, runner *outputRunner, sem chan struct{}, node *Node,
+	keep bool, inputs []stepInput) ([]stepInput, error) {
+
+	var task = runner.task
+	var stderr = &tailWriter{max: stepLogSize}
+	defer task.update(func() { node.Log = stderr.String() })
+
+	if len(inputs) == 0 {
+		return nil, errors.New("нет входящих файлов")
+	}
+
+	var run = func(base string, idx int, paths []string) ([]*OutFile, error) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-sem }()
+		return runner.run(ctx, &node.Step, keep, base, idx, paths, stderr)
+	}
+
+	if node.Mode == NodeReduce {
+		var paths = make([]string, len(inputs))
+		for idx, in := range inputs {
+			paths[idx] = in.path
+		}
+		outputs, err := run(fmt.Sprintf("%s_%s", task.ID, node.Name), inputs[0].idx, paths)
+		if err != nil {
+			return nil, err
+		}
+		return node.pass(inputs[0].idx, outputs), nil
+	}
+
+	// ошибка одного файла отменяет остальные файлы узла
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var next = make([][]stepInput, len(inputs))
+	var errOnce sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for idx, in := range inputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs, err := run(fmt.Sprintf("%s_%s_%d", task.ID, node.Name, idx), in.idx, []string{in.path})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			next[idx] = node.pass(in.idx, outputs)
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var res []stepInput
+	for _, it := range next {
+		res = append(res, it...)
+	}
+	return res, nil
+}
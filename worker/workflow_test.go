@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestExecuteWorkflow(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	var inDir, outDir = t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(inDir, "555_0"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(inDir, "555_1"), []byte("y"), 0644)
+
+	var node = func(name, mode, args string, needs ...string) *Node {
+		return &Node{Step: Step{Name: name, Cmd: sh, Args: []string{"-c", args}}, Mode: mode, Needs: needs}
+	}
+	var task = &Task{
+		ID:     "555",
+		InDir:  inDir,
+		OutDir: outDir,
+		Files:  []string{"555_0", "555_1"},
+		Workflow: &Workflow{Parallel: 3, Nodes: []*Node{
+			node("concat", NodeReduce, "cat {inputs} > {output}", "renditions"),
+			node("transcode", NodeMap, "cp {input} {output}"),
+			node("renditions", NodeMap, "cd {output_dir} && cp {input} r1.b && cp {input} r2.b", "transcode"),
+			node("thumb", NodeMap, "echo {input.name} > {output}"),
+		}},
+	}
+	task.Workflow.Nodes[0].OutExt = ".c"
+	if err = task.Workflow.Validate(nil); err != nil {
+		t.Fatal(err)
+	}
+	var stop = marshalLoop(task)
+	if err = executeTask(context.TODO(), task); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	var names []string
+	for _, out := range task.Outputs {
+		names = append(names, out.Name)
+	}
+	if len(names) != 3 || names[0] != "555_concat.c" || names[1] != "555_thumb_0" || names[2] != "555_thumb_1" {
+		t.Errorf("outputs %v", names)
+	}
+	if buffer, _ := os.ReadFile(filepath.Join(outDir, "555_concat.c")); string(buffer) != "xxyy" {
+		t.Errorf("concat %q", buffer)
+	}
+	// промежуточные результаты удалены
+	if entries, _ := os.ReadDir(outDir); len(entries) != 3 {
+		t.Errorf("out dir entries %d", len(entries))
+	}
+	for _, it := range task.Workflow.Nodes {
+		if it.State != FINISH {
+			t.Errorf("node %s state %s", it.Name, it.State)
+		}
+	}
+
+	// ошибка узла отменяет зависимые
+	task.Outputs = nil
+	for _, it := range task.Workflow.Nodes {
+		it.State = CREATE
+	}
+	task.Workflow.Nodes[1].Args = []string{"-c", "exit 1"}
+	if err = executeTask(context.TODO(), task); err == nil {
+		t.Fatal("expected node error")
+	}
+	if task.Workflow.Nodes[1].State != ERROR || task.Workflow.Nodes[2].State != CANCEL || task.Workflow.Nodes[0].State != CANCEL {
+		t.Errorf("states %s %s %s", task.Workflow.Nodes[1].State, task.Workflow.Nodes[2].State, task.Workflow.Nodes[0].State)
+	}
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	var node = func(name string, needs ...string) *Node {
+		return &Node{Step: Step{Name: name, Cmd: "cmd", Args: []string{"{input}"}}, Needs: needs}
+	}
+	var tests = []struct {
+		nodes []*Node
+		ok    bool
+	}{
+		{[]*Node{node("a"), node("b", "a")}, true},
+		{[]*Node{node("a", "b"), node("b", "a")}, false},
+		{[]*Node{node("a"), node("a")}, false},
+		{[]*Node{node("a", "missing")}, false},
+		{[]*Node{node("a b")}, false},
+		{nil, false},
+	}
+	for idx, it := range tests {
+		var wf = &Workflow{Nodes: it.nodes}
+		if err := wf.Validate(nil); it.ok != (err == nil) {
+			t.Errorf("%d: err %v", idx, err)
+		}
+	}
+}